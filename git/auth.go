@@ -0,0 +1,240 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// environ returns the environment git commands are run with. Unless the
+// repo allows prompts, git is stopped from asking for credentials on the
+// terminal or through an askpass program, so a command with missing or
+// wrong credentials fails rather than waiting for input forever. ssh is
+// forced through the askpass program too, so it doesn't prompt on the
+// terminal for passphrases either
+func (r *Repo) environ(ctx context.Context) ([]string, error) {
+	env := os.Environ()
+
+	if !r.AllowPrompts {
+		env = mergeEnv(env, map[string]string{
+			"GIT_TERMINAL_PROMPT": "0",
+			"GIT_ASKPASS":         "true",
+			"SSH_ASKPASS":         "true",
+			"SSH_ASKPASS_REQUIRE": "force",
+		})
+	}
+
+	env = mergeEnv(env, r.Env)
+
+	if r.GnuPGHome != "" {
+		env = mergeEnv(env, map[string]string{"GNUPGHOME": r.GnuPGHome})
+	}
+
+	ssh, err := r.sshCommand(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := map[string]string{"GIT_SSH_COMMAND": ssh}
+
+	if r.Token != "" {
+		auth["VERIFY_GIT_USERNAME"] = r.TokenUsername
+		if r.TokenUsername == "" {
+			auth["VERIFY_GIT_USERNAME"] = "x-access-token"
+		}
+		auth["VERIFY_GIT_TOKEN"] = r.Token
+	}
+
+	return mergeEnv(env, auth), nil
+}
+
+// mergeEnv returns env with the variables in vars added, replacing any of
+// the same name
+func mergeEnv(env []string, vars map[string]string) []string {
+	if len(vars) == 0 {
+		return env
+	}
+
+	merged := make([]string, 0, len(env)+len(vars))
+	for _, kv := range env {
+		if _, ok := vars[strings.SplitN(kv, "=", 2)[0]]; !ok {
+			merged = append(merged, kv)
+		}
+	}
+
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		merged = append(merged, k+"="+vars[k])
+	}
+
+	return merged
+}
+
+// HostKeyPolicy decides how ssh treats host keys of remotes it has not
+// seen before
+type HostKeyPolicy int
+
+const (
+	// HostKeyStrict refuses to connect to hosts whose key is not already
+	// known
+	HostKeyStrict HostKeyPolicy = iota
+	// HostKeyAcceptNew records the keys of hosts seen for the first time,
+	// but still refuses to connect to known hosts whose key has changed
+	HostKeyAcceptNew
+	// HostKeySSHConfig leaves host keys to ssh's own configuration. It has
+	// to be asked for, as that configuration may accept any key
+	HostKeySSHConfig
+)
+
+func (p HostKeyPolicy) String() string {
+	switch p {
+	case HostKeyAcceptNew:
+		return "accept-new"
+	case HostKeySSHConfig:
+		return "ssh-config"
+	}
+	return "yes"
+}
+
+// tokenHelper is a credential helper that answers with the username and
+// token from the environment, so the token never appears in git's argv
+const tokenHelper = `!f() { test "$1" = get && echo "username=$VERIFY_GIT_USERNAME" && echo "password=$VERIFY_GIT_TOKEN"; }; f`
+
+// configArgs returns the -c options git commands run with ctx are run with
+func (r *Repo) configArgs(ctx context.Context) []string {
+	var args []string
+
+	// the helpers are scoped to origin's host, so the token isn't offered
+	// to others, such as those of submodules. The empty helper discards
+	// any configured for origin, so only the token is offered there
+	if origin := credentialURL(r.repoURL()); r.Token != "" && origin != "" {
+		key := "credential." + origin + ".helper"
+		args = append(args, "-c", key+"=", "-c", key+"="+tokenHelper)
+	}
+
+	if signers := r.allowedSignersFile(ctx); signers != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+signers)
+	}
+
+	return args
+}
+
+// credentialURL returns the scheme and host of the remote url, which
+// credential options for it are scoped to, or an empty string if it isn't
+// an http remote git would ask for credentials for
+func credentialURL(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// sshCommand returns the command git should use to connect to ssh
+// remotes, extending the one it would use otherwise. The key, prompt and
+// host key settings are independent ssh options, so any combination of
+// them can be used together
+func (r *Repo) sshCommand(ctx context.Context, env []string) (string, error) {
+	var opts []string
+
+	if r.SSHKeyPath != "" {
+		f, err := os.Open(r.SSHKeyPath)
+		if err != nil {
+			return "", fmt.Errorf("could not read ssh key: %w", err)
+		}
+		f.Close()
+
+		opts = append(opts, "-i", shellQuote(r.SSHKeyPath), "-o", "IdentitiesOnly=yes")
+	}
+
+	if !r.AllowPrompts {
+		opts = append(opts, "-o", "BatchMode=yes")
+	}
+
+	if r.HostKeyPolicy != HostKeySSHConfig {
+		opts = append(opts, "-o", "StrictHostKeyChecking="+r.HostKeyPolicy.String())
+	}
+
+	if r.KnownHostsFile != "" {
+		opts = append(opts, "-o", "UserKnownHostsFile="+shellQuote(r.KnownHostsFile))
+	}
+
+	return r.sshBase(ctx, env) + " " + strings.Join(opts, " "), nil
+}
+
+// sshBase returns the ssh command git would use without the repo's
+// options: GIT_SSH_COMMAND from env, or else core.sshCommand, which
+// setting GIT_SSH_COMMAND overrides. core.sshCommand is read from the
+// clone's config, or for clones that don't exist yet from the config git
+// sees in Destination, the first time it is needed
+func (r *Repo) sshBase(ctx context.Context, env []string) string {
+	if base := lookupEnv(env, "GIT_SSH_COMMAND"); base != "" {
+		return base
+	}
+
+	r.mu.Lock()
+	cached := r.sshConfig
+	r.mu.Unlock()
+
+	if cached == nil {
+		dir := r.Destination
+		if r.Exists() {
+			dir = r.deploymentPath
+		}
+
+		// it runs without the repo's own ssh command, so through the
+		// runner rather than run
+		cmd := &Command{Path: r.gitBinary(), Args: []string{"config", "--get", "core.sshCommand"}, Dir: dir, Env: env}
+		output, _, err := r.runner().Run(ctx, cmd)
+
+		// git config exits 1 if the key isn't set
+		var exitErr interface{ ExitCode() int }
+		switch {
+		case err == nil:
+			config := strings.TrimSpace(string(output))
+			cached = &config
+		case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+			cached = new(string)
+		default:
+			return "ssh"
+		}
+
+		r.mu.Lock()
+		r.sshConfig = cached
+		r.mu.Unlock()
+	}
+
+	if *cached == "" {
+		return "ssh"
+	}
+	return *cached
+}
+
+// lookupEnv returns the value of key in env
+func lookupEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key+"=") {
+			return env[i][len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// shellQuote quotes s so it is read as a single word by sh, which git
+// uses to run GIT_SSH_COMMAND
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
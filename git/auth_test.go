@@ -0,0 +1,408 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/r3labs/verify/git"
+	"github.com/r3labs/verify/git/gittest"
+)
+
+// cloneEnv returns the environment a clone with opts runs git with
+func cloneEnv(t *testing.T, opts ...git.Option) []string {
+	t.Helper()
+
+	fake := gittest.New()
+	_, err := git.Clone("git@git.example.com:org/repo.git", t.TempDir(), append(opts, git.WithRunner(fake))...)
+	if err != nil {
+		t.Fatalf("Clone() = %v", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) == 0 {
+		t.Fatalf("Clone() ran no git commands")
+	}
+
+	return calls[len(calls)-1].Env
+}
+
+// lookupEnv returns the value of key in env
+func lookupEnv(env []string, key string) string {
+	value, _ := getenv(env, key)
+	return value
+}
+
+// getenv returns the value of key in env, and whether it is set
+func getenv(env []string, key string) (string, bool) {
+	value, ok := "", false
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			value, ok = kv[len(key)+1:], true
+		}
+	}
+	return value, ok
+}
+
+func TestEnvNeverPrompts(t *testing.T) {
+	env := cloneEnv(t)
+
+	want := map[string]string{
+		"GIT_TERMINAL_PROMPT": "0",
+		"GIT_ASKPASS":         "true",
+		"SSH_ASKPASS":         "true",
+		"SSH_ASKPASS_REQUIRE": "force",
+	}
+	for key, value := range want {
+		got, _ := getenv(env, key)
+		if got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+}
+
+func TestEnvWithPrompts(t *testing.T) {
+	env := cloneEnv(t, git.WithPrompts())
+
+	for _, key := range []string{"GIT_TERMINAL_PROMPT", "GIT_ASKPASS", "SSH_ASKPASS_REQUIRE"} {
+		if value, ok := getenv(env, key); ok {
+			t.Errorf("%s = %q, want unset", key, value)
+		}
+	}
+}
+
+// sshArgs returns the words of the GIT_SSH_COMMAND a clone with opts runs
+// git with
+func sshArgs(t *testing.T, opts ...git.Option) []string {
+	t.Helper()
+
+	ssh, ok := getenv(cloneEnv(t, opts...), "GIT_SSH_COMMAND")
+	if !ok {
+		t.Fatalf("GIT_SSH_COMMAND is not set")
+	}
+	return strings.Fields(ssh)
+}
+
+// hasOption reports whether args passes ssh the option "-o opt"
+func hasOption(args []string, opt string) bool {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-o" && args[i+1] == opt {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSSHBatchMode(t *testing.T) {
+	if !hasOption(sshArgs(t), "BatchMode=yes") {
+		t.Errorf("GIT_SSH_COMMAND doesn't set BatchMode=yes")
+	}
+
+	if value, ok := getenv(cloneEnv(t, git.WithPrompts()), "GIT_SSH_COMMAND"); ok && strings.Contains(value, "BatchMode") {
+		t.Errorf("GIT_SSH_COMMAND = %q with prompts allowed, want no BatchMode", value)
+	}
+}
+
+func TestSSHCommandExtendsConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config gittest.Response
+		opts   []git.Option
+		want   string
+	}{
+		{"unset", gittest.Response{ExitCode: 1}, nil, "ssh -o BatchMode=yes -o StrictHostKeyChecking=yes"},
+		{"core.sshCommand", gittest.Response{Stdout: "ssh -p 2222\n"}, nil, "ssh -p 2222 -o BatchMode=yes -o StrictHostKeyChecking=yes"},
+		{
+			"GIT_SSH_COMMAND wins",
+			gittest.Response{Stdout: "ssh -p 2222\n"},
+			[]git.Option{git.WithEnv("GIT_SSH_COMMAND=ssh -p 22")},
+			"ssh -p 22 -o BatchMode=yes -o StrictHostKeyChecking=yes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := gittest.New()
+			fake.On(tt.config, "config", "--get", "core.sshCommand")
+
+			_, err := git.Clone("git@git.example.com:org/repo.git", t.TempDir(), append(tt.opts, git.WithRunner(fake))...)
+			if err != nil {
+				t.Fatalf("Clone() = %v", err)
+			}
+
+			calls := fake.Calls()
+			if ssh := lookupEnv(calls[len(calls)-1].Env, "GIT_SSH_COMMAND"); ssh != tt.want {
+				t.Errorf("GIT_SSH_COMMAND = %q, want %q", ssh, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHCommandHostKeyPolicy(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "id_ed25519")
+	err := ioutil.WriteFile(key, []byte("key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []git.Option
+		want []string
+		not  []string
+	}{
+		{
+			"key only",
+			[]git.Option{git.WithSSHKey(key)},
+			[]string{"IdentitiesOnly=yes", "BatchMode=yes", "StrictHostKeyChecking=yes"},
+			[]string{"StrictHostKeyChecking=accept-new"},
+		},
+		{
+			"known hosts only",
+			[]git.Option{git.WithKnownHosts("/etc/verify/known_hosts")},
+			[]string{"UserKnownHostsFile='/etc/verify/known_hosts'", "StrictHostKeyChecking=yes"},
+			[]string{"StrictHostKeyChecking=accept-new"},
+		},
+		{
+			"strict",
+			[]git.Option{git.WithHostKeyPolicy(git.HostKeyStrict)},
+			[]string{"StrictHostKeyChecking=yes"},
+			nil,
+		},
+		{
+			"default",
+			nil,
+			[]string{"StrictHostKeyChecking=yes"},
+			[]string{"StrictHostKeyChecking=accept-new"},
+		},
+		{
+			"accept new with key",
+			[]git.Option{git.WithSSHKey(key), git.WithHostKeyPolicy(git.HostKeyAcceptNew)},
+			[]string{"IdentitiesOnly=yes", "StrictHostKeyChecking=accept-new"},
+			nil,
+		},
+		{
+			"accept new with known hosts",
+			[]git.Option{git.WithHostKeyPolicy(git.HostKeyAcceptNew), git.WithKnownHosts("/etc/verify/known_hosts")},
+			[]string{"StrictHostKeyChecking=accept-new", "UserKnownHostsFile='/etc/verify/known_hosts'"},
+			nil,
+		},
+		{
+			"ssh config",
+			[]git.Option{git.WithHostKeyPolicy(git.HostKeySSHConfig)},
+			[]string{"BatchMode=yes"},
+			[]string{"StrictHostKeyChecking=yes", "StrictHostKeyChecking=accept-new"},
+		},
+		{
+			"prompts",
+			[]git.Option{git.WithPrompts(), git.WithHostKeyPolicy(git.HostKeyStrict)},
+			[]string{"StrictHostKeyChecking=yes"},
+			[]string{"BatchMode=yes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := sshArgs(t, tt.opts...)
+			for _, opt := range tt.want {
+				if !hasOption(args, opt) {
+					t.Errorf("GIT_SSH_COMMAND %q is missing -o %s", args, opt)
+				}
+			}
+			for _, opt := range tt.not {
+				if hasOption(args, opt) {
+					t.Errorf("GIT_SSH_COMMAND %q has -o %s", args, opt)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenNeverSaved(t *testing.T) {
+	const token = "ghs_t0ken"
+
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url, git.WithTokenAuth("deploy", token))
+
+	err := r.Fetch()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join(r.DeployPath(), ".git", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(config), token) || strings.Contains(string(config), "credential") {
+		t.Errorf(".git/config holds the token:\n%s", config)
+	}
+}
+
+func TestTokenNeverInArgv(t *testing.T) {
+	const token = "ghs_t0ken"
+
+	r, fake := fakeRepo(t, git.WithTokenAuth("deploy", token))
+
+	err := r.Fetch()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) == 0 {
+		t.Fatalf("Fetch() ran no git commands")
+	}
+
+	for _, c := range calls {
+		if strings.Contains(strings.Join(c.Args, " "), token) {
+			t.Errorf("git %q has the token in its argv", c.Args)
+		}
+		if got := lookupEnv(c.Env, "VERIFY_GIT_TOKEN"); got != token {
+			t.Errorf("VERIFY_GIT_TOKEN = %q, want the token passed through the environment", got)
+		}
+		if got := lookupEnv(c.Env, "VERIFY_GIT_USERNAME"); got != "deploy" {
+			t.Errorf("VERIFY_GIT_USERNAME = %q, want deploy", got)
+		}
+	}
+
+	// a rotated token is used from the next command on
+	r.Token = "ghs_r0tated"
+	fake.Reset()
+
+	err = r.Fetch()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	for _, c := range fake.Calls() {
+		if got := lookupEnv(c.Env, "VERIFY_GIT_TOKEN"); got != "ghs_r0tated" {
+			t.Errorf("VERIFY_GIT_TOKEN = %q after rotating it, want ghs_r0tated", got)
+		}
+	}
+}
+
+func TestTokenOnlyOfferedToOrigin(t *testing.T) {
+	const token = "ghs_t0ken"
+
+	r, fake := fakeRepo(t, git.WithTokenAuth("deploy", token))
+
+	err := r.UpdateSubmodules()
+	if err != nil {
+		t.Fatalf("UpdateSubmodules() = %v", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) == 0 {
+		t.Fatalf("UpdateSubmodules() ran no git commands")
+	}
+	update := calls[len(calls)-1]
+
+	var config []string
+	for i := 0; i+1 < len(update.Args) && update.Args[i] == "-c"; i += 2 {
+		config = append(config, update.Args[i:i+2]...)
+	}
+
+	// ask git for credentials the way the submodule update would, for
+	// origin and for a submodule on another host
+	fill := func(host string) string {
+		cmd := exec.Command("git", append(config, "credential", "fill")...)
+		cmd.Env = update.Env
+		cmd.Stdin = strings.NewReader("protocol=https\nhost=" + host + "\n\n")
+		output, _ := cmd.Output()
+		return string(output)
+	}
+
+	if got := fill("git.example.com"); !strings.Contains(got, "password="+token) {
+		t.Errorf("credentials for origin are %q, want the token", got)
+	}
+	if got := fill("modules.example.org"); strings.Contains(got, token) {
+		t.Errorf("credentials for a submodule on another host are %q, want no token", got)
+	}
+}
+
+func TestSSHKey(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "deploy key")
+	err := ioutil.WriteFile(key, []byte("key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssh := lookupEnv(cloneEnv(t, git.WithSSHKey(key)), "GIT_SSH_COMMAND")
+	want := "ssh -i '" + key + "' -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=yes"
+	if ssh != want {
+		t.Errorf("GIT_SSH_COMMAND = %q, want %q", ssh, want)
+	}
+
+	// an ssh command set through WithEnv is extended, not replaced
+	ssh = lookupEnv(cloneEnv(t, git.WithSSHKey(key), git.WithEnv("GIT_SSH_COMMAND=ssh -p 2222")), "GIT_SSH_COMMAND")
+	want = "ssh -p 2222 -i '" + key + "' -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=yes"
+	if ssh != want {
+		t.Errorf("GIT_SSH_COMMAND = %q, want %q", ssh, want)
+	}
+}
+
+func TestSSHKeyMissing(t *testing.T) {
+	fake := gittest.New()
+	key := filepath.Join(t.TempDir(), "missing")
+
+	_, err := git.Clone("git@git.example.com:org/repo.git", t.TempDir(), git.WithSSHKey(key), git.WithRunner(fake))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Clone() = %v, want the key reported missing", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "ssh key") {
+		t.Errorf("Clone() = %v, want it to say the ssh key is the problem", err)
+	}
+	if calls := fake.Commands(); len(calls) != 0 {
+		t.Errorf("Clone() ran %q, want nothing", calls)
+	}
+}
+
+func TestEnvPrecedence(t *testing.T) {
+	os.Setenv("VERIFY_TEST_INHERITED", "inherited")
+	os.Setenv("VERIFY_TEST_OVERRIDDEN", "inherited")
+	defer os.Unsetenv("VERIFY_TEST_INHERITED")
+	defer os.Unsetenv("VERIFY_TEST_OVERRIDDEN")
+
+	r, fake := fakeRepo(t, git.WithEnv("VERIFY_TEST_OVERRIDDEN=repo", "GIT_TERMINAL_PROMPT=1", "LC_ALL=C"))
+
+	err := r.Sync("master")
+	if err != nil {
+		t.Fatalf("Sync() = %v", err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) == 0 {
+		t.Fatalf("Sync() ran no git commands")
+	}
+
+	want := map[string]string{
+		"VERIFY_TEST_INHERITED":  "inherited",
+		"VERIFY_TEST_OVERRIDDEN": "repo",
+		"GIT_TERMINAL_PROMPT":    "1",
+		"LC_ALL":                 "C",
+	}
+
+	for _, c := range calls {
+		for key, value := range want {
+			count := 0
+			for _, kv := range c.Env {
+				if strings.HasPrefix(kv, key+"=") {
+					count++
+				}
+			}
+			if count != 1 {
+				t.Errorf("git %s has %s set %d times, want once", c.Args[0], key, count)
+			}
+			if got := lookupEnv(c.Env, key); got != value {
+				t.Errorf("git %s has %s=%q, want %q", c.Args[0], key, got, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"fmt"
+)
+
+// Backend performs the core git operations of a Repo. The default backend
+// runs the git binary; a pure Go backend built on go-git can be selected
+// with UsePureGo. Operations outside of Backend always run the git binary
+type Backend interface {
+	Clone(ctx context.Context, r *Repo) error
+	Open(ctx context.Context, r *Repo) error
+	Fetch(ctx context.Context, r *Repo, opts FetchOptions) error
+	Checkout(ctx context.Context, r *Repo, branch string, opts CheckoutOptions) error
+	Pull(ctx context.Context, r *Repo, opts PullOptions) error
+	Branch(ctx context.Context, r *Repo) (string, error)
+	CommitID(ctx context.Context, r *Repo) (string, error)
+	Commits(ctx context.Context, r *Repo) ([]string, error)
+	Diverged(ctx context.Context, r *Repo, from, to string) (bool, error)
+}
+
+// backend is used by all repos. It is not safe to change while repos are
+// in use
+var backend Backend = execBackend{}
+
+// pureGo is the go-git backend, when built with the gogit tag
+var pureGo Backend
+
+// UseNative makes all repos run the git binary. This is the default
+func UseNative() {
+	backend = execBackend{}
+}
+
+// UsePureGo makes all repos use go-git, so no git binary is needed. The
+// package must be built with the gogit tag, otherwise ErrNotSupported is
+// returned
+func UsePureGo() error {
+	if pureGo == nil {
+		return fmt.Errorf("pure go backend needs the gogit build tag: %w", ErrNotSupported)
+	}
+
+	backend = pureGo
+	return nil
+}
+
+// execBackend runs the git binary
+type execBackend struct{}
+
+func (execBackend) Clone(ctx context.Context, r *Repo) error {
+	err := r.lookGit()
+	if err != nil {
+		return err
+	}
+
+	err = r.checkCloneFeatures(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.clone(ctx)
+}
+
+func (execBackend) Open(ctx context.Context, r *Repo) error {
+	return r.open(ctx)
+}
+
+func (execBackend) Fetch(ctx context.Context, r *Repo, opts FetchOptions) error {
+	return r.fetch(ctx, opts)
+}
+
+func (execBackend) Checkout(ctx context.Context, r *Repo, branch string, opts CheckoutOptions) error {
+	return r.checkout(ctx, branch, opts)
+}
+
+func (execBackend) Pull(ctx context.Context, r *Repo, opts PullOptions) error {
+	return r.pull(ctx, opts)
+}
+
+func (execBackend) Branch(ctx context.Context, r *Repo) (string, error) {
+	return r.currentBranch(ctx)
+}
+
+func (execBackend) CommitID(ctx context.Context, r *Repo) (string, error) {
+	return r.commitID(ctx)
+}
+
+func (execBackend) Commits(ctx context.Context, r *Repo) ([]string, error) {
+	return r.commits(ctx)
+}
+
+func (execBackend) Diverged(ctx context.Context, r *Repo, from, to string) (bool, error) {
+	return r.diverged(ctx, from, to)
+}
@@ -0,0 +1,558 @@
+//go:build gogit
+// +build gogit
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+var errDryRun = fmt.Errorf("dry run: %w", ErrNotSupported)
+
+func init() {
+	pureGo = goGitBackend{}
+}
+
+// goGitBackend implements Backend with go-git. It differs from the git
+// binary in a few ways:
+//
+//   - partial clones (WithFilter) and reference clones (WithReference) are
+//     not supported, and fail with ErrNotSupported
+//   - HostKeyAcceptNew is not supported, and HostKeySSHConfig is treated
+//     as HostKeyStrict; host keys are always checked against known_hosts,
+//     or KnownHostsFile if it is set
+//   - Env, GitBinary and AllowPrompts have no effect
+//   - DryRun is not supported, and operations that would change the repo
+//     fail with ErrNotSupported
+//   - Pull only fast-forwards, failing with ErrDiverged, without counts,
+//     where git would merge, and can't rebase, failing with
+//     ErrNotSupported
+//   - PruneTags is not supported, and Pruned always returns 0
+//   - a Sync that fails part way through is not rolled back
+//   - Commits abbreviates ids to seven characters, rather than to the
+//     shortest unambiguous length
+type goGitBackend struct{}
+
+func (b goGitBackend) Clone(ctx context.Context, r *Repo) error {
+	switch {
+	case r.DryRun:
+		return errDryRun
+	case r.filter != "":
+		return fmt.Errorf("partial clone: %w", ErrNotSupported)
+	case r.reference != "":
+		return fmt.Errorf("reference clone: %w", ErrNotSupported)
+	}
+
+	r.Destination = filepath.Clean(r.Destination)
+	r.deploymentPath = filepath.Join(r.Destination, r.dirName())
+
+	if r.Exists() {
+		reclone, err := b.reconcile(r)
+		if !reclone {
+			return err
+		}
+
+		err = os.RemoveAll(r.deploymentPath)
+		if err != nil {
+			return fmt.Errorf("could not remove existing clone of repo %s: %w", r.Name(), err)
+		}
+	}
+
+	auth, err := b.auth(r)
+	if err != nil {
+		return err
+	}
+
+	opts := &gogit.CloneOptions{
+		URL:          r.repoURL(),
+		Auth:         auth,
+		Depth:        r.depth,
+		SingleBranch: r.singleBranch,
+	}
+
+	if r.branch != "" {
+		opts.ReferenceName = plumbing.NewBranchReferenceName(r.branch)
+	}
+
+	if r.submodules {
+		opts.RecurseSubmodules = gogit.DefaultSubmoduleRecursionDepth
+	}
+
+	if r.Progress != nil {
+		opts.Progress = r.Progress
+	}
+
+	ctx, cancel, done := b.context(ctx, r, "clone")
+	defer cancel()
+
+	_, err = gogit.PlainCloneContext(ctx, r.deploymentPath, r.bare, opts)
+	if err != nil {
+		_ = os.RemoveAll(r.deploymentPath)
+		return done(fmt.Sprintf("could not clone repo %s", r.Name()), err)
+	}
+
+	return nil
+}
+
+func (b goGitBackend) Open(ctx context.Context, r *Repo) error {
+	repo, err := gogit.PlainOpen(r.deploymentPath)
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		return fmt.Errorf("%s: %w", r.deploymentPath, ErrNotRepository)
+	}
+	if err != nil {
+		return b.error("could not read repo", err)
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return b.error("could not read repo config", err)
+	}
+
+	r.bare = cfg.Core.IsBare
+
+	want := r.repoURL()
+	var url string
+	origin, ok := cfg.Remotes["origin"]
+	if ok && len(origin.URLs) > 0 {
+		url = origin.URLs[0]
+	}
+	r.setRepoURL(url)
+
+	if want != "" && !sameURL(url, want) {
+		r.setRepoURL(want)
+
+		reclone, err := b.reconcile(r)
+		if reclone {
+			return b.Clone(ctx, r)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// reconcile checks the origin url of the clone at deploymentPath against
+// Repo, dealing with a mismatch as Reconcile says. It reports whether the
+// clone should be replaced
+func (b goGitBackend) reconcile(r *Repo) (bool, error) {
+	repo, err := gogit.PlainOpen(r.deploymentPath)
+	if errors.Is(err, gogit.ErrRepositoryNotExists) {
+		return false, fmt.Errorf("%s: %w", r.deploymentPath, ErrNotRepository)
+	}
+	if err != nil {
+		return false, b.error("could not read repo", err)
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return false, b.error("could not read repo config", err)
+	}
+
+	var url string
+	origin, ok := cfg.Remotes["origin"]
+	if ok && len(origin.URLs) > 0 {
+		url = origin.URLs[0]
+	}
+
+	want := r.repoURL()
+	if sameURL(url, want) {
+		return false, nil
+	}
+
+	switch r.Reconcile {
+	case ReconcileURL:
+		err = checkURL(want)
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{want}})
+			if err != nil {
+				return false, b.error("could not add remote origin", err)
+			}
+			return false, nil
+		}
+
+		origin.URLs = []string{want}
+		err = repo.SetConfig(cfg)
+		if err != nil {
+			return false, b.error("could not set url of remote origin", err)
+		}
+		return false, nil
+	case ReconcileReclone:
+		return true, nil
+	}
+
+	return false, &OriginMismatchError{Path: r.deploymentPath, Want: want, Got: url}
+}
+
+func (b goGitBackend) Fetch(ctx context.Context, r *Repo, opts FetchOptions) error {
+	switch {
+	case r.DryRun:
+		return errDryRun
+	case opts.PruneTags:
+		return fmt.Errorf("pruning tags: %w", ErrNotSupported)
+	}
+
+	repo, err := b.open(r)
+	if err != nil {
+		return err
+	}
+
+	auth, err := b.auth(r)
+	if err != nil {
+		return err
+	}
+
+	fetch := &gogit.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		Depth:      r.depth,
+		Prune:      opts.Prune,
+	}
+
+	if r.bare {
+		refspec := "+refs/heads/*:refs/heads/*"
+		if r.singleBranch && r.branch != "" {
+			refspec = "+refs/heads/" + r.branch + ":refs/heads/" + r.branch
+		}
+		fetch.RefSpecs = []config.RefSpec{config.RefSpec(refspec)}
+	}
+
+	if r.Progress != nil {
+		fetch.Progress = r.Progress
+	}
+
+	ctx, cancel, done := b.context(ctx, r, "fetch")
+	defer cancel()
+
+	err = repo.FetchContext(ctx, fetch)
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return done("could not fetch repo data", err)
+	}
+
+	return nil
+}
+
+func (b goGitBackend) Checkout(ctx context.Context, r *Repo, branch string, opts CheckoutOptions) error {
+	if r.DryRun {
+		return errDryRun
+	}
+
+	if ctx.Err() != nil {
+		return b.error("could not checkout branch", ctx.Err())
+	}
+
+	repo, err := b.open(r)
+	if err != nil {
+		return err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return b.error("could not checkout branch", err)
+	}
+
+	name := plumbing.NewBranchReferenceName(branch)
+
+	// like git, create a local branch tracking origin's if there isn't one
+	_, err = repo.Reference(name, false)
+	if err == plumbing.ErrReferenceNotFound {
+		remote, rerr := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+		if rerr != nil {
+			return b.error("could not checkout branch", rerr)
+		}
+
+		err = repo.Storer.SetReference(plumbing.NewHashReference(name, remote.Hash()))
+		if err != nil {
+			return b.error("could not checkout branch", err)
+		}
+
+		err = repo.CreateBranch(&config.Branch{Name: branch, Remote: "origin", Merge: name})
+		if err != nil && err != gogit.ErrBranchExists {
+			return b.error("could not checkout branch", err)
+		}
+	}
+
+	err = wt.Checkout(&gogit.CheckoutOptions{Branch: name, Force: opts.Force})
+	if err != nil {
+		return b.error("could not checkout branch", err)
+	}
+
+	return nil
+}
+
+func (b goGitBackend) Pull(ctx context.Context, r *Repo, options PullOptions) error {
+	switch {
+	case r.DryRun:
+		return errDryRun
+	case options.Rebase:
+		return fmt.Errorf("pull --rebase: %w", ErrNotSupported)
+	}
+
+	repo, err := b.open(r)
+	if err != nil {
+		return err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return b.error("could not pull repo changes", err)
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return b.error("could not pull repo changes", err)
+	}
+
+	auth, err := b.auth(r)
+	if err != nil {
+		return err
+	}
+
+	opts := &gogit.PullOptions{
+		RemoteName:    "origin",
+		ReferenceName: head.Name(),
+		SingleBranch:  r.singleBranch,
+		Depth:         r.depth,
+		Auth:          auth,
+	}
+
+	if r.Progress != nil {
+		opts.Progress = r.Progress
+	}
+
+	ctx, cancel, done := b.context(ctx, r, "pull")
+	defer cancel()
+
+	err = wt.PullContext(ctx, opts)
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return done("could not pull repo changes", err)
+	}
+
+	return nil
+}
+
+func (b goGitBackend) Branch(ctx context.Context, r *Repo) (string, error) {
+	repo, err := b.open(r)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", b.error("could not get git branch", err)
+	}
+
+	if !head.Name().IsBranch() {
+		return "", nil
+	}
+
+	return head.Name().Short(), nil
+}
+
+func (b goGitBackend) CommitID(ctx context.Context, r *Repo) (string, error) {
+	repo, err := b.open(r)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return "", b.error("could not get git revision id", err)
+	}
+
+	return head.Hash().String(), nil
+}
+
+func (b goGitBackend) Commits(ctx context.Context, r *Repo) ([]string, error) {
+	ids := []string{}
+
+	repo, err := b.open(r)
+	if err != nil {
+		return ids, err
+	}
+
+	head, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return ids, nil
+	}
+	if err != nil {
+		return ids, b.error("could not get git revision id's", err)
+	}
+
+	iter, err := repo.Log(&gogit.LogOptions{From: head.Hash()})
+	if err != nil {
+		return ids, b.error("could not get git revision id's", err)
+	}
+
+	err = iter.ForEach(func(c *object.Commit) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ids = append(ids, c.Hash.String()[:7])
+		return nil
+	})
+	if err != nil {
+		return ids, b.error("could not get git revision id's", err)
+	}
+
+	return ids, nil
+}
+
+func (b goGitBackend) Diverged(ctx context.Context, r *Repo, from, to string) (bool, error) {
+	repo, err := b.open(r)
+	if err != nil {
+		return false, err
+	}
+
+	commit := func(rev string) (*object.Commit, error) {
+		hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, err
+		}
+		return repo.CommitObject(*hash)
+	}
+
+	fromCommit, err := commit(from)
+	if err != nil {
+		return false, b.refError(from, err)
+	}
+
+	toCommit, err := commit(to)
+	if err != nil {
+		return false, b.refError(to, err)
+	}
+
+	bases, err := fromCommit.MergeBase(toCommit)
+	if err != nil {
+		return false, b.error("could not count diverged commits", err)
+	}
+
+	// each has commits of its own unless one is the merge base, i.e. an
+	// ancestor of the other
+	for _, base := range bases {
+		if base.Hash == fromCommit.Hash || base.Hash == toCommit.Hash {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// refError describes a failure to resolve ref
+func (b goGitBackend) refError(ref string, err error) error {
+	if errors.Is(err, plumbing.ErrReferenceNotFound) || errors.Is(err, plumbing.ErrObjectNotFound) {
+		return fmt.Errorf("could not resolve %s: %w", ref, ErrRefNotFound)
+	}
+	return b.error("could not resolve "+ref, err)
+}
+
+// open opens the repo's go-git repository
+func (b goGitBackend) open(r *Repo) (*gogit.Repository, error) {
+	repo, err := gogit.PlainOpen(r.deploymentPath)
+	if err != nil {
+		return nil, b.error("could not read repo", err)
+	}
+	return repo, nil
+}
+
+// auth returns the credentials configured on the repo
+func (b goGitBackend) auth(r *Repo) (transport.AuthMethod, error) {
+	if r.Token != "" {
+		username := r.TokenUsername
+		if username == "" {
+			username = "x-access-token"
+		}
+		return &http.BasicAuth{Username: username, Password: r.Token}, nil
+	}
+
+	if r.SSHKeyPath == "" && r.KnownHostsFile == "" {
+		return nil, nil
+	}
+
+	if r.HostKeyPolicy == HostKeyAcceptNew {
+		return nil, fmt.Errorf("host key policy accept-new: %w", ErrNotSupported)
+	}
+
+	var files []string
+	if r.KnownHostsFile != "" {
+		files = append(files, r.KnownHostsFile)
+	}
+
+	callback, err := ssh.NewKnownHostsCallback(files...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read known hosts: %w", err)
+	}
+
+	if r.SSHKeyPath == "" {
+		return &ssh.PublicKeysCallback{User: "git", HostKeyCallbackHelper: ssh.HostKeyCallbackHelper{HostKeyCallback: callback}}, nil
+	}
+
+	keys, err := ssh.NewPublicKeysFromFile("git", r.SSHKeyPath, "")
+	if err != nil {
+		return nil, fmt.Errorf("could not read ssh key: %w", err)
+	}
+	keys.HostKeyCallback = callback
+
+	return keys, nil
+}
+
+// context applies the repo's timeout for op to ctx. The returned function
+// turns an error from go-git into a *GitError, recognising the timeout
+func (b goGitBackend) context(ctx context.Context, r *Repo, op string) (context.Context, context.CancelFunc, func(string, error) error) {
+	timeout := r.timeout(op)
+	if timeout <= 0 {
+		return ctx, func() {}, b.error
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+
+	return opCtx, cancel, func(msg string, err error) error {
+		if ctx.Err() == nil && opCtx.Err() != nil {
+			err = &TimeoutError{Op: op, Timeout: timeout}
+		}
+		return b.error(msg, err)
+	}
+}
+
+// error wraps an error from go-git in a *GitError, translating it to the
+// package's sentinel errors where possible
+func (goGitBackend) error(msg string, err error) error {
+	gerr := &GitError{
+		Message:  msg,
+		ExitCode: -1,
+		Stderr:   err.Error(),
+		Err:      err,
+	}
+
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed):
+		gerr.Err = ErrAuthFailed
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		gerr.Err = ErrRepoNotFound
+	case errors.Is(err, plumbing.ErrReferenceNotFound):
+		gerr.Err = ErrBranchNotFound
+	case errors.Is(err, gogit.ErrNonFastForwardUpdate):
+		gerr.Err = ErrDiverged
+	}
+
+	return gerr
+}
@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/r3labs/verify/git"
+)
+
+// forEachBackend runs test with each backend the package is built with,
+// the pure go one only with the gogit tag, telling it which it runs with
+func forEachBackend(t *testing.T, test func(t *testing.T, pureGo bool)) {
+	t.Run("native", func(t *testing.T) {
+		git.UseNative()
+		test(t, false)
+	})
+
+	t.Run("pure go", func(t *testing.T) {
+		err := git.UsePureGo()
+		if errors.Is(err, git.ErrNotSupported) {
+			t.Skip("built without the gogit tag")
+		}
+		if err != nil {
+			t.Fatalf("UsePureGo() = %v", err)
+		}
+		defer git.UseNative()
+
+		test(t, true)
+	})
+}
+
+func TestBackend(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, pureGo bool) {
+		url, work := newOrigin(t)
+		master := run(t, work, "rev-parse", "master")
+		develop := run(t, work, "rev-parse", "develop")
+
+		r := cloneOrigin(t, url)
+
+		branch, err := r.Branch()
+		if err != nil || branch != "master" {
+			t.Errorf("Branch() = %q, %v, want master", branch, err)
+		}
+
+		id, err := r.CommitID()
+		if err != nil || id != master {
+			t.Errorf("CommitID() = %q, %v, want %s", id, err, master)
+		}
+
+		ids, err := r.Commits()
+		if err != nil || len(ids) != 2 || !strings.HasPrefix(master, ids[0]) {
+			t.Errorf("Commits() = %q, %v, want the 2 on master, newest first", ids, err)
+		}
+
+		diverged, err := r.Diverged("master", "origin/develop")
+		if err != nil || diverged {
+			t.Errorf("Diverged() = %v, %v, want false, as develop is only ahead", diverged, err)
+		}
+
+		err = r.Checkout("develop")
+		if err != nil {
+			t.Fatalf("Checkout() = %v", err)
+		}
+		branch, _ = r.Branch()
+		id, _ = r.CommitID()
+		if branch != "develop" || id != develop {
+			t.Errorf("after Checkout() HEAD is %s at %s, want develop at %s", branch, id, develop)
+		}
+
+		pushed := commitFile(t, work, "d", "4\n", "four")
+		run(t, work, "push", "-q", "origin", "master")
+
+		err = r.Fetch()
+		if err != nil {
+			t.Fatalf("Fetch() = %v", err)
+		}
+
+		diverged, err = r.Diverged("develop", "origin/master")
+		if err != nil || !diverged {
+			t.Errorf("Diverged() = %v, %v, want true", diverged, err)
+		}
+
+		err = r.Checkout("master")
+		if err != nil {
+			t.Fatalf("Checkout() = %v", err)
+		}
+		err = r.Pull()
+		if err != nil {
+			t.Fatalf("Pull() = %v", err)
+		}
+		id, _ = r.CommitID()
+		if id != pushed {
+			t.Errorf("after Pull() HEAD is at %s, want %s", id, pushed)
+		}
+
+		_, err = r.Diverged("master", "nope")
+		if !errors.Is(err, git.ErrRefNotFound) {
+			t.Errorf("Diverged() with an unknown ref = %v, want ErrRefNotFound", err)
+		}
+	})
+}
+
+func TestBackendDivergedPull(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, pureGo bool) {
+		url, work := newOrigin(t)
+		r := cloneOrigin(t, url)
+
+		commitFile(t, work, "d", "4\n", "four")
+		run(t, work, "push", "-q", "origin", "master")
+		local := commitFile(t, r.DeployPath(), "e", "5\n", "five")
+
+		err := r.Pull()
+
+		// the git binary merges, where go-git can only fast-forward
+		if !pureGo {
+			if err != nil {
+				t.Errorf("Pull() = %v, want the branches merged", err)
+			}
+			return
+		}
+
+		if !errors.Is(err, git.ErrDiverged) {
+			t.Errorf("Pull() = %v, want ErrDiverged", err)
+		}
+		if id := run(t, r.DeployPath(), "rev-parse", "HEAD"); id != local {
+			t.Errorf("HEAD is at %s after a failed Pull(), want %s", id, local)
+		}
+	})
+}
+
+func TestBackendPartialClone(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, pureGo bool) {
+		url, _ := newOrigin(t)
+
+		_, err := git.Clone("file://"+url, t.TempDir(), git.WithFilter("blob:none"))
+		if pureGo != errors.Is(err, git.ErrNotSupported) {
+			t.Errorf("Clone(WithFilter) = %v, want ErrNotSupported only from go-git", err)
+		}
+		if !pureGo && err != nil {
+			t.Errorf("Clone(WithFilter) = %v", err)
+		}
+	})
+}
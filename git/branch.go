@@ -0,0 +1,490 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Branches lists the repo's local branches, sorted by name. Use Branch to
+// find which one is checked out
+func (r *Repo) Branches() ([]string, error) {
+	return r.BranchesContext(context.Background())
+}
+
+// BranchesContext lists the repo's local branches, aborting if ctx is done
+func (r *Repo) BranchesContext(ctx context.Context) ([]string, error) {
+	return r.refNames(ctx, "could not list branches", "refs/heads/")
+}
+
+// RemoteBranches lists the remote-tracking branches of the named remote,
+// as of the last fetch, sorted by name. Single-branch clones only track
+// the one branch. ErrRemoteNotFound is returned if there is no such remote
+func (r *Repo) RemoteBranches(remote string) ([]string, error) {
+	return r.RemoteBranchesContext(context.Background(), remote)
+}
+
+// RemoteBranchesContext lists the remote-tracking branches of the named
+// remote, aborting if ctx is done
+func (r *Repo) RemoteBranchesContext(ctx context.Context, remote string) ([]string, error) {
+	err := r.checkRemote(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := r.refNames(ctx, "could not list branches of remote "+remote, "refs/remotes/"+remote+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	// HEAD is a symbolic ref to the remote's default branch
+	branches := refs[:0]
+	for _, ref := range refs {
+		if ref != "HEAD" {
+			branches = append(branches, ref)
+		}
+	}
+
+	return branches, nil
+}
+
+// checkRemote returns an ErrRemoteNotFound error if remote is not
+// configured for the repo
+func (r *Repo) checkRemote(ctx context.Context, remote string) error {
+	remotes, err := r.remoteNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range remotes {
+		if name == remote {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s: %w", remote, ErrRemoteNotFound)
+}
+
+// DefaultBranch returns the branch origin's HEAD points to, e.g. "main".
+// It is looked up once and cached, until a Fetch gives origin the chance
+// to have changed it
+func (r *Repo) DefaultBranch() (string, error) {
+	return r.DefaultBranchContext(context.Background())
+}
+
+// DefaultBranchContext returns the branch origin's HEAD points to,
+// aborting if ctx is done
+func (r *Repo) DefaultBranchContext(ctx context.Context) (string, error) {
+	r.mu.Lock()
+	cached, stale := r.defaultBranch, r.defaultStale
+	r.mu.Unlock()
+
+	if cached != "" {
+		return cached, nil
+	}
+
+	// clones record origin's HEAD, but it is never updated by fetching
+	if !stale {
+		output, err := r.output(ctx, r.deploymentPath, "could not read default branch", "symbolic-ref", "--quiet", "refs/remotes/origin/HEAD")
+		if err == nil {
+			head := strings.TrimPrefix(strings.TrimSpace(string(output)), "refs/remotes/origin/")
+
+			r.mu.Lock()
+			r.defaultBranch = head
+			r.mu.Unlock()
+
+			return head, nil
+		}
+	}
+
+	_, head, err := r.lsRemote(ctx, r.deploymentPath, "could not read default branch of origin", "origin", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if head == "" {
+		return "", fmt.Errorf("could not read default branch of origin: %w", ErrBranchNotFound)
+	}
+
+	r.mu.Lock()
+	r.defaultBranch = head
+	r.defaultStale = false
+	r.mu.Unlock()
+
+	return head, nil
+}
+
+// forgetDefaultBranch drops the cached default branch
+func (r *Repo) forgetDefaultBranch() {
+	r.mu.Lock()
+	r.defaultBranch = ""
+	r.defaultStale = true
+	r.mu.Unlock()
+}
+
+// Upstream returns the remote and branch the checked out branch tracks,
+// and pulls from. It fails with ErrNoUpstream if it doesn't track one, and
+// ErrDetachedHead if there is no branch checked out. Branches tracking
+// another local branch have "." as their remote
+func (r *Repo) Upstream() (remote, branch string, err error) {
+	return r.UpstreamContext(context.Background())
+}
+
+// UpstreamContext returns the remote and branch the checked out branch
+// tracks, aborting if ctx is done
+func (r *Repo) UpstreamContext(ctx context.Context) (remote, branch string, err error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not read upstream branch", "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}")
+	if err != nil {
+		return "", "", err
+	}
+
+	upstream := strings.TrimSpace(string(output))
+
+	remotes, err := r.remoteNames(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	// remote names can contain slashes too, so pick the longest match
+	for _, name := range remotes {
+		if strings.HasPrefix(upstream, name+"/") && len(name) > len(remote) {
+			remote = name
+		}
+	}
+
+	if remote == "" {
+		return ".", upstream, nil
+	}
+
+	return remote, strings.TrimPrefix(upstream, remote+"/"), nil
+}
+
+// SetUpstream makes the checked out branch track branch on remote. The
+// remote's branch must have been fetched
+func (r *Repo) SetUpstream(remote, branch string) error {
+	return r.SetUpstreamContext(context.Background(), remote, branch)
+}
+
+// SetUpstreamContext makes the checked out branch track branch on remote,
+// aborting if ctx is done
+func (r *Repo) SetUpstreamContext(ctx context.Context, remote, branch string) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	upstream := remote + "/" + branch
+	if remote == "." {
+		upstream = branch
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not set upstream branch to "+upstream, "branch", "--set-upstream-to="+upstream)
+	return err
+}
+
+// BranchExists reports whether the branch name exists locally, and on
+// origin. origin is asked directly, so the answer is current even for
+// branches that haven't been fetched
+func (r *Repo) BranchExists(name string) (local, remote bool, err error) {
+	return r.BranchExistsContext(context.Background(), name)
+}
+
+// BranchExistsContext reports whether the branch name exists locally, and
+// on origin, aborting if ctx is done
+func (r *Repo) BranchExistsContext(ctx context.Context, name string) (local, remote bool, err error) {
+	ref := "refs/heads/" + name
+
+	_, err = r.output(ctx, r.deploymentPath, "could not look up branch "+name, "show-ref", "--verify", "--quiet", ref)
+	local, err = exitStatus(err, 1)
+	if err != nil {
+		return false, false, err
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not look up branch "+name+" on origin", "ls-remote", "--exit-code", "--heads", "origin", ref)
+	remote, err = exitStatus(err, 2)
+	if err != nil {
+		return false, false, err
+	}
+
+	// ls-remote matches patterns against the end of ref names
+	remote = remote && hasRef(output, ref)
+
+	return local, remote, nil
+}
+
+// RemoteCommitID returns the id of the commit branch points to on origin.
+// origin is asked directly, without fetching, so it is cheap to poll and
+// works for branches a shallow or single-branch clone doesn't have. It
+// fails with ErrBranchNotFound if origin has no such branch
+func (r *Repo) RemoteCommitID(branch string) (string, error) {
+	return r.RemoteCommitIDContext(context.Background(), branch)
+}
+
+// RemoteCommitIDContext returns the id of the commit branch points to on
+// origin, aborting if ctx is done
+func (r *Repo) RemoteCommitIDContext(ctx context.Context, branch string) (string, error) {
+	ref := "refs/heads/" + branch
+
+	refs, _, err := r.lsRemote(ctx, r.deploymentPath, "could not look up branch "+branch+" on origin", "origin", ref)
+	if err != nil {
+		return "", err
+	}
+
+	// ls-remote matches patterns against the end of ref names
+	id, ok := refs[ref]
+	if !ok {
+		return "", fmt.Errorf("%s on origin: %w", branch, ErrBranchNotFound)
+	}
+
+	return id, nil
+}
+
+// exitStatus turns the error of a command that exits with code when its
+// answer is no into that answer
+func exitStatus(err error, code int) (bool, error) {
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.ExitCode == code {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// hasRef reports whether ls-remote output lists ref
+func hasRef(output []byte, ref string) bool {
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateBranch creates the local branch name at startPoint, or the current
+// HEAD if startPoint is empty, without checking it out. It fails with
+// ErrBranchExists if the branch is already there
+func (r *Repo) CreateBranch(name, startPoint string) error {
+	return r.CreateBranchContext(context.Background(), name, startPoint)
+}
+
+// CreateBranchContext creates the local branch name at startPoint,
+// aborting if ctx is done
+func (r *Repo) CreateBranchContext(ctx context.Context, name, startPoint string) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	args := []string{"branch", name}
+	if startPoint != "" {
+		args = append(args, startPoint)
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not create branch "+name, args...)
+	return err
+}
+
+// DeleteBranch deletes the local branch name. Unless force is set, a
+// branch with commits that aren't merged into its upstream, or HEAD, is
+// kept, failing with ErrBranchNotMerged. The checked out branch can't be
+// deleted, failing with ErrBranchCheckedOut, and a branch that doesn't
+// exist fails with ErrBranchNotFound
+func (r *Repo) DeleteBranch(name string, force bool) error {
+	return r.DeleteBranchContext(context.Background(), name, force)
+}
+
+// DeleteBranchContext deletes the local branch name, aborting if ctx is
+// done
+func (r *Repo) DeleteBranchContext(ctx context.Context, name string, force bool) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	flag := "-d"
+	if force {
+		flag = "-D"
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not delete branch "+name, "branch", flag, name)
+	return err
+}
+
+// PruneOptions configures PruneLocalBranchesWithOptions
+type PruneOptions struct {
+	// Force deletes branches with commits that no remote-tracking branch
+	// has, which would otherwise be lost
+	Force bool
+}
+
+// PruneLocalBranches deletes the local branches whose upstream branch is
+// gone, returning their names, or an empty slice if there were none. An
+// upstream branch is gone once a fetch with Prune set has deleted its
+// remote-tracking branch. The checked out branch and branches with commits
+// no remote-tracking branch has are kept
+func (r *Repo) PruneLocalBranches() ([]string, error) {
+	return r.PruneLocalBranchesWithOptionsContext(context.Background(), PruneOptions{})
+}
+
+// PruneLocalBranchesContext deletes the local branches whose upstream
+// branch is gone, aborting if ctx is done
+func (r *Repo) PruneLocalBranchesContext(ctx context.Context) ([]string, error) {
+	return r.PruneLocalBranchesWithOptionsContext(ctx, PruneOptions{})
+}
+
+// PruneLocalBranchesWithOptions deletes the local branches whose upstream
+// branch is gone, as configured by opts
+func (r *Repo) PruneLocalBranchesWithOptions(opts PruneOptions) ([]string, error) {
+	return r.PruneLocalBranchesWithOptionsContext(context.Background(), opts)
+}
+
+// PruneLocalBranchesWithOptionsContext deletes the local branches whose
+// upstream branch is gone, as configured by opts, aborting if ctx is done
+func (r *Repo) PruneLocalBranchesWithOptionsContext(ctx context.Context, opts PruneOptions) ([]string, error) {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	msg := "could not prune branches"
+
+	output, err := r.output(ctx, r.deploymentPath, msg, "for-each-ref", "--format=%(refname)%00%(upstream:track)", "refs/heads/")
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := r.currentBranch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 2 || fields[1] != "[gone]" {
+			continue
+		}
+
+		branch := strings.TrimPrefix(fields[0], "refs/heads/")
+		if branch == current {
+			continue
+		}
+
+		// git branch -d would compare against HEAD, the upstream being
+		// gone, so whether the commits are safe is checked here instead
+		if !opts.Force {
+			output, err := r.output(ctx, r.deploymentPath, msg, "rev-list", "--count", fields[0], "--not", "--remotes")
+			if err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(string(output)) != "0" {
+				continue
+			}
+		}
+
+		err = r.DeleteBranchContext(ctx, branch, true)
+		if errors.Is(err, ErrBranchCheckedOut) {
+			// checked out in another work tree
+			continue
+		}
+		if err != nil {
+			return pruned, err
+		}
+
+		pruned = append(pruned, branch)
+	}
+
+	return pruned, nil
+}
+
+// BranchesContaining lists the local branches that contain commit, i.e.
+// that it is reachable from, sorted by name. commit can be anything git
+// understands, and ErrRefNotFound is returned if it doesn't name a commit,
+// rather than an empty list
+func (r *Repo) BranchesContaining(commit string) ([]string, error) {
+	return r.BranchesContainingContext(context.Background(), commit)
+}
+
+// BranchesContainingContext lists the local branches that contain commit,
+// aborting if ctx is done
+func (r *Repo) BranchesContainingContext(ctx context.Context, commit string) ([]string, error) {
+	id, err := r.CommitIDForContext(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.refNames(ctx, "could not list branches containing "+commit, "refs/heads/", "--contains="+id)
+}
+
+// RemoteBranchesContaining lists the remote-tracking branches that contain
+// commit, as of the last fetch, sorted by name and prefixed with their
+// remote, e.g. "origin/main"
+func (r *Repo) RemoteBranchesContaining(commit string) ([]string, error) {
+	return r.RemoteBranchesContainingContext(context.Background(), commit)
+}
+
+// RemoteBranchesContainingContext lists the remote-tracking branches that
+// contain commit, aborting if ctx is done
+func (r *Repo) RemoteBranchesContainingContext(ctx context.Context, commit string) ([]string, error) {
+	id, err := r.CommitIDForContext(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := r.refNames(ctx, "could not list branches containing "+commit, "refs/remotes/", "--contains="+id)
+	if err != nil {
+		return nil, err
+	}
+
+	branches := refs[:0]
+	for _, ref := range refs {
+		if !strings.HasSuffix(ref, "/HEAD") {
+			branches = append(branches, ref)
+		}
+	}
+
+	return branches, nil
+}
+
+// BranchContains reports whether commit is reachable from branch, which
+// can be local or remote-tracking, e.g. "origin/release". Either not
+// existing is an error matching ErrRefNotFound
+func (r *Repo) BranchContains(branch, commit string) (bool, error) {
+	return r.BranchContainsContext(context.Background(), branch, commit)
+}
+
+// BranchContainsContext reports whether commit is reachable from branch,
+// aborting if ctx is done
+func (r *Repo) BranchContainsContext(ctx context.Context, branch, commit string) (bool, error) {
+	return r.IsAncestorContext(ctx, commit, branch)
+}
+
+// refNames lists the refs under prefix, with prefix removed. Full ref
+// names are read, as short ones are ambiguous when e.g. a tag and a
+// branch share a name
+func (r *Repo) refNames(ctx context.Context, msg, prefix string, args ...string) ([]string, error) {
+	args = append(append([]string{"for-each-ref", "--format=%(refname)"}, args...), prefix)
+
+	output, err := r.output(ctx, r.deploymentPath, msg, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, ref := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(ref, prefix) {
+			names = append(names, strings.TrimPrefix(ref, prefix))
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,114 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/r3labs/verify/git"
+)
+
+// checkBranch fails t unless the local branch name exists as want says
+func checkBranch(t *testing.T, r *git.Repo, name string, want bool) {
+	t.Helper()
+
+	local, _, err := r.BranchExists(name)
+	if err != nil {
+		t.Fatalf("BranchExists() = %v", err)
+	}
+	if local != want {
+		t.Errorf("branch %s exists = %v, want %v", name, local, want)
+	}
+}
+
+func TestCreateBranch(t *testing.T) {
+	url, work := newOrigin(t)
+	master := run(t, work, "rev-parse", "master")
+	develop := run(t, work, "rev-parse", "develop")
+
+	r := cloneOrigin(t, url)
+
+	err := r.CreateBranch("feature", "")
+	if err != nil {
+		t.Fatalf("CreateBranch() = %v", err)
+	}
+	checkBranch(t, r, "feature", true)
+	if id := run(t, r.DeployPath(), "rev-parse", "feature"); id != master {
+		t.Errorf("feature is at %s, want HEAD at %s", id, master)
+	}
+
+	// the new branch isn't checked out
+	if branch, _ := r.Branch(); branch != "master" {
+		t.Errorf("Branch() = %s after CreateBranch(), want master", branch)
+	}
+
+	err = r.CreateBranch("release", "origin/develop")
+	if err != nil {
+		t.Fatalf("CreateBranch() = %v", err)
+	}
+	if id := run(t, r.DeployPath(), "rev-parse", "release"); id != develop {
+		t.Errorf("release is at %s, want origin/develop at %s", id, develop)
+	}
+
+	err = r.CreateBranch("feature", "origin/develop")
+	if !errors.Is(err, git.ErrBranchExists) {
+		t.Errorf("CreateBranch() of an existing branch = %v, want ErrBranchExists", err)
+	}
+	if id := run(t, r.DeployPath(), "rev-parse", "feature"); id != master {
+		t.Errorf("feature moved to %s, want it left at %s", id, master)
+	}
+
+	err = r.CreateBranch("broken", "nope")
+	if err == nil {
+		t.Errorf("CreateBranch() at an unknown start point = nil, want an error")
+	}
+	checkBranch(t, r, "broken", false)
+}
+
+func TestDeleteBranch(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url)
+	dir := r.DeployPath()
+
+	err := r.DeleteBranch("nope", false)
+	if !errors.Is(err, git.ErrBranchNotFound) {
+		t.Errorf("DeleteBranch() of a missing branch = %v, want ErrBranchNotFound", err)
+	}
+
+	err = r.DeleteBranch("master", true)
+	if !errors.Is(err, git.ErrBranchCheckedOut) {
+		t.Errorf("DeleteBranch() of the checked out branch = %v, want ErrBranchCheckedOut", err)
+	}
+	checkBranch(t, r, "master", true)
+
+	// a branch with commits nothing else has is kept unless forced
+	run(t, dir, "checkout", "-q", "-b", "wip")
+	commitFile(t, dir, "wip", "1\n", "wip")
+	run(t, dir, "checkout", "-q", "master")
+
+	err = r.DeleteBranch("wip", false)
+	if !errors.Is(err, git.ErrBranchNotMerged) {
+		t.Errorf("DeleteBranch() of an unmerged branch = %v, want ErrBranchNotMerged", err)
+	}
+	checkBranch(t, r, "wip", true)
+
+	err = r.DeleteBranch("wip", true)
+	if err != nil {
+		t.Errorf("DeleteBranch(force) = %v", err)
+	}
+	checkBranch(t, r, "wip", false)
+
+	// a merged branch needs no force
+	err = r.CreateBranch("merged", "")
+	if err != nil {
+		t.Fatalf("CreateBranch() = %v", err)
+	}
+	err = r.DeleteBranch("merged", false)
+	if err != nil {
+		t.Errorf("DeleteBranch() of a merged branch = %v", err)
+	}
+	checkBranch(t, r, "merged", false)
+}
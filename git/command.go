@@ -0,0 +1,260 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command is a single invocation of git
+type Command struct {
+	// Path is the git executable
+	Path string
+	// Args are the arguments git is run with, starting with any -c options
+	Args []string
+	// Dir is the directory git is run in
+	Dir string
+	// Env is the complete environment git is run with
+	Env []string
+	// Stdout, if set, receives git's stdout as it is written, instead of it
+	// being returned by Run
+	Stdout io.Writer
+	// Stderr, if set, receives git's stderr as it is written, in addition
+	// to it being returned by Run
+	Stderr io.Writer
+}
+
+// Logger is called after every git command a repo runs, with the git
+// executable, its arguments, the directory it ran in, how long it took and
+// the error it failed with. Credentials in remote urls are redacted from
+// args, and authentication options are left out
+type Logger func(cmd string, args []string, dir string, dur time.Duration, err error)
+
+// Runner runs git commands. Errors for commands that ran but exited
+// non-zero should implement ExitCode() int, as *exec.ExitError does.
+// Runners must stop the command when ctx is done
+type Runner interface {
+	Run(ctx context.Context, cmd *Command) (stdout, stderr []byte, err error)
+}
+
+// ExecRunner runs git commands as child processes. It is the Runner used
+// by repos that don't set one
+type ExecRunner struct{}
+
+// Run runs cmd, killing it if ctx is done
+func (ExecRunner) Run(ctx context.Context, c *Command) ([]byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Env = c.Env
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if c.Stdout != nil {
+		cmd.Stdout = c.Stdout
+	}
+	if c.Stderr != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, c.Stderr)
+	}
+
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// runner returns the Runner the repo's commands go through
+func (r *Repo) runner() Runner {
+	if r.Runner != nil {
+		return r.Runner
+	}
+	return ExecRunner{}
+}
+
+// timeout returns the timeout that applies to the given git subcommand
+func (r *Repo) timeout(op string) time.Duration {
+	if t, ok := r.Timeouts[op]; ok {
+		return t
+	}
+	return r.Timeout
+}
+
+// mutate runs a git command that changes the repo, recording it rather
+// than running it if the repo is a DryRun
+func (r *Repo) mutate(ctx context.Context, dir, msg string, args ...string) ([]byte, []byte, error) {
+	if r.DryRun {
+		r.plan("git " + strings.Join(args, " "))
+		return nil, nil, nil
+	}
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	return r.run(ctx, dir, msg, args...)
+}
+
+// removeAll removes path, recording it rather than removing it if the repo
+// is a DryRun
+func (r *Repo) removeAll(path string) error {
+	if r.DryRun {
+		r.plan("rm -rf " + shellQuote(path))
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// plan records a command a DryRun repo would have run
+func (r *Repo) plan(command string) {
+	r.mu.Lock()
+	r.planned = append(r.planned, command)
+	r.mu.Unlock()
+}
+
+// output runs git with the given args in dir and returns its stdout. On
+// failure a *GitError carrying msg and git's stderr is returned, wrapping
+// ctx.Err() if the command was killed because ctx was done, or a
+// *TimeoutError if it ran past the repo's timeout
+func (r *Repo) output(ctx context.Context, dir, msg string, args ...string) ([]byte, error) {
+	stdout, _, err := r.run(ctx, dir, msg, args...)
+	return stdout, err
+}
+
+// run is output, but also returns whatever git wrote to stderr
+func (r *Repo) run(ctx context.Context, dir, msg string, args ...string) ([]byte, []byte, error) {
+	ctx, unlock, err := r.lock(ctx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	return r.command(ctx, dir, msg, nil, args)
+}
+
+// stream is output, but writes git's stdout to w as it is written
+func (r *Repo) stream(ctx context.Context, dir, msg string, w io.Writer, args ...string) error {
+	ctx, unlock, err := r.lock(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, _, err = r.command(ctx, dir, msg, w, args)
+	return err
+}
+
+// command runs git, sending its stdout to stdout if set
+func (r *Repo) command(ctx context.Context, dir, msg string, stdout io.Writer, args []string) ([]byte, []byte, error) {
+	op := args[0]
+	cmdCtx := ctx
+
+	timeout := r.timeout(op)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	env, err := r.environ(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", msg, err)
+	}
+
+	cmd := &Command{
+		Path:   r.gitBinary(),
+		Dir:    dir,
+		Env:    env,
+		Stdout: stdout,
+	}
+
+	// git only reports progress to a terminal unless asked to
+	if r.Progress != nil && reportsProgress[op] {
+		args = append([]string{op, "--progress"}, args[1:]...)
+		cmd.Stderr = r.Progress
+	}
+
+	cmd.Args = append(r.configArgs(ctx), args...)
+
+	start := time.Now()
+	output, stderr, err := r.runner().Run(cmdCtx, cmd)
+	if err != nil {
+		err = r.gitError(ctx, cmdCtx, msg, args, stderr, err)
+	}
+
+	if r.Logger != nil {
+		r.Logger(cmd.Path, redact(args), dir, time.Since(start), err)
+	}
+
+	return output, stderr, err
+}
+
+// gitError describes a failed command as a *GitError
+func (r *Repo) gitError(ctx, cmdCtx context.Context, msg string, args []string, stderr []byte, err error) error {
+	op := args[0]
+
+	gerr := &GitError{
+		Message:  msg,
+		Args:     redact(args),
+		ExitCode: -1,
+		Stderr:   string(stderr),
+	}
+
+	var exitErr interface{ ExitCode() int }
+	switch {
+	case ctx.Err() != nil:
+		gerr.Err = ctx.Err()
+	case cmdCtx.Err() != nil:
+		gerr.Err = &TimeoutError{Op: op, Timeout: r.timeout(op)}
+	case errors.As(err, &exitErr):
+		gerr.ExitCode = exitErr.ExitCode()
+		gerr.Err = classify(gerr.Stderr)
+	default:
+		gerr.Err = err
+	}
+
+	return gerr
+}
+
+// redact returns args with the credentials in any urls replaced
+func redact(args []string) []string {
+	redacted := make([]string, len(args))
+
+	for i, arg := range args {
+		redacted[i] = redactURL(arg)
+	}
+
+	return redacted
+}
+
+// redactURL replaces the credentials in s, if it is a url that has any
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+
+	// tokens are often sent as the username over https
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	} else if u.Scheme == "http" || u.Scheme == "https" {
+		u.User = url.User("xxxxx")
+	}
+
+	return u.String()
+}
@@ -0,0 +1,555 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commit describes a commit
+type Commit struct {
+	ID      string
+	ShortID string
+
+	AuthorName  string
+	AuthorEmail string
+	AuthorTime  time.Time
+
+	CommitterName  string
+	CommitterEmail string
+	CommitTime     time.Time
+
+	// Message is the full commit message, without its trailing newline
+	Message string
+}
+
+// Subject returns the first line of the commit message
+func (c *Commit) Subject() string {
+	i := strings.IndexByte(c.Message, '\n')
+	if i < 0 {
+		return c.Message
+	}
+	return c.Message[:i]
+}
+
+// Body returns the commit message after the subject and the blank line
+// separating them
+func (c *Commit) Body() string {
+	i := strings.IndexByte(c.Message, '\n')
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimLeft(c.Message[i:], "\n")
+}
+
+// commitFormat has git log print a commit's fields separated by NULs,
+// which can't appear in any of them. Used with -z, commits are NUL
+// terminated too
+const commitFormat = "--format=%H%x00%h%x00%an%x00%ae%x00%ad%x00%cn%x00%ce%x00%cd%x00%B"
+
+// commitFields is the number of fields in commitFormat
+const commitFields = 9
+
+// logArgs returns the arguments for printing commits with git log
+func logArgs(args ...string) []string {
+	return append([]string{"log", "-z", "--date=iso-strict", commitFormat}, args...)
+}
+
+// parseCommits reads the commits printed by git log run with logArgs
+func parseCommits(output []byte) ([]Commit, error) {
+	fields := strings.Split(string(output), "\x00")
+
+	// every commit is terminated, leaving an empty field at the end
+	if len(fields) > 0 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields)%commitFields != 0 {
+		return nil, fmt.Errorf("could not parse git log output")
+	}
+
+	commits := make([]Commit, 0, len(fields)/commitFields)
+	for i := 0; i < len(fields); i += commitFields {
+		commit, err := parseCommit(fields[i : i+commitFields])
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+	}
+
+	return commits, nil
+}
+
+// parseCommit reads a commit from its commitFormat fields
+func parseCommit(f []string) (Commit, error) {
+	authored, err := time.Parse(time.RFC3339, f[4])
+	if err != nil {
+		return Commit{}, fmt.Errorf("could not parse date of commit %s: %w", f[0], err)
+	}
+
+	committed, err := time.Parse(time.RFC3339, f[7])
+	if err != nil {
+		return Commit{}, fmt.Errorf("could not parse date of commit %s: %w", f[0], err)
+	}
+
+	return Commit{
+		ID:             f[0],
+		ShortID:        f[1],
+		AuthorName:     f[2],
+		AuthorEmail:    f[3],
+		AuthorTime:     authored,
+		CommitterName:  f[5],
+		CommitterEmail: f[6],
+		CommitTime:     committed,
+		Message:        strings.TrimSuffix(f[8], "\n"),
+	}, nil
+}
+
+// ShortCommitID returns the id of the commit at HEAD, abbreviated to the
+// shortest prefix git considers unambiguous for the repo. This grows with
+// the size of the repo
+func (r *Repo) ShortCommitID() (string, error) {
+	return r.ShortCommitIDContext(context.Background())
+}
+
+// ShortCommitIDContext returns the abbreviated id of the commit at HEAD,
+// aborting if ctx is done
+func (r *Repo) ShortCommitIDContext(ctx context.Context) (string, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not get git revision id", "rev-parse", "--short", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// CommitIDFor returns the id of the commit ref points to, without checking
+// it out. ref can be anything git understands, e.g. "origin/main", a tag,
+// which is peeled to the commit it tags, or "HEAD~2". ErrRefNotFound is
+// returned if ref doesn't name a commit
+func (r *Repo) CommitIDFor(ref string) (string, error) {
+	return r.CommitIDForContext(context.Background(), ref)
+}
+
+// CommitIDForContext returns the id of the commit ref points to, aborting
+// if ctx is done
+func (r *Repo) CommitIDForContext(ctx context.Context, ref string) (string, error) {
+	id, err := r.resolveCommit(ctx, ref)
+	if errors.Is(err, ErrCommitNotFound) {
+		return "", fmt.Errorf("could not resolve %s: %w", ref, ErrRefNotFound)
+	}
+
+	return id, err
+}
+
+// Head returns the commit at HEAD
+func (r *Repo) Head() (*Commit, error) {
+	return r.HeadContext(context.Background())
+}
+
+// HeadContext returns the commit at HEAD, aborting if ctx is done
+func (r *Repo) HeadContext(ctx context.Context) (*Commit, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not read commit", logArgs("-1", "HEAD")...)
+	if err != nil {
+		return nil, err
+	}
+
+	commits, err := parseCommits(output)
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("could not read commit: %w", ErrRefNotFound)
+	}
+
+	return &commits[0], nil
+}
+
+// CommitsBetween returns the commits reachable from to but not from from,
+// newest first, like git log from..to. Run after Fetch, with from set to
+// the checked out branch and to its remote-tracking branch, it lists the
+// commits a Pull would bring in. ErrRefNotFound is returned if either ref
+// doesn't name a commit
+func (r *Repo) CommitsBetween(from, to string) ([]Commit, error) {
+	return r.CommitsBetweenContext(context.Background(), from, to)
+}
+
+// CommitsBetweenContext returns the commits reachable from to but not from
+// from, aborting if ctx is done
+func (r *Repo) CommitsBetweenContext(ctx context.Context, from, to string) (commits []Commit, err error) {
+	for _, ref := range []string{from, to} {
+		_, err = r.CommitIDForContext(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = r.withHistory(ctx, func() error {
+		output, err := r.output(ctx, r.deploymentPath, "could not read commit log", logArgs(from+".."+to, "--")...)
+		if err != nil {
+			return err
+		}
+
+		commits, err = parseCommits(output)
+		return err
+	})
+
+	return commits, err
+}
+
+// CommitCount returns the number of commits reachable from ref, which can
+// be a branch, tag or commit id. In a shallow clone the count only covers
+// the history that has been fetched, and is returned with an error
+// matching ErrShallow
+func (r *Repo) CommitCount(ref string) (int, error) {
+	return r.CommitCountContext(context.Background(), ref)
+}
+
+// CommitCountContext returns the number of commits reachable from ref,
+// aborting if ctx is done
+func (r *Repo) CommitCountContext(ctx context.Context, ref string) (int, error) {
+	return r.count(ctx, ref)
+}
+
+// CountBetween returns the number of commits reachable from to but not
+// from from. Like CommitCount, the count is returned with an error
+// matching ErrShallow in a shallow clone
+func (r *Repo) CountBetween(from, to string) (int, error) {
+	return r.CountBetweenContext(context.Background(), from, to)
+}
+
+// CountBetweenContext returns the number of commits reachable from to but
+// not from from, aborting if ctx is done
+func (r *Repo) CountBetweenContext(ctx context.Context, from, to string) (int, error) {
+	return r.count(ctx, from, to)
+}
+
+// count counts the commits reachable from the last of refs but none of
+// the others
+func (r *Repo) count(ctx context.Context, refs ...string) (int, error) {
+	for _, ref := range refs {
+		_, err := r.CommitIDForContext(ctx, ref)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	rng := refs[len(refs)-1]
+	if len(refs) == 2 {
+		rng = refs[0] + ".." + refs[1]
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not count commits", "rev-list", "--count", rng, "--")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("could not count commits: %w", err)
+	}
+
+	shallow, err := r.IsShallow()
+	if err != nil {
+		return 0, err
+	}
+	if shallow {
+		return n, fmt.Errorf("count of %s may be incomplete: %w", rng, ErrShallow)
+	}
+
+	return n, nil
+}
+
+// MergeBase returns the id of the best common ancestor of a and b, which
+// can be branches, tags, remote-tracking branches or commit ids.
+// ErrNoMergeBase is returned if they have no history in common
+func (r *Repo) MergeBase(a, b string) (string, error) {
+	return r.MergeBaseContext(context.Background(), a, b)
+}
+
+// MergeBaseContext returns the id of the best common ancestor of a and b,
+// aborting if ctx is done
+func (r *Repo) MergeBaseContext(ctx context.Context, a, b string) (base string, err error) {
+	for _, ref := range []string{a, b} {
+		_, err = r.CommitIDForContext(ctx, ref)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = r.withHistory(ctx, func() error {
+		output, err := r.output(ctx, r.deploymentPath, "could not find merge base", "merge-base", a, b)
+		found, err := exitStatus(err, 1)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("could not find merge base of %s and %s: %w", a, b, ErrNoMergeBase)
+		}
+
+		base = strings.TrimSpace(string(output))
+		return nil
+	})
+
+	return base, err
+}
+
+// IsAncestor reports whether ancestor is reachable from descendant. A
+// commit is its own ancestor, so IsAncestor is true when both name the same
+// commit; check their ids to tell "behind" from "equal". In a shallow clone
+// false may only mean the history linking them hasn't been fetched, so it
+// is returned with an error matching ErrShallow, unless AutoDeepen is set
+// and fetching the rest of the history settles it
+func (r *Repo) IsAncestor(ancestor, descendant string) (bool, error) {
+	return r.IsAncestorContext(context.Background(), ancestor, descendant)
+}
+
+// IsAncestorContext reports whether ancestor is reachable from descendant,
+// aborting if ctx is done
+func (r *Repo) IsAncestorContext(ctx context.Context, ancestor, descendant string) (is bool, err error) {
+	for _, ref := range []string{ancestor, descendant} {
+		_, err = r.CommitIDForContext(ctx, ref)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = r.withHistory(ctx, func() error {
+		_, err := r.output(ctx, r.deploymentPath, "could not check ancestry", "merge-base", "--is-ancestor", ancestor, descendant)
+		is, err = exitStatus(err, 1)
+		if err != nil || is {
+			return err
+		}
+
+		shallow, err := r.IsShallow()
+		if err != nil {
+			return err
+		}
+		if shallow {
+			return fmt.Errorf("%s may be an ancestor of %s: %w", ancestor, descendant, ErrShallow)
+		}
+
+		return nil
+	})
+
+	return is, err
+}
+
+// CommitsSince returns the commits reachable from ref, or HEAD if ref is
+// empty, committed after t, newest first. Commit dates, not author dates,
+// are compared, as git log --since does
+func (r *Repo) CommitsSince(t time.Time, ref string) ([]Commit, error) {
+	return r.CommitsSinceContext(context.Background(), t, ref)
+}
+
+// CommitsSinceContext returns the commits reachable from ref committed
+// after t, aborting if ctx is done
+func (r *Repo) CommitsSinceContext(ctx context.Context, t time.Time, ref string) ([]Commit, error) {
+	return r.LogWithContext(ctx, LogOptions{Ref: ref, Since: t})
+}
+
+// Log returns the latest n commits reachable from HEAD, newest first, or
+// all of them if n <= 0
+func (r *Repo) Log(n int) ([]Commit, error) {
+	return r.LogContext(context.Background(), n)
+}
+
+// LogContext returns the latest n commits reachable from HEAD, aborting
+// if ctx is done
+func (r *Repo) LogContext(ctx context.Context, n int) ([]Commit, error) {
+	return r.LogWithContext(ctx, LogOptions{MaxCount: n})
+}
+
+// LogByAuthor returns the latest n commits reachable from HEAD whose
+// author matches authorPattern, or all of them if n <= 0
+func (r *Repo) LogByAuthor(authorPattern string, n int) ([]Commit, error) {
+	return r.LogByAuthorContext(context.Background(), authorPattern, n)
+}
+
+// LogByAuthorContext returns the latest n commits reachable from HEAD
+// whose author matches authorPattern, aborting if ctx is done
+func (r *Repo) LogByAuthorContext(ctx context.Context, authorPattern string, n int) ([]Commit, error) {
+	return r.LogWithContext(ctx, LogOptions{Author: authorPattern, MaxCount: n})
+}
+
+// LogOptions selects the commits returned by LogWith. Unset fields select
+// everything
+type LogOptions struct {
+	// Ref is where to start looking for commits, HEAD if empty. Ranges,
+	// e.g. "v1.0..main", are accepted too
+	Ref string
+	// Author only selects commits whose author name or email matches the
+	// regular expression, as git log --author does
+	Author string
+	// Since and Until only select commits committed after and before them.
+	// Commit dates, not author dates, are compared
+	Since time.Time
+	Until time.Time
+	// Path only selects commits that changed path, a file or directory
+	// relative to the top of the repo
+	Path string
+	// MaxCount limits the number of commits returned to the latest
+	// MaxCount, if positive
+	MaxCount int
+}
+
+// LogForPath returns the commits selected by opts that changed path, a
+// file or directory relative to the top of the repo, newest first. A path
+// no commit touched, including one that never existed, is not an error.
+// With a range as opts.Ref, e.g. "deployed..main", it tells whether
+// anything under path changed since a commit
+func (r *Repo) LogForPath(path string, opts LogOptions) ([]Commit, error) {
+	return r.LogForPathContext(context.Background(), path, opts)
+}
+
+// LogForPathContext returns the commits selected by opts that changed
+// path, aborting if ctx is done
+func (r *Repo) LogForPathContext(ctx context.Context, path string, opts LogOptions) ([]Commit, error) {
+	opts.Path = path
+	return r.LogWithContext(ctx, opts)
+}
+
+// LogWith returns the commits selected by opts, newest first
+func (r *Repo) LogWith(opts LogOptions) ([]Commit, error) {
+	return r.LogWithContext(context.Background(), opts)
+}
+
+// LogWithContext returns the commits selected by opts, aborting if ctx is
+// done
+func (r *Repo) LogWithContext(ctx context.Context, opts LogOptions) ([]Commit, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not read commit log", logArgs(opts.args()...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCommits(output)
+}
+
+// args returns the git log arguments selecting the commits
+func (opts LogOptions) args() []string {
+	var args []string
+
+	if opts.Author != "" {
+		args = append(args, "--author="+opts.Author)
+	}
+
+	// an explicit offset leaves git nothing to interpret in the local
+	// timezone
+	if !opts.Since.IsZero() {
+		args = append(args, "--since="+opts.Since.Format(time.RFC3339))
+	}
+	if !opts.Until.IsZero() {
+		args = append(args, "--until="+opts.Until.Format(time.RFC3339))
+	}
+
+	if opts.MaxCount > 0 {
+		args = append(args, "-n", strconv.Itoa(opts.MaxCount))
+	}
+
+	ref := opts.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	args = append(args, ref, "--")
+
+	if opts.Path != "" {
+		args = append(args, opts.Path)
+	}
+
+	return args
+}
+
+// ForEachCommit calls fn with each of the commits selected by opts, newest
+// first, as git finds them, so histories of any size can be scanned
+// without holding them in memory. If fn returns an error, git is stopped
+// and ForEachCommit returns the error, unless it matches ErrStop
+func (r *Repo) ForEachCommit(opts LogOptions, fn func(Commit) error) error {
+	return r.ForEachCommitContext(context.Background(), opts, fn)
+}
+
+// ForEachCommitContext calls fn with each of the commits selected by opts,
+// aborting if ctx is done
+func (r *Repo) ForEachCommitContext(ctx context.Context, opts LogOptions, fn func(Commit) error) error {
+	return r.forEachRecord(ctx, "could not read commit log", commitFields, logArgs(opts.args()...), func(fields []string) error {
+		commit, err := parseCommit(fields)
+		if err != nil {
+			return err
+		}
+		return fn(commit)
+	})
+}
+
+// forEachRecord runs git with args, calling fn with each record of n NUL
+// terminated fields it writes, as it writes them. If fn returns an error
+// git is stopped, and the error returned, unless it matches ErrStop
+func (r *Repo) forEachRecord(ctx context.Context, msg string, n int, args []string, fn func([]string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		err := r.stream(ctx, r.deploymentPath, msg, pw, args...)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	scanner := bufio.NewScanner(pr)
+	scanner.Buffer(make([]byte, 64*1024), maxFieldSize)
+	scanner.Split(scanNul)
+
+	var err error
+	fields := make([]string, 0, n)
+
+	for err == nil && scanner.Scan() {
+		fields = append(fields, scanner.Text())
+		if len(fields) < n {
+			continue
+		}
+
+		err = fn(fields)
+		fields = fields[:0]
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+
+	// stop git if it is still going, and unblock its writes
+	cancel()
+	pr.Close()
+	gitErr := <-done
+
+	switch {
+	case errors.Is(err, ErrStop):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	return gitErr
+}
+
+// maxFieldSize bounds the size of a single field streamed by
+// forEachRecord, in practice a commit message
+const maxFieldSize = 64 << 20
+
+// scanNul is a bufio.SplitFunc for NUL terminated fields
+func scanNul(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
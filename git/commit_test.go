@@ -0,0 +1,267 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r3labs/verify/git"
+)
+
+func TestIsAncestor(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url)
+
+	tests := []struct {
+		ancestor, descendant string
+		want                 bool
+	}{
+		{"HEAD", "HEAD", true},
+		{"origin/master", "master", true},
+		{"master", "origin/develop", true},
+		{"origin/develop", "master", false},
+		{"HEAD~1", "HEAD", true},
+		{"HEAD", "HEAD~1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ancestor+" "+tt.descendant, func(t *testing.T) {
+			is, err := r.IsAncestor(tt.ancestor, tt.descendant)
+			if err != nil {
+				t.Fatalf("IsAncestor() = %v", err)
+			}
+			if is != tt.want {
+				t.Errorf("IsAncestor() = %v, want %v", is, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAncestorUnknownRef(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url)
+
+	_, err := r.IsAncestor("nope", "HEAD")
+	if !errors.Is(err, git.ErrRefNotFound) {
+		t.Errorf("IsAncestor() = %v, want ErrRefNotFound", err)
+	}
+}
+
+func TestIsAncestorShallow(t *testing.T) {
+	url, work := newOrigin(t)
+
+	// develop diverges from master, so neither is the other's ancestor
+	run(t, work, "checkout", "-q", "master")
+	commitFile(t, work, "d", "4\n", "four")
+	run(t, work, "push", "-q", "origin", "master")
+
+	r := cloneOrigin(t, "file://"+url, git.WithDepth(1))
+
+	// the history linking them is what a shallow clone lacks
+	is, err := r.IsAncestor("origin/develop", "origin/master")
+	if is || !errors.Is(err, git.ErrShallow) {
+		t.Errorf("IsAncestor() = %v, %v, want false, ErrShallow", is, err)
+	}
+
+	// a commit is its own ancestor, shallow or not
+	is, err = r.IsAncestor("origin/master", "origin/master")
+	if !is || err != nil {
+		t.Errorf("IsAncestor() = %v, %v, want true, nil", is, err)
+	}
+
+	err = r.Unshallow()
+	if err != nil {
+		t.Fatalf("Unshallow() = %v", err)
+	}
+
+	is, err = r.IsAncestor("origin/develop", "origin/master")
+	if is || err != nil {
+		t.Errorf("IsAncestor() after Unshallow = %v, %v, want false, nil", is, err)
+	}
+}
+
+func TestIsAncestorAutoDeepen(t *testing.T) {
+	url, work := newOrigin(t)
+
+	run(t, work, "checkout", "-q", "master")
+	commitFile(t, work, "d", "4\n", "four")
+	run(t, work, "push", "-q", "origin", "master")
+
+	r := cloneOrigin(t, "file://"+url, git.WithDepth(1), git.WithAutoDeepen())
+
+	// the history is deepened until the answer is known
+	is, err := r.IsAncestor("origin/develop", "origin/master")
+	if is || err != nil {
+		t.Errorf("IsAncestor() = %v, %v, want false, nil", is, err)
+	}
+}
+
+// endlessLog is a git.Runner whose git log writes commits until it is
+// killed, so a caller that drains it rather than stop it never returns
+type endlessLog struct {
+	written int
+	killed  bool
+}
+
+func (l *endlessLog) Run(ctx context.Context, cmd *git.Command) ([]byte, []byte, error) {
+	if cmd.Stdout == nil {
+		return nil, nil, nil
+	}
+
+	const commit = "1111111111111111111111111111111111111111\x001111111\x00test\x00test@example.com\x002024-01-02T03:04:05Z\x00test\x00test@example.com\x002024-01-02T03:04:05Z\x00message\n\x00"
+
+	for {
+		_, err := io.WriteString(cmd.Stdout, commit)
+
+		// the command is cancelled before its output is closed, so a write
+		// failing because nobody reads it any more means it was killed
+		if ctx.Err() != nil {
+			l.killed = true
+			return nil, nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		l.written++
+	}
+}
+
+func TestForEachCommitStopKillsGit(t *testing.T) {
+	for _, stop := range []error{git.ErrStop, fmt.Errorf("found it: %w", git.ErrStop)} {
+		t.Run(stop.Error(), func(t *testing.T) {
+			log := &endlessLog{}
+			r, err := git.Clone("https://git.example.com/org/repo.git", t.TempDir(), git.WithRunner(log))
+			if err != nil {
+				t.Fatalf("Clone() = %v", err)
+			}
+
+			seen := 0
+			done := make(chan error, 1)
+			go func() {
+				done <- r.ForEachCommit(git.LogOptions{}, func(git.Commit) error {
+					seen++
+					if seen == 3 {
+						return stop
+					}
+					return nil
+				})
+			}()
+
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("ForEachCommit() is still reading git's output")
+			}
+
+			if err != nil {
+				t.Errorf("ForEachCommit() = %v, want nil", err)
+			}
+			if seen != 3 {
+				t.Errorf("fn called %d times, want 3", seen)
+			}
+			if !log.killed {
+				t.Errorf("git log ran to completion, want it killed")
+			}
+		})
+	}
+}
+
+func TestForEachCommitError(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url)
+
+	failed := errors.New("failed")
+	var messages []string
+
+	err := r.ForEachCommit(git.LogOptions{}, func(c git.Commit) error {
+		messages = append(messages, c.Message)
+		return failed
+	})
+	if err != failed {
+		t.Errorf("ForEachCommit() = %v, want fn's error", err)
+	}
+	if strings.Join(messages, " ") != "two" {
+		t.Errorf("fn called with %q, want the newest commit only", messages)
+	}
+}
+
+func TestMergeBase(t *testing.T) {
+	url, work := newOrigin(t)
+	master := run(t, work, "rev-parse", "master")
+
+	r := cloneOrigin(t, url)
+	dir := r.DeployPath()
+
+	run(t, dir, "checkout", "-q", "-b", "hotfix", "master")
+	commitFile(t, dir, "fix", "1\n", "fix")
+	run(t, dir, "tag", "v1.0.1")
+
+	// an orphan branch shares no history with the others
+	run(t, dir, "checkout", "-q", "--orphan", "orphan")
+	run(t, dir, "rm", "-rfq", ".")
+	commitFile(t, dir, "unrelated", "1\n", "unrelated")
+	run(t, dir, "checkout", "-q", "master")
+
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"hotfix", "origin/develop", master},
+		{"v1.0.1", "origin/develop", master},
+		{master[:12], "hotfix", master},
+		{"master", "master", master},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			base, err := r.MergeBase(tt.a, tt.b)
+			if err != nil || base != tt.want {
+				t.Errorf("MergeBase() = %q, %v, want %s", base, err, tt.want)
+			}
+		})
+	}
+
+	_, err := r.MergeBase("orphan", "master")
+	if !errors.Is(err, git.ErrNoMergeBase) {
+		t.Errorf("MergeBase() of unrelated histories = %v, want ErrNoMergeBase", err)
+	}
+
+	_, err = r.MergeBase("nope", "master")
+	if !errors.Is(err, git.ErrRefNotFound) {
+		t.Errorf("MergeBase() of an unknown ref = %v, want ErrRefNotFound", err)
+	}
+}
+
+func TestCommitsBetween(t *testing.T) {
+	url, work := newOrigin(t)
+	develop := run(t, work, "rev-parse", "develop")
+
+	r := cloneOrigin(t, url)
+
+	commits, err := r.CommitsBetween("master", "origin/develop")
+	if err != nil {
+		t.Fatalf("CommitsBetween() = %v", err)
+	}
+	if len(commits) != 1 || commits[0].ID != develop || commits[0].Message != "three" {
+		t.Errorf("CommitsBetween() = %+v, want develop's commit three", commits)
+	}
+
+	commits, err = r.CommitsBetween("origin/develop", "master")
+	if err != nil || len(commits) != 0 {
+		t.Errorf("CommitsBetween() = %+v, %v, want no commits", commits, err)
+	}
+
+	_, err = r.CommitsBetween("master", "nope")
+	if !errors.Is(err, git.ErrRefNotFound) {
+		t.Errorf("CommitsBetween() with an unknown ref = %v, want ErrRefNotFound", err)
+	}
+}
@@ -0,0 +1,576 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrAuthFailed is matched by errors caused by the remote rejecting
+	// the supplied credentials
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrRepoNotFound is matched by errors caused by the remote
+	// repository not existing
+	ErrRepoNotFound = errors.New("repository not found")
+	// ErrNetwork is matched by errors caused by the remote host being
+	// unreachable
+	ErrNetwork = errors.New("network unreachable")
+	// ErrHostNotFound is matched by errors caused by the remote's host
+	// name not resolving. It matches ErrNetwork too
+	ErrHostNotFound error = networkError("host not found")
+	// ErrBranchNotFound is matched by errors caused by a branch or ref
+	// that does not exist
+	ErrBranchNotFound = errors.New("branch not found")
+	// ErrCommitNotFound is returned when a commit id does not name a
+	// commit, even after fetching
+	ErrCommitNotFound = errors.New("commit not found")
+	// ErrStop can be returned by ForEachCommit callbacks to stop early,
+	// without ForEachCommit failing
+	ErrStop = errors.New("stop iteration")
+	// ErrNoTags is matched by errors caused by there being no tags to
+	// describe a commit with
+	ErrNoTags = errors.New("no tags")
+	// ErrTagExists is matched by errors caused by creating a tag that
+	// already exists
+	ErrTagExists = errors.New("tag already exists")
+	// ErrPushRejected is matched by errors caused by the remote refusing
+	// pushed refs
+	ErrPushRejected = errors.New("push rejected")
+	// ErrUntrustedCommit is returned when a commit's signature doesn't
+	// satisfy a SignaturePolicy
+	ErrUntrustedCommit = errors.New("commit is not trusted")
+	// ErrInvalidVersion is returned when a tag is not a semantic version
+	ErrInvalidVersion = errors.New("invalid semantic version")
+	// ErrNoMergeBase is returned when two commits have no history in
+	// common
+	ErrNoMergeBase = errors.New("no merge base")
+	// ErrShallow is returned along with results that may be incomplete
+	// because the repo is a shallow clone
+	ErrShallow = errors.New("repository is shallow")
+	// ErrRefNotFound is returned when a ref does not name a commit
+	ErrRefNotFound = errors.New("ref not found")
+	// ErrAmbiguousRef is matched by errors caused by an abbreviated commit
+	// id or ref name matching more than one object
+	ErrAmbiguousRef = errors.New("ambiguous ref")
+	// ErrDetachedHead is returned by operations that need a branch checked
+	// out when HEAD is detached
+	ErrDetachedHead = errors.New("HEAD is detached")
+	// ErrTagNotFound is matched by errors caused by a tag that does not
+	// exist, even after fetching tags
+	ErrTagNotFound = errors.New("tag not found")
+	// ErrBranchExists is matched by errors caused by creating a branch
+	// that already exists
+	ErrBranchExists = errors.New("branch already exists")
+	// ErrDirtyWorkTree is matched by errors returned when a checkout would
+	// have to touch a work tree with uncommitted changes
+	ErrDirtyWorkTree = errors.New("work tree has uncommitted changes")
+	// ErrStashConflict is returned when stashed changes can't be applied
+	// cleanly. The stash is kept, so the changes aren't lost
+	ErrStashConflict = errors.New("stashed changes conflict")
+	// ErrBranchCheckedOut is matched by errors caused by deleting the
+	// branch that is checked out
+	ErrBranchCheckedOut = errors.New("branch is checked out")
+	// ErrBranchNotMerged is matched by errors caused by deleting a branch
+	// holding commits that aren't merged anywhere else
+	ErrBranchNotMerged = errors.New("branch is not fully merged")
+	// ErrNoUpstream is matched by errors caused by a branch not tracking
+	// a remote branch
+	ErrNoUpstream = errors.New("branch has no upstream")
+	// ErrRemoteNotFound is matched by errors caused by a remote that is
+	// not configured for the repo
+	ErrRemoteNotFound = errors.New("remote not found")
+	// ErrInvalidURL is returned for remote urls that git couldn't fetch
+	ErrInvalidURL = errors.New("invalid remote url")
+	// ErrOriginMismatch is returned when an existing clone's origin is
+	// not the repo it was expected to be a clone of
+	ErrOriginMismatch = errors.New("origin does not match repo")
+	// ErrRemoteExists is matched by errors caused by adding a remote that
+	// is already configured
+	ErrRemoteExists = errors.New("remote already exists")
+	// ErrRollbackFailed is matched by errors returned when a sync failed
+	// and the repo couldn't be put back as it was either
+	ErrRollbackFailed = errors.New("rollback failed")
+	// ErrBusy is matched by errors returned when an operation given a ctx
+	// from NoWait found another goroutine using the repo
+	ErrBusy = errors.New("repo is busy")
+	// ErrLocked is matched by errors returned when another process held
+	// the repo's lock file for longer than the repo's LockWait
+	ErrLocked = errors.New("repo is locked")
+	// ErrHookFailed is matched by errors returned when a sync hook failed
+	// or panicked
+	ErrHookFailed = errors.New("sync hook failed")
+	// ErrDiverged is matched by errors caused by local and remote commits
+	// that can't be fast-forwarded to each other
+	ErrDiverged = errors.New("branches have diverged")
+	// ErrMergeConflict is matched by errors returned when the remote's
+	// commits can't be merged into the local branch without conflicts
+	ErrMergeConflict = errors.New("merge conflict")
+	// ErrRebaseConflict is matched by errors returned when local commits
+	// can't be rebased onto the remote's without conflicts
+	ErrRebaseConflict = errors.New("rebase conflict")
+	// ErrNotRepository is returned when opening a directory that is not a
+	// git work tree
+	ErrNotRepository = errors.New("not a git repository")
+	// ErrBareRepo is returned by operations that need a work tree when
+	// run against a bare repo
+	ErrBareRepo = errors.New("repository is bare")
+	// ErrUnsupportedVersion is returned when an option needs a newer git
+	// than the one installed
+	ErrUnsupportedVersion = errors.New("unsupported git version")
+	// ErrNotSupported is returned when the selected backend can't perform
+	// an operation or honour an option
+	ErrNotSupported = errors.New("not supported by backend")
+)
+
+// networkError is a network failure more specific than ErrNetwork
+type networkError string
+
+func (e networkError) Error() string {
+	return string(e)
+}
+
+// Is reports whether target is ErrNetwork
+func (e networkError) Is(target error) bool {
+	return target == ErrNetwork
+}
+
+// classifiers map fragments of git's stderr to the failure they indicate.
+// They are checked in order, as some messages contain more than one
+// fragment, e.g. github reports a missing repository over ssh as both
+// "Repository not found" and "make sure you have the correct access rights"
+var classifiers = []struct {
+	err       error
+	fragments []string
+}{
+	{ErrRepoNotFound, []string{
+		"repository not found",
+		"does not appear to be a git repository",
+		"the requested url returned error: 404",
+		"the project you were looking for could not be found",
+	}},
+	// a bare "permission denied" is also how local filesystem errors end,
+	// so only ssh's forms of it count
+	{ErrAuthFailed, []string{
+		"permission denied (publickey",
+		"permission denied (password",
+		"permission denied (keyboard-interactive",
+		"permission denied, please try again",
+		"authentication failed",
+		"could not read username",
+		"could not read password",
+		"terminal prompts disabled",
+		"access denied",
+		"invalid username or password",
+		"the requested url returned error: 401",
+		"the requested url returned error: 403",
+	}},
+	{ErrHostNotFound, []string{
+		"could not resolve host",
+		"temporary failure in name resolution",
+		"name or service not known",
+		"nodename nor servname provided",
+		"no address associated with hostname",
+	}},
+	{ErrNetwork, []string{
+		"connection refused",
+		"connection timed out",
+		"operation timed out",
+		"connection reset",
+		"network is unreachable",
+		"no route to host",
+		"failed to connect to",
+	}},
+	{ErrAmbiguousRef, []string{
+		"is ambiguous",
+	}},
+	{ErrDiverged, []string{
+		"not possible to fast-forward",
+	}},
+	{ErrNoUpstream, []string{
+		"no upstream configured",
+	}},
+	{ErrDetachedHead, []string{
+		"head does not point to a branch",
+	}},
+	{ErrNoTags, []string{
+		"no names found",
+		"tags can describe",
+	}},
+	{ErrRemoteNotFound, []string{
+		"no such remote",
+	}},
+	{ErrBranchNotMerged, []string{
+		"is not fully merged",
+	}},
+	{ErrBranchNotFound, []string{
+		"couldn't find remote ref",
+		"did not match any file(s) known to git",
+		"invalid reference:",
+	}},
+}
+
+// classify returns the sentinel error matching git's stderr output, or
+// nil if the failure is not recognised
+func classify(stderr string) error {
+	stderr = strings.ToLower(stderr)
+
+	for _, c := range classifiers {
+		for _, f := range c.fragments {
+			if strings.Contains(stderr, f) {
+				return c.err
+			}
+		}
+	}
+
+	// "remote: Permission to org/x.git denied to user."
+	if strings.Contains(stderr, "permission to ") && strings.Contains(stderr, " denied to ") {
+		return ErrAuthFailed
+	}
+
+	// "fatal: repository '/srv/x' does not exist"
+	if strings.Contains(stderr, "fatal: repository '") && strings.Contains(stderr, "' does not exist") {
+		return ErrRepoNotFound
+	}
+
+	// "fatal: a branch named 'x' already exists"
+	if strings.Contains(stderr, "a branch named '") && strings.Contains(stderr, "' already exists") {
+		return ErrBranchExists
+	}
+
+	// "error: remote origin already exists."
+	if strings.Contains(stderr, "error: remote ") && strings.Contains(stderr, " already exists") {
+		return ErrRemoteExists
+	}
+
+	// "fatal: tag 'x' already exists"
+	if strings.Contains(stderr, "tag '") && strings.Contains(stderr, "' already exists") {
+		return ErrTagExists
+	}
+
+	// "error: tag 'x' not found."
+	if strings.Contains(stderr, "error: tag '") && strings.Contains(stderr, "' not found") {
+		return ErrTagNotFound
+	}
+
+	// "error: Cannot delete branch 'x' checked out at '/srv/x'"
+	if strings.Contains(stderr, "cannot delete branch '") && strings.Contains(stderr, "checked out at") {
+		return ErrBranchCheckedOut
+	}
+
+	// "error: branch 'x' not found."
+	if strings.Contains(stderr, "error: branch '") && strings.Contains(stderr, "' not found") {
+		return ErrBranchNotFound
+	}
+
+	// "fatal: Remote branch x not found in upstream origin"
+	if strings.Contains(stderr, "remote branch") && strings.Contains(stderr, "not found") {
+		return ErrBranchNotFound
+	}
+
+	return nil
+}
+
+// ErrTimeout is matched by errors returned when a git command is killed
+// for running longer than its configured timeout
+var ErrTimeout = errors.New("git command timed out")
+
+// TimeoutError describes which git operation exceeded its timeout
+type TimeoutError struct {
+	Op      string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("git %s timed out after %s", e.Op, e.Timeout)
+}
+
+// Is reports whether target is ErrTimeout
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// DirtyError is returned when a work tree has uncommitted changes to the
+// files in Paths, or is in the middle of Operation. It matches
+// ErrDirtyWorkTree
+type DirtyError struct {
+	Paths []string
+	// Operation is the operation that stopped part way through, e.g.
+	// "merge" or "rebase", if any
+	Operation string
+}
+
+func (e *DirtyError) Error() string {
+	msg := ErrDirtyWorkTree.Error()
+	if e.Operation != "" {
+		msg += ": " + e.Operation + " in progress"
+	}
+	if len(e.Paths) > 0 {
+		msg += ": " + strings.Join(e.Paths, ", ")
+	}
+	return msg
+}
+
+// Is reports whether target is ErrDirtyWorkTree
+func (e *DirtyError) Is(target error) bool {
+	return target == ErrDirtyWorkTree
+}
+
+// DivergedError is returned when a branch can't be fast-forwarded to its
+// upstream, as it is Ahead by commits the upstream lacks, as well as
+// Behind. It matches ErrDiverged
+type DivergedError struct {
+	Ahead  int
+	Behind int
+}
+
+func (e *DivergedError) Error() string {
+	return fmt.Sprintf("%s: %d commits ahead, %d behind", ErrDiverged, e.Ahead, e.Behind)
+}
+
+// Is reports whether target is ErrDiverged
+func (e *DivergedError) Is(target error) bool {
+	return target == ErrDiverged
+}
+
+// RejectedError is returned when the remote refuses pushed refs. It
+// matches ErrPushRejected
+type RejectedError struct {
+	// Refs maps each refused ref to the reason given, e.g. "already
+	// exists" or "pre-receive hook declined"
+	Refs map[string]string
+	// Remote is what the remote said, e.g. the output of a hook
+	Remote string
+}
+
+func (e *RejectedError) Error() string {
+	refs := make([]string, 0, len(e.Refs))
+	for ref, reason := range e.Refs {
+		refs = append(refs, ref+" ("+reason+")")
+	}
+	sort.Strings(refs)
+
+	msg := fmt.Sprintf("%s: %s", ErrPushRejected, strings.Join(refs, ", "))
+	if e.Remote != "" {
+		msg += ": " + strings.Replace(e.Remote, "\n", " ", -1)
+	}
+
+	return msg
+}
+
+// Is reports whether target is ErrPushRejected
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrPushRejected
+}
+
+// PolicyError is returned when a commit isn't trusted by a
+// SignaturePolicy. It matches ErrUntrustedCommit
+type PolicyError struct {
+	Commit string
+	// Author is the commit's author, e.g. "Jo <jo@r3labs.io>"
+	Author      string
+	Status      SignatureStatus
+	Fingerprint string
+	// Reason explains why a good signature isn't trusted
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	msg := fmt.Sprintf("%s: commit %s by %s: signature %s", ErrUntrustedCommit, e.Commit, e.Author, e.Status)
+	if e.Fingerprint != "" {
+		msg += " from key " + e.Fingerprint
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// Is reports whether target is ErrUntrustedCommit
+func (e *PolicyError) Is(target error) bool {
+	return target == ErrUntrustedCommit
+}
+
+// OriginMismatchError is returned when the clone at Path has the origin
+// url Got rather than Want. It matches ErrOriginMismatch
+type OriginMismatchError struct {
+	Path string
+	Want string
+	// Got is empty if the clone has no origin remote
+	Got string
+}
+
+func (e *OriginMismatchError) Error() string {
+	got := redactURL(e.Got)
+	if got == "" {
+		got = "no origin"
+	}
+	return fmt.Sprintf("%s: %s is a clone of %s, not %s", ErrOriginMismatch, e.Path, got, redactURL(e.Want))
+}
+
+// Is reports whether target is ErrOriginMismatch
+func (e *OriginMismatchError) Is(target error) bool {
+	return target == ErrOriginMismatch
+}
+
+// BranchGoneError is returned when syncing Branch, which origin no longer
+// has, e.g. because it was renamed. Default is origin's default branch,
+// if it could be read. It matches ErrBranchNotFound
+type BranchGoneError struct {
+	Branch  string
+	Default string
+}
+
+func (e *BranchGoneError) Error() string {
+	msg := fmt.Sprintf("%s: %s is no longer on origin", ErrBranchNotFound, e.Branch)
+	if e.Default != "" {
+		msg += ", whose default branch is " + e.Default
+	}
+	return msg
+}
+
+// Is reports whether target is ErrBranchNotFound
+func (e *BranchGoneError) Is(target error) bool {
+	return target == ErrBranchNotFound
+}
+
+// RollbackError is returned when a sync failed part way through with
+// Err, and the repo was rolled back to Commit, on Branch unless HEAD was
+// detached, as it was before. If that failed too Rollback says why, the
+// repo may be left in any state, and the error matches ErrRollbackFailed.
+// Otherwise it matches what Err does
+type RollbackError struct {
+	Err      error
+	Rollback error
+	Branch   string
+	Commit   string
+}
+
+func (e *RollbackError) Error() string {
+	to := e.Commit
+	if e.Branch != "" {
+		to = e.Branch + " at " + e.Commit
+	}
+
+	if e.Rollback != nil {
+		return fmt.Sprintf("%s; rolling back to %s failed too: %s", e.Err, to, e.Rollback)
+	}
+	return fmt.Sprintf("%s; rolled back to %s", e.Err, to)
+}
+
+// Unwrap returns the error the sync failed with
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrRollbackFailed, if rolling back failed
+func (e *RollbackError) Is(target error) bool {
+	return target == ErrRollbackFailed && e.Rollback != nil
+}
+
+// LockedError is returned when the lock file at Path was held by another
+// process for longer than the repo's LockWait. PID and Host identify the
+// process, and Since says when it took the lock. PID is zero if the lock
+// file couldn't be read, e.g. because it was still being written, and
+// Since is when it was last written. It matches ErrLocked
+type LockedError struct {
+	Path  string
+	PID   int
+	Host  string
+	Since time.Time
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s: %s", ErrLocked, e.Path)
+	}
+	return fmt.Sprintf("%s: %s held by process %d on %s since %s", ErrLocked, e.Path, e.PID, e.Host, e.Since.Format(time.RFC3339))
+}
+
+// Is reports whether target is ErrLocked
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// HookError is returned when the sync hook named Hook, e.g. "BeforeSync",
+// failed or panicked with Err. It matches ErrHookFailed and what Err does
+type HookError struct {
+	Hook string
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrHookFailed, e.Hook, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrHookFailed
+func (e *HookError) Is(target error) bool {
+	return target == ErrHookFailed
+}
+
+// ConflictError is returned when Op, "merge" or "rebase", stopped because
+// of conflicts in Paths. It matches ErrMergeConflict or ErrRebaseConflict
+type ConflictError struct {
+	Op    string
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s conflict in %s", e.Op, strings.Join(e.Paths, ", "))
+}
+
+// Is reports whether target is the sentinel error for the operation
+func (e *ConflictError) Is(target error) bool {
+	switch e.Op {
+	case "merge":
+		return target == ErrMergeConflict
+	case "rebase":
+		return target == ErrRebaseConflict
+	}
+	return false
+}
+
+// GitError describes a failed git command. Its Error string is kept
+// short; the full output of git is available through Stderr
+type GitError struct {
+	// Message is a short description of what failed
+	Message string
+	// Args are the arguments git was run with, with the credentials in any
+	// urls redacted
+	Args []string
+	// ExitCode is git's exit status, or -1 if git did not exit on its own
+	ExitCode int
+	// Stderr is everything git wrote to stderr
+	Stderr string
+	// Err is the underlying cause of the failure: one of the package's
+	// sentinel errors when git's output was recognised, a cancelled context
+	// or timeout, or nil if git exited non-zero for an unknown reason
+	Err error
+}
+
+func (e *GitError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying cause of the failure
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// Command returns the git command line that failed
+func (e *GitError) Command() string {
+	return "git " + strings.Join(e.Args, " ")
+}
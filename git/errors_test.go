@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		stderr string
+		want   error
+	}{
+		{
+			"ssh key rejected",
+			"git@github.com: Permission denied (publickey).\r\nfatal: Could not read from remote repository.\n\nPlease make sure you have the correct access rights\nand the repository exists.\n",
+			ErrAuthFailed,
+		},
+		{
+			"ssh password rejected",
+			"Permission denied, please try again.\r\ngit@git.example.com: Permission denied (publickey,password).\r\nfatal: Could not read from remote repository.\n",
+			ErrAuthFailed,
+		},
+		{
+			"ssh repository missing",
+			"ERROR: Repository not found.\nfatal: Could not read from remote repository.\n\nPlease make sure you have the correct access rights\nand the repository exists.\n",
+			ErrRepoNotFound,
+		},
+		{
+			"ssh host missing",
+			"ssh: Could not resolve hostname git.example.invalid: Name or service not known\r\nfatal: Could not read from remote repository.\n",
+			ErrHostNotFound,
+		},
+		{
+			"ssh connection refused",
+			"ssh: connect to host git.example.com port 22: Connection refused\r\nfatal: Could not read from remote repository.\n",
+			ErrNetwork,
+		},
+		{
+			"https credentials rejected",
+			"remote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/org/repo.git/'\n",
+			ErrAuthFailed,
+		},
+		{
+			"https prompts disabled",
+			"fatal: could not read Username for 'https://github.com': terminal prompts disabled\n",
+			ErrAuthFailed,
+		},
+		{
+			"https push denied",
+			"remote: Permission to org/repo.git denied to someone.\nfatal: unable to access 'https://github.com/org/repo.git/': The requested URL returned error: 403\n",
+			ErrAuthFailed,
+		},
+		{
+			"https repository missing",
+			"remote: Repository not found.\nfatal: repository 'https://github.com/org/missing.git/' not found\n",
+			ErrRepoNotFound,
+		},
+		{
+			"https 404",
+			"fatal: unable to access 'https://git.example.com/missing.git/': The requested URL returned error: 404\n",
+			ErrRepoNotFound,
+		},
+		{
+			"https host missing",
+			"fatal: unable to access 'https://git.example.invalid/repo.git/': Could not resolve host: git.example.invalid\n",
+			ErrHostNotFound,
+		},
+		{
+			"https connection failed",
+			"fatal: unable to access 'https://git.example.com/repo.git/': Failed to connect to git.example.com port 443 after 2 ms: Couldn't connect to server\n",
+			ErrNetwork,
+		},
+		{
+			"missing branch",
+			"warning: Could not find remote branch nope to clone.\nfatal: Remote branch nope not found in upstream origin\n",
+			ErrBranchNotFound,
+		},
+		{
+			"missing remote ref",
+			"fatal: couldn't find remote ref refs/heads/nope\n",
+			ErrBranchNotFound,
+		},
+		{
+			"unwritable destination",
+			"fatal: could not create work tree dir '/srv/deploy/repo': Permission denied\n",
+			nil,
+		},
+		{
+			"unwritable object directory",
+			"error: insufficient permission for adding an object to repository database .git/objects\nfatal: failed to write object\n",
+			nil,
+		},
+		{
+			"unknown",
+			"fatal: something nobody has seen before\n",
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classify(tt.stderr)
+			if got != tt.want {
+				t.Errorf("classify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitErrorFallsBackToGeneric(t *testing.T) {
+	err := &GitError{Message: "could not clone repo", Stderr: "fatal: something nobody has seen before\n"}
+
+	for _, sentinel := range []error{ErrAuthFailed, ErrRepoNotFound, ErrNetwork, ErrBranchNotFound} {
+		if errors.Is(err, sentinel) {
+			t.Errorf("unrecognised failure matches %v", sentinel)
+		}
+	}
+
+	var gerr *GitError
+	if !errors.As(err, &gerr) {
+		t.Errorf("errors.As(*GitError) = false")
+	}
+}
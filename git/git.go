@@ -5,28 +5,329 @@
 package git
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// submodulePath matches the submodule named in git's error output, e.g.
+// "fatal: clone of '...' into submodule path '/srv/app/config' failed"
+var submodulePath = regexp.MustCompile(`(?:submodule path|Failed to clone) '([^']+)'`)
+
+// commitIDPattern matches full and abbreviated commit ids
+var commitIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,64}$`)
+
+// reportsProgress lists the git subcommands that accept --progress
+var reportsProgress = map[string]bool{
+	"clone": true,
+	"fetch": true,
+	"pull":  true,
+	"push":  true,
+}
+
 // Repo stores all information about a git repo
+//
+// A Repo is safe for concurrent use once cloned or opened. Operations that
+// change the repo, such as Fetch, Checkout and Sync, run one at a time,
+// holding the repo's lock throughout, while read-only ones, such as
+// CommitID and Log, run alongside each other, each git command they run
+// waiting for any operation changing the repo to finish. An operation
+// finding the repo busy waits its turn, or fails with ErrBusy if its ctx
+// comes from NoWait. Sync hooks run outside the lock, so they may use the
+// repo, but a Logger, or the fn given to ForEachCommit and the like, must
+// not. The exported fields must not be changed while the repo is in use,
+// nor Repo read, as SetRemoteURL changes it; use RemoteURL instead
 type Repo struct {
 	Repo           string
 	Destination    string
 	deploymentPath string
+
+	// Timeout bounds every git command run for the repo. Zero means
+	// commands may run indefinitely
+	Timeout time.Duration
+	// Timeouts overrides Timeout for individual git subcommands, keyed by
+	// the subcommand name, e.g. "clone" or "fetch"
+	Timeouts map[string]time.Duration
+	// GitBinary is the git executable to run, overriding DefaultGitBinary
+	GitBinary string
+	// Observer, if set, is told how long each operation on the repo takes
+	Observer Observer
+	// Logger, if set, is told about every git command run for the repo
+	Logger Logger
+	// BeforeSync, if set, is called before Sync, SyncWithOptions, SyncForce,
+	// SyncTag and SyncTo run any git command, and an error from it aborts the
+	// sync. AfterSync is called once a sync succeeds, with what it did,
+	// and an error from it is returned along with the result. OnError is
+	// called with the error whenever a sync fails, once any rollback is
+	// done. A hook that panics fails the sync with a *HookError
+	BeforeSync func(*Repo) error
+	AfterSync  func(*Repo, SyncResult) error
+	OnError    func(*Repo, error)
+	// LockFile makes the operations that change the repo hold a lock file
+	// in its git directory too, so other processes using the same clone
+	// with LockFile set wait their turn. LockWait bounds how long they wait
+	// for one another before failing with a *LockedError; zero fails
+	// straight away. A lock left by a process that is no longer running on
+	// the same host is broken
+	LockFile bool
+	LockWait time.Duration
+	// DryRun stops the repo from changing anything on disk. Commands that
+	// would are recorded instead, and can be retrieved with
+	// PlannedCommands, while read-only commands still run
+	DryRun bool
+	// Runner runs the repo's git commands. It defaults to ExecRunner, and
+	// can be replaced to test code using the package without git, e.g.
+	// with a gittest.Runner
+	Runner Runner
+	// Env holds environment variables added to every git command run for
+	// the repo, replacing any inherited variables of the same name
+	Env map[string]string
+	// Prune removes remote-tracking branches that no longer exist on the
+	// remote when fetching, and PruneTags, which implies Prune, does the
+	// same for tags
+	Prune     bool
+	PruneTags bool
+	// SyncTags makes Sync fetch all tags from origin, updating any that
+	// were moved there
+	SyncTags bool
+	// AllowDirty lets Checkout and Sync run over uncommitted changes to
+	// tracked files, leaving git to carry them over or fail, rather than
+	// refusing with ErrDirtyWorkTree
+	AllowDirty bool
+	// DirtyUntracked makes untracked files count as uncommitted changes,
+	// for IsClean and the checks Checkout and Sync make before touching
+	// the work tree. By default they are ignored, as git refuses to
+	// overwrite them itself
+	DirtyUntracked bool
+	// AutoDeepen lets operations that need more history than a shallow
+	// clone has, such as Diverged, fetch it and try again
+	AutoDeepen bool
+	// Reconcile decides what Clone and Open do with an existing clone
+	// whose origin url is not Repo. By default they fail with an
+	// *OriginMismatchError rather than use the wrong repo
+	Reconcile Reconcile
+	// Progress receives git's progress output from clone, fetch and pull
+	// as it is written. A nil Progress discards it
+	Progress io.Writer
+	// SSHKeyPath is the private key used to authenticate with ssh remotes,
+	// instead of whichever identities ssh would otherwise offer
+	SSHKeyPath string
+	// Token authenticates with https remotes. It is handed to git through
+	// a credential helper on every invocation rather than stored in the
+	// remote url or the repo's config, so it can be rotated at any time.
+	// It is only offered to origin's host
+	Token string
+	// TokenUsername is the username sent along with Token. It defaults to
+	// "x-access-token"
+	TokenUsername string
+	// AllowPrompts lets git ask for credentials, ssh passphrases and host
+	// key confirmation interactively. By default git fails instead, as
+	// nobody is expected to be there to answer
+	AllowPrompts bool
+	// HostKeyPolicy decides whether ssh accepts the keys of hosts it has
+	// not seen before. It defaults to HostKeyStrict, overriding ssh's
+	// configuration; HostKeySSHConfig defers to it instead
+	HostKeyPolicy HostKeyPolicy
+	// KnownHostsFile replaces the user's known_hosts file as the list of
+	// trusted host keys
+	KnownHostsFile string
+	// GnuPGHome is the gpg home directory whose keyring signatures are
+	// checked against, instead of the user's
+	GnuPGHome string
+	// AllowedSignersFile is the ssh allowed signers file, in the format
+	// described by ssh-keygen(1), whose keys ssh signatures are checked
+	// against, instead of the one in git's config. AllowedSigners lists
+	// the keys directly, and is used if AllowedSignersFile is empty
+	AllowedSignersFile string
+	AllowedSigners     []AllowedSigner
+
+	depth        int
+	branch       string
+	singleBranch bool
+	dir          string
+	bare         bool
+	submodules   bool
+	filter       string
+	filtered     bool
+	reference    string
+	dissociate   bool
+	version      *Version
+	planned      []string
+	pruned       int
+	// sshConfig caches core.sshCommand, which GIT_SSH_COMMAND extends
+	sshConfig *string
+	// signersFile is the temporary file AllowedSigners are written to
+	// while signatures are checked
+	signersFile string
+	// defaultBranch caches DefaultBranch; defaultStale is set by fetches
+	// once it may have changed on origin
+	defaultBranch string
+	defaultStale  bool
+	// signersUsers counts the operations using signersFile
+	signersUsers int
+
+	// ops is the lock operations on the repo take, and mu guards the
+	// state read-only operations may share: Repo, version, planned,
+	// pruned, the ssh config, the signers file and the default branch
+	ops opLock
+	mu  sync.Mutex
+}
+
+// CloneOptions configures how a repo is cloned
+//
+// Deprecated: use Clone with WithDepth, WithBranch, WithSingleBranch,
+// WithDir and WithBare
+type CloneOptions struct {
+	// Depth truncates the cloned history to the given number of commits
+	// on every branch. Zero clones the full history
+	Depth int
+	// Branch is checked out after cloning instead of the remote's HEAD
+	Branch string
+	// SingleBranch only clones the history of Branch, or of the remote's
+	// HEAD if Branch is empty. Later fetches are restricted to that branch
+	SingleBranch bool
+	// Dir is the name of the directory the repo is cloned into under the
+	// destination. It defaults to the repo's Name, with a .git suffix for
+	// bare clones
+	Dir string
+	// Bare clones the repo without a work tree. Operations that need a
+	// work tree, such as Checkout and Pull, fail with ErrBareRepo
+	Bare bool
 }
 
 // Clone sets up and clones a git repo
-func Clone(repo, destination string) (*Repo, error) {
+func Clone(repo, destination string, opts ...Option) (*Repo, error) {
+	return CloneContext(context.Background(), repo, destination, opts...)
+}
+
+// CloneContext sets up and clones a git repo. If ctx is cancelled or its
+// deadline passes, the git process is killed and the returned error wraps
+// ctx.Err()
+//
+// A clone already in the destination is reused if its origin is repo,
+// ignoring differences such as ssh and https forms of the same url.
+// Otherwise Clone fails with an *OriginMismatchError, unless Reconcile
+// says to fix the origin url or clone afresh. A directory there that
+// isn't a clone fails with ErrNotRepository
+func CloneContext(ctx context.Context, repo, destination string, opts ...Option) (*Repo, error) {
 	r := Repo{
 		Repo:        repo,
 		Destination: destination,
 	}
 
-	err := r.clone()
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	start := time.Now()
+	err := backend.Clone(ctx, &r)
+	r.observe("clone", start, &err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// CloneWithOptions sets up and clones a git repo as configured by opts
+//
+// Deprecated: use Clone with WithDepth, WithBranch, WithSingleBranch,
+// WithDir and WithBare
+func CloneWithOptions(repo, destination string, opts CloneOptions) (*Repo, error) {
+	return CloneWithOptionsContext(context.Background(), repo, destination, opts)
+}
+
+// CloneWithOptionsContext sets up and clones a git repo as configured by
+// opts, aborting if ctx is done
+//
+// Deprecated: use CloneContext with WithDepth, WithBranch,
+// WithSingleBranch, WithDir and WithBare
+func CloneWithOptionsContext(ctx context.Context, repo, destination string, opts CloneOptions) (*Repo, error) {
+	o := []Option{WithDepth(opts.Depth), WithBranch(opts.Branch), WithDir(opts.Dir)}
+	if opts.SingleBranch {
+		o = append(o, WithSingleBranch())
+	}
+	if opts.Bare {
+		o = append(o, WithBare())
+	}
+
+	return CloneContext(ctx, repo, destination, o...)
+}
+
+// CloneInto sets up and clones a git repo into the directory dirname under
+// destination, rather than one named after the repo
+//
+// Deprecated: use Clone with WithDir
+func CloneInto(repo, destination, dirname string) (*Repo, error) {
+	return Clone(repo, destination, WithDir(dirname))
+}
+
+// UpdateCache creates or updates a mirror of repo at path, for use as a
+// reference by clones made WithReference
+func UpdateCache(repo, path string, opts ...Option) error {
+	return UpdateCacheContext(context.Background(), repo, path, opts...)
+}
+
+// UpdateCacheContext creates or updates a mirror of repo at path,
+// aborting if ctx is done
+func UpdateCacheContext(ctx context.Context, repo, path string, opts ...Option) (err error) {
+	r := Repo{Repo: repo}
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	defer r.observe("update-cache", time.Now(), &err)
+
+	if !isRepo(ctx, path) {
+		_, err = r.output(ctx, filepath.Dir(path), "could not create cache of repo "+r.Name(), "clone", "--mirror", repo, path)
+		return err
+	}
+
+	_, err = r.output(ctx, path, "could not update cache of repo "+r.Name(), "fetch", "--prune")
+	return err
+}
+
+// Open attaches to a repo that has already been cloned to path
+func Open(path string, opts ...Option) (*Repo, error) {
+	return OpenContext(context.Background(), path, opts...)
+}
+
+// OpenContext attaches to a repo that has already been cloned to path,
+// aborting if ctx is done. ErrNotRepository is returned if path exists but
+// is not a git work tree. If the repo's url is given WithRepo, the repo's
+// origin is checked against it as by Clone
+func OpenContext(ctx context.Context, path string, opts ...Option) (*Repo, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r Repo
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	r.Destination = filepath.Dir(path)
+	r.deploymentPath = path
+	r.dir = filepath.Base(path)
+
+	start := time.Now()
+	err = backend.Open(ctx, &r)
+	r.observe("open", start, &err)
 	if err != nil {
 		return nil, err
 	}
@@ -34,21 +335,113 @@ func Clone(repo, destination string) (*Repo, error) {
 	return &r, nil
 }
 
+// open reads the state of the repo at deploymentPath
+func (r *Repo) open(ctx context.Context) error {
+	path := r.deploymentPath
+
+	err := r.lookGit()
+	if err != nil {
+		return err
+	}
+
+	output, err := r.output(ctx, path, "could not read repo", "rev-parse", "--is-bare-repository", "--is-inside-work-tree")
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.ExitCode < 0 {
+		return err
+	}
+
+	state := strings.Fields(string(output))
+	switch {
+	case len(state) != 2:
+		return fmt.Errorf("%s: %w", path, ErrNotRepository)
+	case state[0] == "true":
+		r.bare = true
+	case state[1] != "true":
+		return fmt.Errorf("%s: %w", path, ErrNotRepository)
+	}
+
+	// a repo without an origin remote is left with an empty Repo url
+	want := r.repoURL()
+	var origin string
+	output, err = r.output(ctx, path, "could not read origin url", "config", "remote.origin.url")
+	if err == nil {
+		origin = strings.TrimSpace(string(output))
+	}
+	r.setRepoURL(origin)
+
+	if want != "" && !sameURL(origin, want) {
+		r.setRepoURL(want)
+
+		reclone, err := r.reconcile(ctx, origin)
+		if reclone {
+			return r.clone(ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// partial clones record the filter they were made with
+	output, err = r.output(ctx, path, "could not read origin filter", "config", "remote.origin.partialclonefilter")
+	if err == nil {
+		r.filter = strings.TrimSpace(string(output))
+		r.filtered = true
+	}
+
+	// single-branch clones only fetch refs/heads/<branch>
+	output, err = r.output(ctx, path, "could not read origin refspec", "config", "--get-all", "remote.origin.fetch")
+	if err == nil {
+		refspecs := strings.Fields(string(output))
+		if len(refspecs) == 1 && !strings.Contains(refspecs[0], "*") {
+			src := strings.SplitN(strings.TrimPrefix(refspecs[0], "+"), ":", 2)[0]
+			r.branch = strings.TrimPrefix(src, "refs/heads/")
+			r.singleBranch = true
+		}
+	}
+
+	return nil
+}
+
+// CloneTimeout sets up and clones a git repo, killing the clone if it
+// takes longer than timeout
+//
+// Deprecated: use Clone with WithOperationTimeout("clone", timeout)
+func CloneTimeout(repo, destination string, timeout time.Duration) (*Repo, error) {
+	return Clone(repo, destination, WithOperationTimeout("clone", timeout))
+}
+
 // Path returns the repo's path
 func (r *Repo) Path() string {
-	path := strings.Split(r.Repo, ":")
+	path := strings.Split(r.repoURL(), ":")
 	return strings.Replace(path[len(path)-1], ".git", "", -1)
 }
 
 // Name returns the repo's name
 func (r *Repo) Name() string {
-	path := strings.Split(r.Repo, "/")
-	return strings.Replace(path[len(path)-1], ".git", "", -1)
+	url := r.repoURL()
+	name := url[strings.LastIndexAny(url, "/\\")+1:]
+	return strings.Replace(name, ".git", "", -1)
+}
+
+// repoURL returns Repo, which is guarded by mu as SetRemoteURL changes it
+// while other operations may be reading it
+func (r *Repo) repoURL() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.Repo
+}
+
+// setRepoURL changes Repo
+func (r *Repo) setRepoURL(url string) {
+	r.mu.Lock()
+	r.Repo = url
+	r.mu.Unlock()
 }
 
 // Exists checks if the repo exists in the destination
 func (r *Repo) Exists() bool {
-	_, err := os.Stat(r.deploymentPath)
+	_, err := os.Stat(r.DeployPath())
 	if err != nil {
 		return false
 	}
@@ -58,143 +451,2334 @@ func (r *Repo) Exists() bool {
 
 // DeployPath gives the full path to the project/repo
 func (r *Repo) DeployPath() string {
-	return r.Destination + r.Name()
+	if r.deploymentPath != "" {
+		return r.deploymentPath
+	}
+	return filepath.Join(r.Destination, r.dirName())
+}
+
+// dirName returns the name of the repo's directory under Destination
+func (r *Repo) dirName() string {
+	if r.dir != "" {
+		return r.dir
+	}
+	if r.bare {
+		return r.Name() + ".git"
+	}
+	return r.Name()
+}
+
+// PlannedCommands returns the commands a DryRun repo would have run, in
+// order
+func (r *Repo) PlannedCommands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.planned...)
+}
+
+// Filtered reports whether the repo is a partial clone. It is false if a
+// filter was requested but the remote did not support it, in which case a
+// full clone was made instead
+func (r *Repo) Filtered() bool {
+	return r.filtered
 }
 
-// Fetch all branches from remote
+// Fetch all branches from origin
 func (r *Repo) Fetch() error {
-	cmd := exec.Command("git", "fetch")
-	cmd.Dir = r.deploymentPath
+	return r.FetchContext(context.Background())
+}
+
+// FetchContext fetches all branches from origin, aborting if ctx is done
+func (r *Repo) FetchContext(ctx context.Context) error {
+	return r.FetchWithOptionsContext(ctx, FetchOptions{Prune: r.Prune, PruneTags: r.PruneTags})
+}
+
+// FetchOptions configures FetchWithOptions
+type FetchOptions struct {
+	// Prune removes remote-tracking branches that no longer exist on
+	// origin, and PruneTags, which implies Prune, does the same for tags
+	Prune     bool
+	PruneTags bool
+}
+
+// FetchWithOptions fetches all branches from origin as configured by
+// opts, which take the place of the repo's Prune and PruneTags
+func (r *Repo) FetchWithOptions(opts FetchOptions) error {
+	return r.FetchWithOptionsContext(context.Background(), opts)
+}
 
-	_, err := cmd.Output()
+// FetchWithOptionsContext fetches all branches from origin as configured
+// by opts, aborting if ctx is done
+func (r *Repo) FetchWithOptionsContext(ctx context.Context, opts FetchOptions) (err error) {
+	defer r.observe("fetch", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
 	if err != nil {
-		return errors.New("could not fetch repo data")
+		return err
 	}
+	defer unlock()
 
-	return nil
+	err = backend.Fetch(ctx, r, opts)
+	if err == nil {
+		r.forgetDefaultBranch()
+	}
+
+	return err
 }
 
-// Checkout git branch
-func (r *Repo) Checkout(branch string) error {
-	cmd := exec.Command("git", "checkout", branch)
-	cmd.Dir = r.deploymentPath
+func (r *Repo) fetch(ctx context.Context, opts FetchOptions) error {
+	// single-branch clones are restricted by the refspec git configured
+	// for origin when cloning, so a plain fetch only updates that branch
+	args := []string{"fetch"}
+
+	// bare clones have no fetch refspec and no remote-tracking branches;
+	// their local branches mirror the remote's
+	if r.bare {
+		refspec := "+refs/heads/*:refs/heads/*"
+		if r.singleBranch && r.branch != "" {
+			refspec = "+refs/heads/" + r.branch + ":refs/heads/" + r.branch
+		}
+		args = append(args, "origin", refspec)
+	}
+
+	// keep a shallow clone shallow, rather than pulling in the full
+	// history of branches that appeared since it was cloned
+	if r.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(r.depth))
+	}
+
+	// only refs matching the fetch refspecs are pruned, so single-branch
+	// clones never lose the branches they don't track
+	if opts.Prune || opts.PruneTags {
+		args = append(args, "--prune")
+	}
+
+	if opts.PruneTags {
+		err := r.requireVersion(ctx, "--prune-tags", 2, 17)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--prune-tags")
+	}
+
+	_, stderr, err := r.mutate(ctx, r.deploymentPath, "could not fetch repo data", args...)
+	r.mu.Lock()
+	r.pruned = bytes.Count(stderr, []byte("[deleted]"))
+	r.mu.Unlock()
+
+	return err
+}
+
+// IsShallow reports whether the repo is a shallow clone, missing history
+// beyond some depth
+func (r *Repo) IsShallow() (bool, error) {
+	_, err := os.Stat(filepath.Join(r.gitDir(), "shallow"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not check for shallow clone: %w", err)
+	}
+
+	return true, nil
+}
+
+// Deepen fetches n more commits of history for a shallow clone
+func (r *Repo) Deepen(n int) error {
+	return r.DeepenContext(context.Background(), n)
+}
+
+// DeepenContext fetches n more commits of history for a shallow clone,
+// aborting if ctx is done
+func (r *Repo) DeepenContext(ctx context.Context, n int) (err error) {
+	defer r.observe("fetch", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	_, err := cmd.Output()
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not deepen repo history", "fetch", "origin", "--deepen="+strconv.Itoa(n))
 	if err != nil {
-		return errors.New("could not checkout branch")
+		return err
+	}
+
+	// later fetches keep the new depth, rather than cutting history back
+	if r.depth > 0 {
+		r.depth += n
 	}
 
 	return nil
 }
 
-// Branch : ..
-func (r *Repo) Branch() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
-	cmd.Dir = r.deploymentPath
+// Unshallow fetches the full history of a shallow clone. It does nothing
+// for a clone that is already complete
+func (r *Repo) Unshallow() error {
+	return r.UnshallowContext(context.Background())
+}
 
-	output, err := cmd.Output()
+// UnshallowContext fetches the full history of a shallow clone, aborting
+// if ctx is done
+func (r *Repo) UnshallowContext(ctx context.Context) (err error) {
+	ctx, unlock, err := r.lock(ctx, true)
 	if err != nil {
-		return "", errors.New("could not get git branch")
+		return err
 	}
+	defer unlock()
 
-	branch := string(output)
-	return strings.TrimSpace(branch), nil
-}
+	shallow, err := r.IsShallow()
+	if err != nil || !shallow {
+		return err
+	}
 
-// Pull from remote
-func (r *Repo) Pull() error {
-	cmd := exec.Command("git", "pull")
-	cmd.Dir = r.deploymentPath
+	defer r.observe("fetch", time.Now(), &err)
 
-	_, err := cmd.Output()
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not unshallow repo", "fetch", "origin", "--unshallow")
 	if err != nil {
-		return errors.New("could not pull repo changes")
+		return err
 	}
 
+	r.depth = 0
+
 	return nil
 }
 
-// CommitID returns the commit id for the currently checked out branch
-func (r *Repo) CommitID() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "HEAD")
-	cmd.Dir = r.deploymentPath
+// withHistory runs fn, and if it fails in a shallow clone with AutoDeepen
+// set, deepens the clone a few times, then unshallows it, trying fn again
+// after each
+func (r *Repo) withHistory(ctx context.Context, fn func() error) error {
+	err := fn()
 
-	output, err := cmd.Output()
-	if err != nil {
-		return "", errors.New("could not get git revision id")
+	for attempt := 0; err != nil && r.AutoDeepen && ctx.Err() == nil; attempt++ {
+		shallow, serr := r.IsShallow()
+		if serr != nil || !shallow || attempt > 3 {
+			return err
+		}
+
+		var derr error
+		if attempt < 3 {
+			derr = r.DeepenContext(ctx, 50<<(2*attempt))
+		} else {
+			derr = r.UnshallowContext(ctx)
+		}
+		if derr != nil {
+			return err
+		}
+
+		err = fn()
 	}
 
-	id := string(output)
-	return strings.TrimSpace(id), nil
+	return err
 }
 
-// Diverged : Check if two branches have diverged
-func (r *Repo) Diverged(from, to string) (bool, error) {
-	cmd := exec.Command("git", "diff", from+"..."+to)
-	cmd.Dir = r.deploymentPath
+// FetchAll fetches from every remote configured for the repo. Each remote
+// is fetched separately, so one that can't be reached doesn't stop the
+// others being updated; the returned map holds the result of fetching each
+// remote, keyed by name
+func (r *Repo) FetchAll() (map[string]error, error) {
+	return r.FetchAllContext(context.Background())
+}
 
-	output, err := cmd.Output()
+// FetchAllContext fetches from every remote configured for the repo,
+// aborting if ctx is done
+func (r *Repo) FetchAllContext(ctx context.Context) (map[string]error, error) {
+	ctx, unlock, err := r.lock(ctx, true)
 	if err != nil {
-		return true, errors.New("could not get git revision id's")
+		return nil, err
 	}
+	defer unlock()
 
-	if string(output) == "" {
-		return false, nil
+	remotes, err := r.remoteNames(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	return true, nil
+	results := make(map[string]error, len(remotes))
+	for _, remote := range remotes {
+		results[remote] = r.FetchRemoteContext(ctx, remote)
+	}
+
+	return results, nil
 }
 
-// Commits : ..
-func (r *Repo) Commits() ([]string, error) {
-	var ids []string
+// remoteNames lists the remotes configured for the repo
+func (r *Repo) remoteNames(ctx context.Context) ([]string, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not list remotes", "remote")
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(output)), nil
+}
 
-	cmd := exec.Command("git", "log", "--pretty=format:'%h'")
-	cmd.Dir = r.deploymentPath
+// FetchPrune fetches all branches from origin, removing remote-tracking
+// branches, and tags if PruneTags is set, that no longer exist on origin.
+// It returns the number of refs removed
+func (r *Repo) FetchPrune() (int, error) {
+	return r.FetchPruneContext(context.Background())
+}
 
-	output, err := cmd.Output()
+// FetchPruneContext fetches all branches from origin and prunes deleted
+// ones, aborting if ctx is done
+func (r *Repo) FetchPruneContext(ctx context.Context) (int, error) {
+	ctx, unlock, err := r.lock(ctx, true)
 	if err != nil {
-		return ids, errors.New("could not get git revision id's")
+		return 0, err
 	}
+	defer unlock()
 
-	for _, id := range strings.Split(string(output), "\n") {
-		ids = append(ids, strings.TrimSpace(id))
+	err = r.FetchWithOptionsContext(ctx, FetchOptions{Prune: true, PruneTags: r.PruneTags})
+	return r.Pruned(), err
+}
+
+// TagFetch lists the tags changed by FetchTags
+type TagFetch struct {
+	// New lists tags fetched for the first time
+	New []string
+	// Moved lists tags that were re-pointed on the remote, and updated to
+	// match
+	Moved []string
+	// Rejected lists tags that were re-pointed on the remote, but kept as
+	// they were because force was not set
+	Rejected []string
+}
+
+// FetchTags fetches all tags from origin, along with the commits they
+// point to. Tags that were moved on origin are only updated if force is
+// set, and are listed in the result either way
+func (r *Repo) FetchTags(force bool) (*TagFetch, error) {
+	return r.FetchTagsContext(context.Background(), force)
+}
+
+// FetchTagsContext fetches all tags from origin, aborting if ctx is done
+func (r *Repo) FetchTagsContext(ctx context.Context, force bool) (tags *TagFetch, err error) {
+	defer r.observe("fetch-tags", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	return ids, nil
+	args := []string{"fetch", "origin", "--tags"}
+	if force {
+		args = append(args, "--force")
+	}
+	if r.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(r.depth))
+	}
+
+	_, stderr, err := r.mutate(ctx, r.deploymentPath, "could not fetch repo tags", args...)
+	tags = parseTagFetch(stderr)
+
+	// git fails when it refuses to move a tag, which is reported in
+	// Rejected instead
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.ExitCode == 1 && len(tags.Rejected) > 0 &&
+		!strings.Contains(gerr.Stderr, "fatal:") &&
+		strings.Count(gerr.Stderr, "[rejected]") == len(tags.Rejected) {
+		err = nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
 }
 
-// Sync : ...
-func (r *Repo) Sync(branch string) error {
-	// Fetch correct branch and update
-	err := r.Fetch()
+// parseTagFetch reads the tags changed by a fetch from its output, e.g.
+// " t [tag update]      v1         -> v1"
+func parseTagFetch(output []byte) *TagFetch {
+	var tags TagFetch
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		i := indexOf(fields, "->")
+		if i < 0 || i+1 >= len(fields) {
+			continue
+		}
+		name := fields[i+1]
+
+		switch {
+		case strings.Contains(line, "[new tag]"):
+			tags.New = append(tags.New, name)
+		case strings.Contains(line, "[tag update]"):
+			tags.Moved = append(tags.Moved, name)
+		case strings.Contains(line, "[rejected]") && strings.Contains(line, "would clobber existing tag"):
+			tags.Rejected = append(tags.Rejected, name)
+		}
+	}
+
+	return &tags
+}
+
+func indexOf(s []string, v string) int {
+	for i := range s {
+		if s[i] == v {
+			return i
+		}
+	}
+	return -1
+}
+
+// Pruned returns the number of refs removed by the last fetch
+func (r *Repo) Pruned() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.pruned
+}
+
+// FetchRemote fetches refspecs from the named remote, or the refs its
+// fetch refspecs configure if none are given
+func (r *Repo) FetchRemote(remote string, refspecs ...string) error {
+	return r.FetchRemoteContext(context.Background(), remote, refspecs...)
+}
+
+// FetchRemoteContext fetches refspecs from the named remote, aborting if
+// ctx is done
+func (r *Repo) FetchRemoteContext(ctx context.Context, remote string, refspecs ...string) (err error) {
+	defer r.observe("fetch", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	err = r.Checkout(branch)
-	if err != nil {
-		return fmt.Errorf("could not checkout repo branch " + r.Name() + ":" + branch)
+	args := append([]string{"fetch", remote}, refspecs...)
+	if r.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(r.depth))
 	}
 
-	err = r.Pull()
+	msg := "could not fetch from remote " + remote
+	if len(refspecs) > 0 {
+		msg = fmt.Sprintf("could not fetch %s from remote %s", strings.Join(refspecs, " "), remote)
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, msg, args...)
 	return err
 }
 
-// Clone the repositort into the destination
-func (r *Repo) clone() error {
-	r.deploymentPath = r.Destination + r.Name()
+// Checkout git branch
+func (r *Repo) Checkout(branch string) error {
+	return r.CheckoutContext(context.Background(), branch)
+}
+
+// CheckoutContext checks out a git branch, aborting if ctx is done
+func (r *Repo) CheckoutContext(ctx context.Context, branch string) error {
+	_, err := r.CheckoutWithOptionsContext(ctx, branch, CheckoutOptions{})
+	return err
+}
+
+// CheckoutOptions configures CheckoutWithOptions
+type CheckoutOptions struct {
+	// Force discards local changes to tracked files, staged or not, so the
+	// checkout can't be stopped by them
+	Force bool
+}
+
+// CheckoutWithOptions checks out branch as configured by opts. It returns
+// the files whose local changes were discarded by a forced checkout
+func (r *Repo) CheckoutWithOptions(branch string, opts CheckoutOptions) ([]string, error) {
+	return r.CheckoutWithOptionsContext(context.Background(), branch, opts)
+}
+
+// CheckoutWithOptionsContext checks out branch as configured by opts,
+// aborting if ctx is done
+func (r *Repo) CheckoutWithOptionsContext(ctx context.Context, branch string, opts CheckoutOptions) ([]string, error) {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return r.checkoutBranch(ctx, branch, opts, true)
+}
+
+// checkoutBranch checks out branch, first making sure the work tree is
+// clean if checkClean is set
+func (r *Repo) checkoutBranch(ctx context.Context, branch string, opts CheckoutOptions, checkClean bool) (overwritten []string, err error) {
+	defer r.observe("checkout", time.Now(), &err)
 
-	// Clone the repo, if it doesn't exist
-	if !r.Exists() {
-		cmd := exec.Command("git", "clone", r.Repo)
-		cmd.Dir = r.Destination
+	if r.bare {
+		return nil, fmt.Errorf("could not checkout branch: %w", ErrBareRepo)
+	}
 
-		_, err := cmd.Output()
+	if checkClean && !opts.Force {
+		err = r.checkClean(ctx)
 		if err != nil {
-			fmt.Println(err)
-			return fmt.Errorf("could not clone repo %s", r.Name())
+			return nil, fmt.Errorf("could not checkout branch: %w", err)
 		}
 	}
-	return nil
+
+	if opts.Force {
+		overwritten, err = r.changedFiles(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = backend.Checkout(ctx, r, branch, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return overwritten, nil
+}
+
+// checkClean returns a *DirtyError if the work tree isn't clean, as
+// IsClean decides, unless AllowDirty is set
+func (r *Repo) checkClean(ctx context.Context) error {
+	if r.AllowDirty {
+		return nil
+	}
+
+	return r.CheckCleanContext(ctx)
+}
+
+// parseStatusPaths reads the paths from the output of git status
+// --porcelain -z, where each entry is "XY path", and renames and copies
+// are followed by an entry holding the original path
+func parseStatusPaths(output []byte) []string {
+	var paths []string
+
+	entries := splitNul(output)
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if len(e) < 4 {
+			continue
+		}
+
+		paths = append(paths, e[3:])
+
+		if e[0] == 'R' || e[0] == 'C' {
+			i++
+		}
+	}
+
+	return paths
+}
+
+// changedFiles lists the tracked files that differ from HEAD, in the
+// index or the work tree
+func (r *Repo) changedFiles(ctx context.Context) ([]string, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not list changed files", "diff", "--name-only", "-z", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	return splitNul(output), nil
+}
+
+// splitNul splits git's -z output into its entries
+func splitNul(output []byte) []string {
+	var entries []string
+	for _, e := range strings.Split(string(output), "\x00") {
+		if e != "" {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (r *Repo) checkout(ctx context.Context, branch string, opts CheckoutOptions) error {
+	msg := "could not checkout branch"
+	if r.singleBranch && branch != r.branch {
+		msg = "could not checkout branch: repo is a single-branch clone"
+		if r.branch != "" {
+			msg += " of " + r.branch
+		}
+	}
+
+	args := []string{"checkout"}
+	if opts.Force {
+		args = append(args, "--force")
+	}
+
+	_, _, err := r.mutate(ctx, r.deploymentPath, msg, append(args, branch)...)
+	return err
+}
+
+// CheckoutNew creates branch at startPoint, or the current HEAD if
+// startPoint is empty, and checks it out. It fails with ErrBranchExists if
+// the branch is already there
+func (r *Repo) CheckoutNew(branch, startPoint string) error {
+	return r.CheckoutNewContext(context.Background(), branch, startPoint)
+}
+
+// CheckoutNewContext creates branch at startPoint and checks it out,
+// aborting if ctx is done
+func (r *Repo) CheckoutNewContext(ctx context.Context, branch, startPoint string) (err error) {
+	defer r.observe("checkout", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if r.bare {
+		return fmt.Errorf("could not create branch: %w", ErrBareRepo)
+	}
+
+	args := []string{"checkout", "--quiet", "-b", branch}
+	if startPoint != "" {
+		args = append(args, startPoint)
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not create branch "+branch, args...)
+	return err
+}
+
+// CheckoutTag checks out the commit tag points to, detaching HEAD. If the
+// tag isn't found locally, tags are fetched from origin first, and
+// ErrTagNotFound is returned if it still isn't there
+func (r *Repo) CheckoutTag(tag string) error {
+	return r.CheckoutTagContext(context.Background(), tag)
+}
+
+// CheckoutTagContext checks out the commit tag points to, detaching HEAD,
+// aborting if ctx is done
+func (r *Repo) CheckoutTagContext(ctx context.Context, tag string) (err error) {
+	defer r.observe("checkout", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if r.bare {
+		return fmt.Errorf("could not checkout tag: %w", ErrBareRepo)
+	}
+
+	id, err := r.resolveCommit(ctx, "refs/tags/"+tag)
+	if errors.Is(err, ErrCommitNotFound) {
+		_, err = r.FetchTagsContext(ctx, false)
+		if err != nil {
+			return err
+		}
+		id, err = r.resolveCommit(ctx, "refs/tags/"+tag)
+	}
+	if errors.Is(err, ErrCommitNotFound) {
+		return fmt.Errorf("could not checkout tag %s: %w", tag, ErrTagNotFound)
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.detach(ctx, "could not checkout tag "+tag, id)
+}
+
+// CheckoutRef checks out ref. Branches, as refs/heads/<branch>, are
+// checked out with Checkout, tags, as refs/tags/<tag>, with CheckoutTag,
+// and anything else, e.g. refs/remotes/origin/master, detaching HEAD
+func (r *Repo) CheckoutRef(ref string) error {
+	return r.CheckoutRefContext(context.Background(), ref)
+}
+
+// CheckoutRefContext checks out ref, aborting if ctx is done
+func (r *Repo) CheckoutRefContext(ctx context.Context, ref string) (err error) {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return r.CheckoutContext(ctx, strings.TrimPrefix(ref, "refs/heads/"))
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return r.CheckoutTagContext(ctx, strings.TrimPrefix(ref, "refs/tags/"))
+	}
+
+	defer r.observe("checkout", time.Now(), &err)
+
+	if r.bare {
+		return fmt.Errorf("could not checkout ref: %w", ErrBareRepo)
+	}
+
+	id, err := r.resolveCommit(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	return r.detach(ctx, "could not checkout ref "+ref, id)
+}
+
+// HeadState describes what is checked out
+type HeadState struct {
+	// Branch is the checked out branch, or empty if HEAD is detached
+	Branch string
+	// Commit is the id of the checked out commit
+	Commit string
+	// Detached is set when HEAD points directly at a commit, e.g. after
+	// checking out a tag or commit id, rather than at a branch
+	Detached bool
+}
+
+// HeadState returns what is checked out
+func (r *Repo) HeadState() (*HeadState, error) {
+	return r.HeadStateContext(context.Background())
+}
+
+// HeadStateContext returns what is checked out, aborting if ctx is done
+func (r *Repo) HeadStateContext(ctx context.Context) (*HeadState, error) {
+	var state HeadState
+
+	detached, err := r.detached(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !detached {
+		state.Branch, err = backend.Branch(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	state.Commit, err = backend.CommitID(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	state.Detached = detached
+
+	return &state, nil
+}
+
+// detach checks out the commit id, detaching HEAD, as long as the work
+// tree is clean
+func (r *Repo) detach(ctx context.Context, msg, id string) error {
+	err := r.checkClean(ctx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, msg, "checkout", "--quiet", "--detach", id)
+	return err
+}
+
+// detached reports whether HEAD is detached
+func (r *Repo) detached(ctx context.Context) (bool, error) {
+	if _, native := backend.(execBackend); !native {
+		branch, err := backend.Branch(ctx, r)
+		return branch == "", err
+	}
+
+	_, err := r.output(ctx, r.deploymentPath, "could not get git branch", "symbolic-ref", "--quiet", "HEAD")
+
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.ExitCode == 1 {
+		return true, nil
+	}
+
+	return false, err
+}
+
+// CheckoutCommit checks out the commit sha, which may be abbreviated,
+// detaching HEAD. If the commit isn't found locally, origin is fetched
+// first. A sha matching more than one commit fails with ErrAmbiguousRef
+func (r *Repo) CheckoutCommit(sha string) error {
+	return r.CheckoutCommitContext(context.Background(), sha)
+}
+
+// CheckoutCommitContext checks out the commit sha, detaching HEAD,
+// aborting if ctx is done
+func (r *Repo) CheckoutCommitContext(ctx context.Context, sha string) (err error) {
+	defer r.observe("checkout", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if r.bare {
+		return fmt.Errorf("could not checkout commit: %w", ErrBareRepo)
+	}
+
+	if !commitIDPattern.MatchString(sha) {
+		return fmt.Errorf("could not checkout commit: %q is not a commit id", sha)
+	}
+
+	id, err := r.resolveCommit(ctx, sha)
+	if errors.Is(err, ErrCommitNotFound) {
+		id, err = r.fetchCommit(ctx, sha)
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.detach(ctx, "could not checkout commit "+sha, id)
+}
+
+// resolveCommit returns the full id of the commit sha. It fails with
+// ErrCommitNotFound if there is no such commit
+func (r *Repo) resolveCommit(ctx context.Context, sha string) (string, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not find commit "+sha, "rev-parse", "--verify", sha+"^{commit}")
+
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.Err == nil && gerr.ExitCode == 128 {
+		gerr.Err = ErrCommitNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// fetchCommit fetches origin, then the commit itself if it is still
+// missing, as servers only send commits that branches or tags point to
+// unless asked for them by full id
+func (r *Repo) fetchCommit(ctx context.Context, sha string) (string, error) {
+	err := r.FetchContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := r.resolveCommit(ctx, sha)
+	if !errors.Is(err, ErrCommitNotFound) || (len(sha) != 40 && len(sha) != 64) {
+		return id, err
+	}
+
+	if r.FetchRemoteContext(ctx, "origin", sha) != nil {
+		return "", err
+	}
+
+	return r.resolveCommit(ctx, sha)
+}
+
+// Branch returns the currently checked out branch, or an empty string if
+// HEAD is detached
+func (r *Repo) Branch() (string, error) {
+	return r.BranchContext(context.Background())
+}
+
+// BranchContext returns the currently checked out branch, aborting if ctx
+// is done. It returns an empty string if HEAD is detached
+func (r *Repo) BranchContext(ctx context.Context) (string, error) {
+	ctx, unlock, err := r.lock(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	return backend.Branch(ctx, r)
+}
+
+func (r *Repo) currentBranch(ctx context.Context) (string, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not get git branch", "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	// git names the branch HEAD when there isn't one
+	branch := strings.TrimSpace(string(output))
+	if branch == "HEAD" {
+		return "", nil
+	}
+
+	return branch, nil
+}
+
+// Pull from remote
+func (r *Repo) Pull() error {
+	return r.PullContext(context.Background())
+}
+
+// PullContext pulls from remote, aborting if ctx is done
+func (r *Repo) PullContext(ctx context.Context) error {
+	return r.PullWithOptionsContext(ctx, PullOptions{})
+}
+
+// PullOptions configures PullWithOptions. Whichever way the branch is
+// pulled, conflicts are aborted, restoring the branch to how it was, and
+// reported with a *ConflictError
+type PullOptions struct {
+	// Rebase replays local commits on top of the remote's, rather than
+	// merging. If they conflict, the rebase is aborted and the error is a
+	// *ConflictError matching ErrRebaseConflict
+	Rebase bool
+	// FFOnly only lets the branch be fast-forwarded, leaving it untouched
+	// if it has commits the remote's lacks. The error is then a
+	// *DivergedError matching ErrDiverged
+	FFOnly bool
+}
+
+// PullWithOptions pulls from remote as configured by opts
+func (r *Repo) PullWithOptions(opts PullOptions) error {
+	return r.PullWithOptionsContext(context.Background(), opts)
+}
+
+// PullWithOptionsContext pulls from remote as configured by opts,
+// aborting if ctx is done
+func (r *Repo) PullWithOptionsContext(ctx context.Context, opts PullOptions) (err error) {
+	defer r.observe("pull", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = r.checkPull(ctx)
+	if err != nil {
+		return err
+	}
+
+	return backend.Pull(ctx, r, opts)
+}
+
+// checkPull returns an error if the repo has no branch checked out to
+// pull into
+func (r *Repo) checkPull(ctx context.Context) error {
+	if r.bare {
+		return fmt.Errorf("could not pull repo changes: %w", ErrBareRepo)
+	}
+
+	detached, err := r.detached(ctx)
+	if err != nil {
+		return err
+	}
+	if detached {
+		return fmt.Errorf("could not pull repo changes: %w", ErrDetachedHead)
+	}
+
+	return nil
+}
+
+func (r *Repo) pull(ctx context.Context, opts PullOptions) error {
+	return r.runPull(ctx, "could not pull repo changes", "@{u}", opts)
+}
+
+// PullFrom pulls branch from remote into the checked out branch, whether
+// or not it tracks them. remote can be the name of a remote, failing with
+// ErrRemoteNotFound if there is no such remote, or a url. ErrBranchNotFound
+// is returned if the remote has no such branch
+func (r *Repo) PullFrom(remote, branch string) error {
+	return r.PullFromContext(context.Background(), remote, branch)
+}
+
+// PullFromContext pulls branch from remote into the checked out branch,
+// aborting if ctx is done
+func (r *Repo) PullFromContext(ctx context.Context, remote, branch string) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return r.pullFrom(ctx, remote, branch, PullOptions{})
+}
+
+func (r *Repo) pullFrom(ctx context.Context, remote, branch string, opts PullOptions) (err error) {
+	defer r.observe("pull", time.Now(), &err)
+
+	err = r.checkPull(ctx)
+	if err != nil {
+		return err
+	}
+
+	// git reports unknown remote names as missing repos
+	if !strings.ContainsAny(remote, ":/\\") {
+		err = r.checkRemote(ctx, remote)
+		if err != nil {
+			return fmt.Errorf("could not pull repo changes: %w", err)
+		}
+	}
+
+	msg := fmt.Sprintf("could not pull branch %s from remote %s", branch, remote)
+	return r.runPull(ctx, msg, "FETCH_HEAD", opts, remote, branch)
+}
+
+// runPull runs git pull with args, upstream being what was pulled, for
+// counting diverged commits
+func (r *Repo) runPull(ctx context.Context, msg, upstream string, opts PullOptions, args ...string) error {
+	pull := []string{"pull"}
+	if opts.Rebase {
+		pull = append(pull, "--rebase")
+	}
+	if opts.FFOnly {
+		pull = append(pull, "--ff-only")
+	}
+
+	// since git 2.33 a pull that can't fast-forward fails unless told how
+	// to reconcile the branches
+	if !opts.Rebase && !opts.FFOnly {
+		pull = append(pull, "--no-rebase")
+	}
+
+	_, _, err := r.mutate(ctx, r.deploymentPath, msg, append(pull, args...)...)
+
+	if errors.Is(err, ErrDiverged) {
+		return r.divergedError(ctx, upstream, err)
+	}
+
+	// git exits with 1 when it stops for conflicts, leaving them in the
+	// work tree
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.ExitCode == 1 {
+		op := "merge"
+		if opts.Rebase {
+			op = "rebase"
+		}
+		return r.abortConflict(ctx, op, err)
+	}
+
+	return err
+}
+
+// divergedError counts the commits by which the checked out branch and
+// upstream have diverged, returning them as a *DivergedError, or err
+// if they can't be counted
+func (r *Repo) divergedError(ctx context.Context, upstream string, err error) error {
+	ahead, behind, cerr := r.leftRight(ctx, "HEAD", upstream)
+	if cerr != nil {
+		return err
+	}
+
+	return fmt.Errorf("could not pull repo changes: %w", &DivergedError{Ahead: ahead, Behind: behind})
+}
+
+// leftRight counts the commits only reachable from from, and only
+// reachable from to
+func (r *Repo) leftRight(ctx context.Context, from, to string) (int, int, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not count diverged commits", "rev-list", "--left-right", "--count", from+"..."+to, "--")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var ahead, behind int
+	_, err = fmt.Sscan(string(output), &ahead, &behind)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not count diverged commits: %w", err)
+	}
+
+	return ahead, behind, nil
+}
+
+// abortConflict aborts op, "merge" or "rebase", if it stopped because of
+// conflicts, returning a *ConflictError listing them. Otherwise err, what
+// op failed with, is returned
+func (r *Repo) abortConflict(ctx context.Context, op string, err error) error {
+	output, cerr := r.output(ctx, r.deploymentPath, "could not list conflicts", "diff", "--name-only", "--diff-filter=U", "-z")
+	if cerr != nil {
+		return err
+	}
+
+	paths := splitNul(output)
+	if len(paths) == 0 {
+		return err
+	}
+
+	_, _, aerr := r.mutate(ctx, r.deploymentPath, "could not abort "+op, op, "--abort")
+	if aerr != nil {
+		return aerr
+	}
+
+	return fmt.Errorf("could not pull repo changes: %w", &ConflictError{Op: op, Paths: paths})
+}
+
+// CommitID returns the commit id for the currently checked out branch
+func (r *Repo) CommitID() (string, error) {
+	return r.CommitIDContext(context.Background())
+}
+
+// CommitIDContext returns the commit id for the currently checked out
+// branch, aborting if ctx is done
+func (r *Repo) CommitIDContext(ctx context.Context) (string, error) {
+	ctx, unlock, err := r.lock(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	return backend.CommitID(ctx, r)
+}
+
+func (r *Repo) commitID(ctx context.Context) (string, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not get git revision id", "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	id := string(output)
+	return strings.TrimSpace(id), nil
+}
+
+// DescribeOptions change how Describe names a commit
+type DescribeOptions struct {
+	// Ref is the commit to describe, HEAD if empty
+	Ref string
+	// Tags lets lightweight tags describe the commit, not just annotated
+	// ones
+	Tags bool
+	// Dirty appends "-dirty" if the work tree has modifications. It can't
+	// be combined with Ref
+	Dirty bool
+	// Always falls back to the abbreviated commit id if no tag describes
+	// the commit
+	Always bool
+	// Match only considers tags matching the glob pattern, e.g. "v*"
+	Match string
+}
+
+// Describe names a commit after the nearest tag it is reachable from, as
+// git describe does, e.g. "v1.4.2-8-gdeadbee-dirty". Unless opts.Always is
+// set, ErrNoTags is returned if no tag describes it
+func (r *Repo) Describe(opts DescribeOptions) (string, error) {
+	return r.DescribeContext(context.Background(), opts)
+}
+
+// DescribeContext names a commit after the nearest tag it is reachable
+// from, aborting if ctx is done
+func (r *Repo) DescribeContext(ctx context.Context, opts DescribeOptions) (string, error) {
+	// only the work tree can be dirty, not an arbitrary commit
+	if opts.Dirty && opts.Ref != "" {
+		return "", fmt.Errorf("could not describe commit %s: Dirty can't be combined with Ref", opts.Ref)
+	}
+
+	args := []string{"describe"}
+
+	if opts.Tags {
+		args = append(args, "--tags")
+	}
+	if opts.Dirty {
+		args = append(args, "--dirty")
+	}
+	if opts.Always {
+		args = append(args, "--always")
+	}
+	if opts.Match != "" {
+		args = append(args, "--match="+opts.Match)
+	}
+	if opts.Ref != "" {
+		args = append(args, opts.Ref)
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not describe commit", args...)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// Diverged : Check if two branches have diverged, i.e. each has commits the
+// other doesn't. A branch that is only ahead or behind the other, which
+// could be fast-forwarded, has not diverged. Refs that don't exist are an
+// error matching ErrRefNotFound
+func (r *Repo) Diverged(from, to string) (bool, error) {
+	return r.DivergedContext(context.Background(), from, to)
+}
+
+// DivergedContext checks if two branches have diverged, aborting if ctx is
+// done
+func (r *Repo) DivergedContext(ctx context.Context, from, to string) (diverged bool, err error) {
+	// the lock isn't held throughout, as deepening the history changes
+	// the repo
+	err = r.withHistory(ctx, func() error {
+		ctx, unlock, err := r.lock(ctx, false)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		diverged, err = backend.Diverged(ctx, r, from, to)
+		return err
+	})
+	return diverged, err
+}
+
+func (r *Repo) diverged(ctx context.Context, from, to string) (bool, error) {
+	for _, ref := range []string{from, to} {
+		_, err := r.CommitIDForContext(ctx, ref)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	ahead, behind, err := r.leftRight(ctx, from, to)
+	if err != nil {
+		return false, err
+	}
+
+	return ahead > 0 && behind > 0, nil
+}
+
+// AheadBehind counts the commits on the local branch that origin's branch
+// of the same name doesn't have, and those it is missing, as of the last
+// fetch. The branch doesn't need to be checked out. It fails with
+// ErrBranchNotFound if there is no such local branch, and ErrNoUpstream
+// if origin's branch hasn't been fetched
+func (r *Repo) AheadBehind(branch string) (ahead, behind int, err error) {
+	return r.AheadBehindContext(context.Background(), branch)
+}
+
+// AheadBehindContext counts the commits the local branch is ahead and
+// behind origin's, aborting if ctx is done
+func (r *Repo) AheadBehindContext(ctx context.Context, branch string) (ahead, behind int, err error) {
+	refs := []struct {
+		ref string
+		err error
+	}{
+		{"refs/heads/" + branch, ErrBranchNotFound},
+		{"refs/remotes/origin/" + branch, ErrNoUpstream},
+	}
+
+	for _, ref := range refs {
+		_, err := r.output(ctx, r.deploymentPath, "could not look up "+ref.ref, "show-ref", "--verify", "--quiet", ref.ref)
+		found, err := exitStatus(err, 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !found {
+			return 0, 0, fmt.Errorf("%s: %w", branch, ref.err)
+		}
+	}
+
+	return r.leftRight(ctx, refs[0].ref, refs[1].ref)
+}
+
+// Commits returns the abbreviated ids of the commits on the checked out
+// branch, newest first, or an empty slice if it has no commits yet. Log
+// returns them as Commit values
+func (r *Repo) Commits() ([]string, error) {
+	return r.CommitsContext(context.Background())
+}
+
+// CommitsContext returns the commit ids of the checked out branch,
+// aborting if ctx is done
+func (r *Repo) CommitsContext(ctx context.Context) ([]string, error) {
+	ctx, unlock, err := r.lock(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return backend.Commits(ctx, r)
+}
+
+func (r *Repo) commits(ctx context.Context) ([]string, error) {
+	ids := []string{}
+
+	// git log fails on a branch with no commits
+	_, err := r.output(ctx, r.deploymentPath, "could not get git revision id's", "rev-parse", "--verify", "--quiet", "HEAD")
+	hasCommits, err := exitStatus(err, 1)
+	if err != nil || !hasCommits {
+		return ids, err
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not get git revision id's", "log", "--pretty=format:%h")
+	if err != nil {
+		return ids, err
+	}
+
+	for _, id := range strings.Split(string(output), "\n") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// FileAt returns the contents of the file at path, relative to the root
+// of the repo, as of ref. Partial clones fetch the file from the remote if
+// it is missing locally
+func (r *Repo) FileAt(ref, path string) ([]byte, error) {
+	return r.FileAtContext(context.Background(), ref, path)
+}
+
+// FileAtContext returns the contents of the file at path as of ref,
+// aborting if ctx is done
+func (r *Repo) FileAtContext(ctx context.Context, ref, path string) ([]byte, error) {
+	return r.output(ctx, r.deploymentPath, "could not read file "+path, "show", ref+":"+filepath.ToSlash(path))
+}
+
+// Sync : ...
+func (r *Repo) Sync(branch string) error {
+	return r.SyncContext(context.Background(), branch)
+}
+
+// SyncContext fetches, checks out and pulls the given branch, or origin's
+// default branch if branch is empty, aborting if ctx is done
+func (r *Repo) SyncContext(ctx context.Context, branch string) error {
+	_, err := r.SyncWithOptionsContext(ctx, branch, SyncOptions{})
+	return err
+}
+
+// SyncOptions configures SyncWithOptions
+type SyncOptions struct {
+	// PullOptions configure how the branch is pulled
+	PullOptions
+
+	// Force discards local changes to tracked files, restoring the work
+	// tree to the branch, rather than failing because of them
+	Force bool
+	// Clean, if set along with Force, also removes untracked files as it
+	// configures, once the branch is checked out
+	Clean *CleanOptions
+	// Reset resets the branch to origin's instead of pulling, discarding
+	// local commits and aborting a merge or rebase in progress, so the
+	// work tree ends up matching origin whatever state it was in. It
+	// implies Force
+	Reset bool
+	// Plan, if set, is a plan SyncPlan made for the branch. The sync uses
+	// what SyncPlan fetched rather than fetching again
+	Plan *SyncPlan
+	// FollowRename syncs origin's default branch instead of a branch
+	// origin no longer has, taking it to have been renamed, e.g. from
+	// master to main. Otherwise a *BranchGoneError naming the default
+	// branch is returned
+	FollowRename bool
+	// Stash stashes local changes to tracked files before syncing and
+	// applies them again afterwards. If they no longer apply cleanly the
+	// error matches ErrStashConflict, and the changes are kept in the stash
+	Stash bool
+	// Policy, if set, must trust every commit the sync would bring in,
+	// from HEAD to origin's branch. They are checked after fetching and
+	// before anything is checked out, so if one isn't the work tree is
+	// left as it was and a *PolicyError naming the oldest is returned
+	Policy *SignaturePolicy
+}
+
+// SyncResult describes what SyncWithOptions did
+type SyncResult struct {
+	// Branch is the branch synced, origin's default branch if FollowRename
+	// followed a rename
+	Branch string
+	// Overwritten lists the files whose local changes were discarded by a
+	// forced sync
+	Overwritten []string
+	// Removed lists the untracked files removed by a forced sync with
+	// Clean set
+	Removed []string
+	// Discarded lists the ids of the local commits, newest first, that a
+	// sync with Reset set threw away
+	Discarded []string
+	// Previous is the commit HEAD was at before the sync, empty if there
+	// was none, and Current the one it is at after
+	Previous string
+	Current  string
+	// Changed reports whether HEAD moved. It is false if the branch was
+	// already checked out and up to date
+	Changed bool
+	// Commits counts the commits the sync brought in, those reachable from
+	// Current but not from Previous
+	Commits int
+	// Files lists the files that differ between Previous and Current
+	Files []string
+}
+
+// SyncWithOptions fetches, checks out and pulls the given branch, as
+// configured by opts. The result says what changed
+func (r *Repo) SyncWithOptions(branch string, opts SyncOptions) (*SyncResult, error) {
+	return r.SyncWithOptionsContext(context.Background(), branch, opts)
+}
+
+// SyncWithOptionsContext fetches, checks out and pulls the given branch,
+// as configured by opts, aborting if ctx is done
+func (r *Repo) SyncWithOptionsContext(ctx context.Context, branch string, opts SyncOptions) (result *SyncResult, err error) {
+	defer r.observe("sync", time.Now(), &err)
+
+	return r.withHooks(func() (*SyncResult, error) {
+		ctx, unlock, err := r.lock(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		return r.sync(ctx, branch, opts)
+	})
+}
+
+// sync does the work of SyncWithOptionsContext, between the repo's hooks
+func (r *Repo) sync(ctx context.Context, branch string, opts SyncOptions) (result *SyncResult, err error) {
+	result = &SyncResult{}
+
+	if opts.Reset {
+		opts.Force = true
+	}
+
+	if branch == "" {
+		branch, err = r.DefaultBranchContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Previous, err = r.CommitIDForContext(ctx, "HEAD")
+	if errors.Is(err, ErrRefNotFound) {
+		result.Previous, err = "", nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Stash && !opts.Force {
+		var stash string
+		stash, err = r.StashContext(ctx, "verify: sync "+branch)
+		if err != nil {
+			return nil, err
+		}
+
+		if stash != "" {
+			defer func() {
+				perr := r.StashPopContext(ctx)
+				if err == nil && perr != nil {
+					result, err = nil, perr
+				}
+			}()
+		}
+	}
+
+	// a sync that fails part way through puts the repo back where it was,
+	// rather than leave it on some other branch or commit
+	_, native := backend.(execBackend)
+	if native && !r.DryRun && !r.bare && result.Previous != "" {
+		var before syncState
+		before.commit = result.Previous
+		before.branch, err = r.currentBranch(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// without Force or AllowDirty the work tree is checked to be clean
+		// before anything changes, so nothing is lost by resetting it
+		hard := opts.Force || !r.AllowDirty
+
+		// registered after the stash is, so it runs before the stash is
+		// popped
+		defer func() {
+			if err != nil {
+				err = r.rollback(ctx, before, hard, err)
+			}
+		}()
+	}
+
+	// check before fetching, so nothing is done to a dirty repo
+	if !opts.Force && !r.bare {
+		err = r.checkClean(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not sync repo %s: %w", r.Name(), err)
+		}
+	}
+
+	// Fetch correct branch and update, unless a plan already did
+	if opts.Plan == nil || opts.Plan.Branch != branch {
+		err = r.syncFetch(ctx, branch)
+
+		var gone *BranchGoneError
+		if errors.As(err, &gone) && opts.FollowRename && gone.Default != "" && gone.Default != branch {
+			branch = gone.Default
+			err = r.syncFetch(ctx, branch)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Branch = branch
+
+	if opts.Policy != nil {
+		// a branch that doesn't exist locally yet, as in a repo with no
+		// HEAD, brings in every commit of origin's
+		rng := "refs/remotes/origin/" + branch
+		local := "refs/heads/" + branch
+		_, err = r.output(ctx, r.deploymentPath, "could not look up branch "+branch, "show-ref", "--verify", "--quiet", local)
+		var found bool
+		found, err = exitStatus(err, 1)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			rng = local + ".." + rng
+		}
+
+		err = r.checkPolicy(ctx, opts.Policy, rng)
+		if err != nil {
+			return nil, fmt.Errorf("could not sync repo %s: %w", r.Name(), err)
+		}
+	}
+
+	if opts.Reset && !r.bare {
+		err = r.abortInProgress(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Overwritten, err = r.checkoutBranch(ctx, branch, CheckoutOptions{Force: opts.Force}, false)
+	if err != nil {
+		// git's own error doesn't always say that the branch is missing
+		local, remote, berr := r.BranchExistsContext(ctx, branch)
+		if berr == nil && !local && !remote {
+			return nil, fmt.Errorf("could not sync repo %s: branch %s: %w", r.Name(), branch, ErrBranchNotFound)
+		}
+
+		return nil, fmt.Errorf("could not checkout repo branch %s:%s: %w", r.Name(), branch, err)
+	}
+
+	if opts.Force && opts.Clean != nil {
+		result.Removed, err = r.CleanContext(ctx, *opts.Clean)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// checking out a tag or commit, rather than a branch, leaves nothing
+	// to pull; SyncTag and CheckoutCommit are meant for those
+	detached, err := r.detached(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if detached {
+		return nil, fmt.Errorf("could not sync repo %s: %s is not a branch: %w", r.Name(), branch, ErrDetachedHead)
+	}
+
+	// branches that don't track one on origin, e.g. because they were
+	// created locally, are pulled from origin's branch of the same name
+	_, _, err = r.UpstreamContext(ctx)
+	switch {
+	case opts.Reset:
+		result.Discarded, err = r.resetBranch(ctx, branch)
+	case errors.Is(err, ErrNoUpstream):
+		err = r.pullFrom(ctx, "origin", branch, opts.PullOptions)
+	case err != nil:
+		return nil, fmt.Errorf("could not sync repo %s: branch %s: %w", r.Name(), branch, err)
+	default:
+		err = r.PullWithOptionsContext(ctx, opts.PullOptions)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.submodules {
+		err = r.UpdateSubmodulesContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = r.syncChanges(ctx, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// withHooks runs sync between the repo's BeforeSync and AfterSync hooks,
+// calling OnError if anything fails. The hooks only run while no git
+// command is under way, so one that panics can't leave a sync part done
+func (r *Repo) withHooks(sync func() (*SyncResult, error)) (result *SyncResult, err error) {
+	if r.BeforeSync != nil {
+		err = callHook("BeforeSync", func() error { return r.BeforeSync(r) })
+	}
+
+	if err == nil {
+		result, err = sync()
+	}
+
+	if err == nil && r.AfterSync != nil {
+		err = callHook("AfterSync", func() error { return r.AfterSync(r, *result) })
+	}
+
+	if err != nil && r.OnError != nil {
+		// an OnError that panics has nothing left to fail
+		_ = callHook("OnError", func() error {
+			r.OnError(r, err)
+			return nil
+		})
+	}
+
+	return result, err
+}
+
+// callHook calls the hook named name, returning a *HookError if it fails
+// or panics
+func callHook(name string, hook func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &HookError{Hook: name, Err: fmt.Errorf("panic: %v", p)}
+		}
+	}()
+
+	err = hook()
+	if err != nil {
+		return &HookError{Hook: name, Err: err}
+	}
+
+	return nil
+}
+
+// syncState is the branch, empty if HEAD is detached, and commit HEAD is
+// at before a sync
+type syncState struct {
+	branch string
+	commit string
+}
+
+// rollback puts HEAD back on the branch and commit it was at before a
+// sync that failed with cause, returning a *RollbackError, or cause if
+// there was nothing to undo. hard discards any changes in the work tree,
+// otherwise they are carried over where they can be
+func (r *Repo) rollback(ctx context.Context, before syncState, hard bool, cause error) error {
+	// the sync may have failed because its context was done, which
+	// mustn't stop the repo being restored
+	ctx = uncancelled{ctx}
+
+	branch, berr := r.currentBranch(ctx)
+	commit, cerr := r.CommitIDForContext(ctx, "HEAD")
+	if berr == nil && cerr == nil && branch == before.branch && commit == before.commit && r.inProgress() == "" {
+		return cause
+	}
+
+	return &RollbackError{
+		Err:      cause,
+		Rollback: r.restore(ctx, before, hard),
+		Branch:   before.branch,
+		Commit:   before.commit,
+	}
+}
+
+// restore checks out the branch and commit of state
+func (r *Repo) restore(ctx context.Context, state syncState, hard bool) error {
+	err := r.abortInProgress(ctx)
+	if err != nil {
+		return err
+	}
+
+	checkout := []string{"checkout", "--quiet"}
+	reset := []string{"reset", "--quiet", "--keep"}
+	if hard {
+		checkout = append(checkout, "--force")
+		reset = []string{"reset", "--quiet", "--hard"}
+	}
+
+	if state.branch == "" {
+		_, _, err = r.mutate(ctx, r.deploymentPath, "could not restore HEAD", append(checkout, "--detach", state.commit)...)
+		return err
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not restore branch "+state.branch, append(checkout, state.branch)...)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not restore branch "+state.branch, append(reset, state.commit)...)
+	return err
+}
+
+// emptyTree is the id of the tree with nothing in it, which every repo
+// can diff against
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// syncChanges fills in what moving HEAD from result.Previous changed
+func (r *Repo) syncChanges(ctx context.Context, result *SyncResult) error {
+	var err error
+
+	result.Current, err = r.CommitIDForContext(ctx, "HEAD")
+	if err != nil {
+		return err
+	}
+
+	result.Files = []string{}
+	result.Changed = result.Current != result.Previous
+	if !result.Changed {
+		return nil
+	}
+
+	from, rng := emptyTree, result.Current
+	if result.Previous != "" {
+		from, rng = result.Previous, result.Previous+".."+result.Current
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not count synced commits", "rev-list", "--count", rng, "--")
+	if err != nil {
+		return err
+	}
+
+	result.Commits, err = strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return fmt.Errorf("could not count synced commits: %w", err)
+	}
+
+	output, err = r.output(ctx, r.deploymentPath, "could not list synced files", "diff", "--name-only", "--no-renames", "-z", from, result.Current, "--")
+	if err != nil {
+		return err
+	}
+
+	result.Files = append(result.Files, splitNul(output)...)
+
+	return nil
+}
+
+// SyncForce fetches branch from origin and resets the local branch to it,
+// discarding local commits and changes to tracked files, so the work tree
+// matches origin however it got out of step. The result lists what was
+// discarded. It is SyncWithOptions with Reset set; set Clean there to
+// remove untracked files too
+func (r *Repo) SyncForce(branch string) (*SyncResult, error) {
+	return r.SyncForceContext(context.Background(), branch)
+}
+
+// SyncForceContext fetches branch from origin and resets the local branch
+// to it, aborting if ctx is done
+func (r *Repo) SyncForceContext(ctx context.Context, branch string) (*SyncResult, error) {
+	return r.SyncWithOptionsContext(ctx, branch, SyncOptions{Reset: true})
+}
+
+// SyncPlan describes what syncing a branch would do, as worked out by
+// Repo.SyncPlan
+type SyncPlan struct {
+	Branch string
+	// Commit is the commit HEAD is at, and RemoteCommit the one origin's
+	// branch is at
+	Commit       string
+	RemoteCommit string
+	// Ahead and Behind count the commits the local branch has that
+	// origin's doesn't, and those it is missing. A branch that hasn't been
+	// checked out yet is compared as if it were at HEAD
+	Ahead  int
+	Behind int
+	// Commits are the commits the sync would bring in, newest first
+	Commits []Commit
+	// Dirty, if set, holds the local changes that would stop the sync
+	// unless it is forced
+	Dirty *DirtyError
+}
+
+// UpToDate reports whether syncing would bring in no commits
+func (p *SyncPlan) UpToDate() bool {
+	return len(p.Commits) == 0
+}
+
+// SyncPlan fetches branch from origin, as Sync does, and works out what
+// syncing it would do, without touching the work tree. An empty branch
+// plans for origin's default branch. Pass the plan to SyncWithOptions to
+// sync without fetching again
+func (r *Repo) SyncPlan(branch string) (*SyncPlan, error) {
+	return r.SyncPlanContext(context.Background(), branch)
+}
+
+// SyncPlanContext fetches branch and works out what syncing it would do,
+// aborting if ctx is done
+func (r *Repo) SyncPlanContext(ctx context.Context, branch string) (*SyncPlan, error) {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if branch == "" {
+		branch, err = r.DefaultBranchContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = r.syncFetch(ctx, branch)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &SyncPlan{Branch: branch}
+
+	plan.Commit, err = r.CommitIDForContext(ctx, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := "refs/remotes/origin/" + branch
+	plan.RemoteCommit, err = r.CommitIDForContext(ctx, upstream)
+	if errors.Is(err, ErrRefNotFound) {
+		return nil, fmt.Errorf("could not plan sync of repo %s: branch %s: %w", r.Name(), branch, ErrBranchNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	local := "refs/heads/" + branch
+	_, err = r.output(ctx, r.deploymentPath, "could not look up branch "+branch, "show-ref", "--verify", "--quiet", local)
+	found, err := exitStatus(err, 1)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		local = "HEAD"
+	}
+
+	plan.Ahead, plan.Behind, err = r.leftRight(ctx, local, upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.Commits, err = r.LogWithContext(ctx, LogOptions{Ref: local + ".." + upstream})
+	if err != nil {
+		return nil, err
+	}
+
+	if !r.bare {
+		err = r.checkClean(ctx)
+		var derr *DirtyError
+		if errors.As(err, &derr) {
+			plan.Dirty, err = derr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// resetBranch resets the checked out branch to origin's branch, returning
+// the ids of the local commits that were discarded
+func (r *Repo) resetBranch(ctx context.Context, branch string) ([]string, error) {
+	upstream := "refs/remotes/origin/" + branch
+
+	output, err := r.output(ctx, r.deploymentPath, "could not list local commits", "rev-list", upstream+"..HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+
+	discarded := strings.Fields(string(output))
+	if discarded == nil {
+		discarded = []string{}
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not reset branch "+branch+" to origin", "reset", "--quiet", "--hard", upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	return discarded, nil
+}
+
+// SyncTag fetches from origin, including tags, and checks out tag. Unlike
+// Sync there is nothing to pull, as HEAD is detached at the tag. The sync
+// hooks run around it as they do around Sync
+func (r *Repo) SyncTag(tag string) error {
+	return r.SyncTagContext(context.Background(), tag)
+}
+
+// SyncTagContext fetches from origin and checks out tag, aborting if ctx
+// is done
+func (r *Repo) SyncTagContext(ctx context.Context, tag string) (err error) {
+	defer r.observe("sync", time.Now(), &err)
+
+	_, err = r.withHooks(func() (*SyncResult, error) {
+		ctx, unlock, err := r.lock(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		return r.syncTag(ctx, tag)
+	})
+
+	return err
+}
+
+// syncTag does the work of SyncTagContext, between the repo's hooks
+func (r *Repo) syncTag(ctx context.Context, tag string) (result *SyncResult, err error) {
+	result = &SyncResult{}
+	result.Previous, err = r.CommitIDForContext(ctx, "HEAD")
+	if errors.Is(err, ErrRefNotFound) {
+		result.Previous, err = "", nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.FetchContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// tags can be moved, and the tag should match the one on origin
+	_, err = r.FetchTagsContext(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.CheckoutTagContext(ctx, tag)
+	if err != nil {
+		return nil, fmt.Errorf("could not checkout repo tag %s:%s: %w", r.Name(), tag, err)
+	}
+
+	if r.submodules {
+		err = r.UpdateSubmodulesContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = r.syncChanges(ctx, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// SyncTo fetches from origin and checks out the commit sha, which may be
+// abbreviated, detaching HEAD, for deployments pinned to a commit rather
+// than a branch. A shallow clone is deepened if the commit is older than
+// its history. ErrCommitNotFound is returned if the commit is on nothing
+// fetched from origin, e.g. because it hasn't been pushed; a branch tip is
+// never checked out instead. The result says what changed
+func (r *Repo) SyncTo(sha string) (*SyncResult, error) {
+	return r.SyncToContext(context.Background(), sha)
+}
+
+// SyncToContext fetches from origin and checks out the commit sha,
+// aborting if ctx is done
+func (r *Repo) SyncToContext(ctx context.Context, sha string) (result *SyncResult, err error) {
+	defer r.observe("sync", time.Now(), &err)
+
+	return r.withHooks(func() (*SyncResult, error) {
+		ctx, unlock, err := r.lock(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		return r.syncTo(ctx, sha)
+	})
+}
+
+// syncTo does the work of SyncToContext, between the repo's hooks
+func (r *Repo) syncTo(ctx context.Context, sha string) (result *SyncResult, err error) {
+	msg := fmt.Sprintf("could not sync repo %s to %s", r.Name(), sha)
+
+	if r.bare {
+		return nil, fmt.Errorf("%s: %w", msg, ErrBareRepo)
+	}
+
+	if !commitIDPattern.MatchString(sha) {
+		return nil, fmt.Errorf("%s: %q is not a commit id", msg, sha)
+	}
+
+	result = &SyncResult{}
+	result.Previous, err = r.CommitIDForContext(ctx, "HEAD")
+	if errors.Is(err, ErrRefNotFound) {
+		result.Previous, err = "", nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// check before fetching, so nothing is done to a dirty repo
+	err = r.checkClean(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", msg, err)
+	}
+
+	id, err := r.fetchCommit(ctx, sha)
+
+	// the commit may be older than a shallow clone's history
+	if errors.Is(err, ErrCommitNotFound) {
+		shallow, serr := r.IsShallow()
+		if serr == nil && shallow {
+			err = r.UnshallowContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			id, err = r.resolveCommit(ctx, sha)
+		}
+	}
+
+	if errors.Is(err, ErrCommitNotFound) {
+		return nil, fmt.Errorf("%s: not found on origin: %w", msg, ErrCommitNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a branch or tag whose name looks like a commit id takes precedence
+	// over the commit
+	if !strings.HasPrefix(id, strings.ToLower(sha)) {
+		return nil, fmt.Errorf("%s: %s names a ref, not a commit: %w", msg, sha, ErrCommitNotFound)
+	}
+
+	err = r.detach(ctx, msg, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.submodules {
+		err = r.UpdateSubmodulesContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = r.syncChanges(ctx, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Current != id && !r.DryRun {
+		return nil, fmt.Errorf("%s: HEAD is at %s after checking it out", msg, result.Current)
+	}
+
+	return result, nil
+}
+
+// Stash saves local changes to tracked files, both staged and unstaged,
+// and reverts them. It returns the id of the stash commit, or an empty
+// string if there were no changes to save
+func (r *Repo) Stash(message string) (string, error) {
+	return r.StashContext(context.Background(), message)
+}
+
+// StashContext saves and reverts local changes, aborting if ctx is done
+func (r *Repo) StashContext(ctx context.Context, message string) (string, error) {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if r.bare {
+		return "", fmt.Errorf("could not stash changes: %w", ErrBareRepo)
+	}
+
+	before, err := r.stashID(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not stash changes", "stash", "push", "--quiet", "-m", message)
+	if err != nil {
+		return "", err
+	}
+
+	// git stashes nothing, successfully, if there are no changes
+	after, err := r.stashID(ctx)
+	if err != nil || after == before {
+		return "", err
+	}
+
+	return after, nil
+}
+
+// stashID returns the id of the latest stash, or an empty string if there
+// isn't one
+func (r *Repo) stashID(ctx context.Context) (string, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not read stash", "rev-parse", "--verify", "--quiet", "refs/stash")
+
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.ExitCode == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// StashPop applies the latest stash and drops it. If the changes conflict
+// with the work tree, the error matches ErrStashConflict, and the stash is
+// kept
+func (r *Repo) StashPop() error {
+	return r.StashPopContext(context.Background())
+}
+
+// StashPopContext applies the latest stash and drops it, aborting if ctx
+// is done
+func (r *Repo) StashPopContext(ctx context.Context) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if r.bare {
+		return fmt.Errorf("could not restore stashed changes: %w", ErrBareRepo)
+	}
+
+	id, err := r.stashID(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not restore stashed changes", "stash", "pop", "--quiet")
+
+	var gerr *GitError
+	if errors.As(err, &gerr) && gerr.ExitCode == 1 && id != "" {
+		return fmt.Errorf("could not restore stashed changes, kept in stash %s: %w", id, ErrStashConflict)
+	}
+
+	return err
+}
+
+// syncFetch fetches only branch from origin where it can, falling back
+// to fetching everything, e.g. for branches that only exist locally, and
+// fetches tags too if SyncTags is set
+func (r *Repo) syncFetch(ctx context.Context, branch string) error {
+	err := r.fetchBranch(ctx, branch)
+	if err != nil || !r.SyncTags {
+		return err
+	}
+
+	_, err = r.FetchTagsContext(ctx, true)
+	return err
+}
+
+// fetchBranch fetches branch from origin, or everything if it has to
+func (r *Repo) fetchBranch(ctx context.Context, branch string) error {
+	// bare repos can't be synced, and the pure go backend has no
+	// FetchRemote, so leave them to fail as they always have
+	_, native := backend.(execBackend)
+	if r.bare || !native {
+		return r.FetchContext(ctx)
+	}
+
+	// pruning only applies to the refspecs being fetched, so everything
+	// has to be fetched for stale branches to be removed
+	if r.Prune || r.PruneTags {
+		return r.FetchContext(ctx)
+	}
+
+	err := r.FetchRemoteContext(ctx, "origin", branch)
+	if !errors.Is(err, ErrBranchNotFound) {
+		return err
+	}
+
+	err = r.FetchContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	return r.checkGone(ctx, branch)
+}
+
+// checkGone returns a *BranchGoneError if branch, which origin doesn't
+// have, was origin's, rather than one that only exists locally. Its
+// remote-tracking branch is deleted, so it can't pass for origin's
+func (r *Repo) checkGone(ctx context.Context, branch string) error {
+	_, err := r.output(ctx, r.deploymentPath, "could not look up branch "+branch, "show-ref", "--verify", "--quiet", "refs/heads/"+branch)
+	local, err := exitStatus(err, 1)
+	if err != nil {
+		return err
+	}
+
+	// local branches that don't track origin are pulled from origin's
+	// branch of the same name once it appears
+	if local {
+		output, err := r.output(ctx, r.deploymentPath, "could not read upstream of branch "+branch, "config", "branch."+branch+".remote")
+		tracked, err := exitStatus(err, 1)
+		if err != nil {
+			return err
+		}
+		if !tracked || strings.TrimSpace(string(output)) != "origin" {
+			return nil
+		}
+	}
+
+	tracking := "refs/remotes/origin/" + branch
+	_, err = r.output(ctx, r.deploymentPath, "could not look up branch "+branch, "show-ref", "--verify", "--quiet", tracking)
+	stale, err := exitStatus(err, 1)
+	if err != nil {
+		return err
+	}
+	if stale {
+		_, _, err = r.mutate(ctx, r.deploymentPath, "could not delete remote-tracking branch origin/"+branch, "update-ref", "-d", tracking)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a default branch that can't be read only makes the error less useful
+	r.forgetDefaultBranch()
+	def, _ := r.DefaultBranchContext(ctx)
+
+	return &BranchGoneError{Branch: branch, Default: def}
+}
+
+// UpdateSubmodules initializes and updates all submodules, recursively
+func (r *Repo) UpdateSubmodules() error {
+	return r.UpdateSubmodulesContext(context.Background())
+}
+
+// UpdateSubmodulesContext initializes and updates all submodules,
+// recursively, aborting if ctx is done. The returned error names the
+// submodule that could not be updated
+func (r *Repo) UpdateSubmodulesContext(ctx context.Context) (err error) {
+	defer r.observe("update-submodules", time.Now(), &err)
+
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if r.bare {
+		return fmt.Errorf("could not update submodules: %w", ErrBareRepo)
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not update submodules", "submodule", "update", "--init", "--recursive")
+
+	var gerr *GitError
+	if errors.As(err, &gerr) {
+		if m := submodulePath.FindStringSubmatch(gerr.Stderr); m != nil {
+			gerr.Message = "could not update submodule " + m[1]
+		}
+	}
+
+	return err
+}
+
+// Clone the repositort into the destination
+func (r *Repo) clone(ctx context.Context) error {
+	r.Destination = filepath.Clean(r.Destination)
+	r.deploymentPath = filepath.Join(r.Destination, r.dirName())
+
+	existed := r.Exists()
+
+	if existed {
+		// a previous clone that was interrupted before it finished is
+		// started over, rather than leave every later operation failing
+		reclone := r.partial(ctx)
+
+		if !reclone {
+			origin, err := r.origin(ctx)
+			if err != nil {
+				return err
+			}
+			if sameURL(origin, r.repoURL()) {
+				return nil
+			}
+
+			reclone, err = r.reconcile(ctx, origin)
+			if !reclone {
+				return err
+			}
+		}
+
+		err := r.removeAll(r.deploymentPath)
+		if err != nil {
+			return fmt.Errorf("could not remove existing clone of repo %s: %w", r.Name(), err)
+		}
+	}
+
+	// a missing or corrupt cache is no reason not to clone
+	if r.reference != "" && !isRepo(ctx, r.reference) {
+		r.reference = ""
+	}
+
+	_, stderr, err := r.mutate(ctx, r.Destination, fmt.Sprintf("could not clone repo %s", r.Name()), r.cloneArgs()...)
+	if err != nil {
+		// git cleans up after itself on failure, but not if it is killed
+		if !existed {
+			_ = os.RemoveAll(r.deploymentPath)
+		}
+
+		if r.reference != "" && ctx.Err() == nil {
+			r.reference = ""
+			return r.clone(ctx)
+		}
+
+		return err
+	}
+
+	// servers that don't support filters send everything instead
+	r.filtered = r.filter != "" && !bytes.Contains(stderr, []byte("filtering not recognized by server"))
+
+	return nil
+}
+
+// isRepo checks whether path holds a readable git repo
+func isRepo(ctx context.Context, path string) bool {
+	var r Repo
+	output, err := r.output(ctx, path, "could not read repo", "rev-parse", "--git-dir")
+	return err == nil && len(bytes.TrimSpace(output)) > 0
+}
+
+// partial checks whether the repo's directory was left behind by an
+// interrupted clone: git had started writing the repo, but HEAD is
+// missing or does not resolve to a commit. Directories that git did not
+// create are never considered partial
+func (r *Repo) partial(ctx context.Context) bool {
+	gitDir := r.gitDir()
+
+	_, err := os.Stat(filepath.Join(gitDir, "objects"))
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return true
+	}
+
+	_, err = r.output(ctx, r.deploymentPath, "could not read repo", "rev-parse", "--verify", "--quiet", "HEAD")
+
+	// git failing to run at all, e.g. because ctx is done, says nothing
+	// about the state of the clone
+	var gerr *GitError
+	return errors.As(err, &gerr) && gerr.ExitCode > 0
+}
+
+// gitDir returns the path of the repo's git directory
+func (r *Repo) gitDir() string {
+	if r.bare {
+		return r.deploymentPath
+	}
+	return filepath.Join(r.deploymentPath, ".git")
+}
+
+// cloneArgs returns the arguments git clone is run with
+func (r *Repo) cloneArgs() []string {
+	args := []string{"clone"}
+
+	if r.branch != "" {
+		args = append(args, "--branch", r.branch)
+	}
+
+	if r.bare {
+		args = append(args, "--bare")
+	}
+
+	// --depth implies --single-branch, which would leave Sync unable to
+	// check out any other branch unless it was asked for
+	if r.singleBranch {
+		args = append(args, "--single-branch")
+	} else if r.depth > 0 {
+		args = append(args, "--no-single-branch")
+	}
+
+	if r.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(r.depth))
+	}
+
+	if r.submodules {
+		args = append(args, "--recurse-submodules")
+	}
+
+	if r.filter != "" {
+		args = append(args, "--filter="+r.filter)
+	}
+
+	if r.reference != "" {
+		args = append(args, "--reference", r.reference)
+		if r.dissociate {
+			args = append(args, "--dissociate")
+		}
+	}
+
+	return append(args, r.repoURL(), r.dirName())
 }
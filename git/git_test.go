@@ -0,0 +1,879 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r3labs/verify/git"
+	"github.com/r3labs/verify/git/gittest"
+)
+
+func TestSyncRollback(t *testing.T) {
+	const (
+		before = "1111111111111111111111111111111111111111"
+		after  = "2222222222222222222222222222222222222222"
+	)
+
+	networkDown := gittest.Response{
+		Stderr:   "fatal: unable to access 'https://git.example.com/org/repo.git/': Could not resolve host: git.example.com\n",
+		ExitCode: 128,
+	}
+
+	tests := []struct {
+		name string
+		// fail lists the commands that fail, and how
+		fail map[string]gittest.Response
+		// moved is whether HEAD has left master at before when the sync
+		// fails
+		moved    bool
+		want     error
+		restored []string
+	}{
+		{
+			name:  "fetch",
+			fail:  map[string]gittest.Response{"fetch": networkDown},
+			moved: false,
+			want:  git.ErrHostNotFound,
+		},
+		{
+			name: "checkout",
+			fail: map[string]gittest.Response{"checkout": {
+				Stderr:   "error: Your local changes to the following files would be overwritten by checkout:\n\ta\nAborting\n",
+				ExitCode: 1,
+			}},
+			moved: false,
+		},
+		{
+			name:     "pull",
+			fail:     map[string]gittest.Response{"pull": networkDown},
+			moved:    true,
+			want:     git.ErrHostNotFound,
+			restored: []string{"checkout --quiet --force master", "reset --quiet --hard " + before},
+		},
+		{
+			name:     "counting commits",
+			fail:     map[string]gittest.Response{"rev-list": {Stderr: "fatal: bad revision\n", ExitCode: 128}},
+			moved:    true,
+			restored: []string{"checkout --quiet --force master", "reset --quiet --hard " + before},
+		},
+		{
+			name: "pull and rollback",
+			fail: map[string]gittest.Response{
+				"pull":  networkDown,
+				"reset": {Stderr: "fatal: Unable to create '.git/index.lock': File exists.\n", ExitCode: 128},
+			},
+			moved:    true,
+			want:     git.ErrRollbackFailed,
+			restored: []string{"checkout --quiet --force master", "reset --quiet --hard " + before},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, fake := fakeRepo(t)
+
+			head, branch := before, "master"
+			if tt.moved {
+				head, branch = after, "develop"
+			}
+
+			// where HEAD is once the sync has failed
+			fake.On(gittest.Response{Stdout: head + "\n"}, "rev-parse")
+			fake.On(gittest.Response{Stdout: branch + "\n"}, "rev-parse", "--abbrev-ref", "HEAD")
+			fake.On(gittest.Response{Stdout: "refs/heads/" + branch + "\n"}, "symbolic-ref")
+			fake.On(gittest.Response{Stdout: "origin/develop\n"}, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}")
+
+			// where it is when the sync starts
+			fake.On(gittest.Response{Stdout: before + "\n", Times: 1}, "rev-parse", "--verify", "HEAD^{commit}")
+			fake.On(gittest.Response{Stdout: "master\n", Times: 1}, "rev-parse", "--abbrev-ref", "HEAD")
+
+			for command, resp := range tt.fail {
+				fake.On(resp, command)
+			}
+
+			err := r.Sync("develop")
+			if err == nil {
+				t.Fatalf("Sync() = nil, want an error")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Sync() = %v, want %v", err, tt.want)
+			}
+
+			var rerr *git.RollbackError
+			rolledBack := errors.As(err, &rerr)
+			if rolledBack != tt.moved {
+				t.Errorf("Sync() = %v, rolled back %v, want %v", err, rolledBack, tt.moved)
+			}
+			if rolledBack && (rerr.Branch != "master" || rerr.Commit != before) {
+				t.Errorf("rolled back to %s at %s, want master at %s", rerr.Branch, rerr.Commit, before)
+			}
+
+			var restored []string
+			for _, command := range fake.Commands() {
+				if strings.HasPrefix(command, "checkout --quiet") || strings.HasPrefix(command, "reset") {
+					restored = append(restored, command)
+				}
+			}
+			if strings.Join(restored, "\n") != strings.Join(tt.restored, "\n") {
+				t.Errorf("rollback ran %q, want %q", restored, tt.restored)
+			}
+		})
+	}
+}
+
+func TestDescribeDirtyRef(t *testing.T) {
+	r, fake := fakeRepo(t)
+
+	_, err := r.Describe(git.DescribeOptions{Ref: "v1.0.0", Dirty: true})
+	if err == nil {
+		t.Fatalf("Describe() = nil, want an error")
+	}
+
+	if commands := fake.Commands(); len(commands) != 0 {
+		t.Errorf("Describe() ran %q, want nothing", commands)
+	}
+}
+
+func TestSyncTagHooks(t *testing.T) {
+	url, work := newOrigin(t)
+	run(t, work, "tag", "v1.0.0", "develop")
+	run(t, work, "push", "-q", "origin", "v1.0.0")
+	want := run(t, work, "rev-parse", "develop")
+
+	var calls []string
+	var synced git.SyncResult
+
+	r := cloneOrigin(t, url,
+		git.WithBeforeSync(func(*git.Repo) error {
+			calls = append(calls, "before")
+			return nil
+		}),
+		git.WithAfterSync(func(_ *git.Repo, result git.SyncResult) error {
+			calls = append(calls, "after")
+			synced = result
+			return nil
+		}),
+		git.WithOnError(func(*git.Repo, error) {
+			calls = append(calls, "error")
+		}),
+	)
+
+	err := r.SyncTag("v1.0.0")
+	if err != nil {
+		t.Fatalf("SyncTag() = %v", err)
+	}
+
+	if strings.Join(calls, " ") != "before after" {
+		t.Errorf("hooks called = %q, want before, after", calls)
+	}
+	if synced.Current != want || !synced.Changed || synced.Commits != 1 {
+		t.Errorf("AfterSync result = %+v, want one commit up to %s", synced, want)
+	}
+
+	calls = nil
+	err = r.SyncTag("v9.9.9")
+	if err == nil {
+		t.Fatalf("SyncTag() = nil, want an error")
+	}
+	if strings.Join(calls, " ") != "before error" {
+		t.Errorf("hooks called = %q, want before, error", calls)
+	}
+}
+
+func TestSyncTagBeforeSyncFails(t *testing.T) {
+	r, fake := fakeRepo(t, git.WithBeforeSync(func(*git.Repo) error {
+		return errors.New("maintenance window")
+	}))
+
+	err := r.SyncTag("v1.0.0")
+	if !errors.Is(err, git.ErrHookFailed) {
+		t.Errorf("SyncTag() = %v, want ErrHookFailed", err)
+	}
+	if commands := fake.Commands(); len(commands) != 0 {
+		t.Errorf("SyncTag() ran %q, want nothing", commands)
+	}
+}
+
+// conflicting clones url twice, and commits conflicting changes to the file
+// a in each, pushing the first's. It returns the second, which has yet to
+// pull, and the id of its commit
+func conflicting(t *testing.T, url string) (*git.Repo, string) {
+	t.Helper()
+
+	pushed := cloneOrigin(t, url)
+	local := cloneOrigin(t, url)
+
+	commitFile(t, pushed.DeployPath(), "a", "pushed\n", "pushed")
+	run(t, pushed.DeployPath(), "push", "-q", "origin", "master")
+
+	return local, commitFile(t, local.DeployPath(), "a", "local\n", "local")
+}
+
+// checkUntouched fails t unless the work tree of r is at head and clean,
+// with no merge or rebase left in progress
+func checkUntouched(t *testing.T, r *git.Repo, head string) {
+	t.Helper()
+
+	dir := r.DeployPath()
+	if got := run(t, dir, "rev-parse", "HEAD"); got != head {
+		t.Errorf("HEAD = %s, want %s", got, head)
+	}
+	if status := run(t, dir, "status", "--porcelain"); status != "" {
+		t.Errorf("work tree is not clean:\n%s", status)
+	}
+	for _, path := range []string{"MERGE_HEAD", "rebase-merge", "rebase-apply"} {
+		_, err := os.Stat(filepath.Join(dir, ".git", path))
+		if err == nil {
+			t.Errorf(".git/%s was left behind", path)
+		}
+	}
+}
+
+// checkConflict fails t unless err is a *ConflictError for op in the file a
+func checkConflict(t *testing.T, err error, op string, sentinel error) {
+	t.Helper()
+
+	var cerr *git.ConflictError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("err = %v, want a *ConflictError", err)
+	}
+	if cerr.Op != op || strings.Join(cerr.Paths, ",") != "a" {
+		t.Errorf("err = %s conflict in %q, want %s conflict in a", cerr.Op, cerr.Paths, op)
+	}
+	if !errors.Is(err, sentinel) {
+		t.Errorf("err = %v, want %v", err, sentinel)
+	}
+}
+
+func TestPullMergeConflict(t *testing.T) {
+	url, _ := newOrigin(t)
+	r, head := conflicting(t, url)
+
+	err := r.Pull()
+	checkConflict(t, err, "merge", git.ErrMergeConflict)
+	checkUntouched(t, r, head)
+}
+
+func TestSyncMergeConflict(t *testing.T) {
+	url, _ := newOrigin(t)
+	r, head := conflicting(t, url)
+
+	err := r.Sync("master")
+	checkConflict(t, err, "merge", git.ErrMergeConflict)
+	checkUntouched(t, r, head)
+}
+
+func TestPullRebase(t *testing.T) {
+	url, _ := newOrigin(t)
+	pushed := cloneOrigin(t, url)
+	r := cloneOrigin(t, url)
+
+	remote := commitFile(t, pushed.DeployPath(), "remote", "1\n", "remote")
+	run(t, pushed.DeployPath(), "push", "-q", "origin", "master")
+	commitFile(t, r.DeployPath(), "local", "1\n", "local")
+
+	err := r.PullWithOptions(git.PullOptions{Rebase: true})
+	if err != nil {
+		t.Fatalf("PullWithOptions(Rebase) = %v", err)
+	}
+
+	// the local commit is replayed on top of the pushed one, without a
+	// merge commit
+	dir := r.DeployPath()
+	if parent := run(t, dir, "rev-parse", "HEAD~1"); parent != remote {
+		t.Errorf("HEAD~1 = %s, want the pushed commit %s", parent, remote)
+	}
+	if subject := run(t, dir, "log", "-1", "--format=%s"); subject != "local" {
+		t.Errorf("HEAD is %q, want the local commit", subject)
+	}
+	if merges := run(t, dir, "rev-list", "--merges", "HEAD"); merges != "" {
+		t.Errorf("history has merge commits %s", merges)
+	}
+	checkUntouched(t, r, run(t, dir, "rev-parse", "HEAD"))
+}
+
+func TestPullRebaseConflict(t *testing.T) {
+	url, _ := newOrigin(t)
+	r, head := conflicting(t, url)
+
+	err := r.PullWithOptions(git.PullOptions{Rebase: true})
+	checkConflict(t, err, "rebase", git.ErrRebaseConflict)
+	checkUntouched(t, r, head)
+}
+
+func TestHeadState(t *testing.T) {
+	url, work := newOrigin(t)
+	run(t, work, "tag", "-a", "-m", "release", "v1.0.0", "develop")
+	run(t, work, "push", "-q", "origin", "v1.0.0")
+	master := run(t, work, "rev-parse", "master")
+	develop := run(t, work, "rev-parse", "develop")
+	first := run(t, work, "rev-parse", "master~1")
+
+	tests := []struct {
+		name     string
+		checkout func(r *git.Repo) error
+		want     git.HeadState
+	}{
+		{
+			name:     "attached",
+			checkout: func(r *git.Repo) error { return nil },
+			want:     git.HeadState{Branch: "master", Commit: master},
+		},
+		{
+			name:     "attached to another branch",
+			checkout: func(r *git.Repo) error { return r.Checkout("develop") },
+			want:     git.HeadState{Branch: "develop", Commit: develop},
+		},
+		{
+			name:     "detached at tag",
+			checkout: func(r *git.Repo) error { return r.CheckoutTag("v1.0.0") },
+			want:     git.HeadState{Commit: develop, Detached: true},
+		},
+		{
+			name:     "detached at commit",
+			checkout: func(r *git.Repo) error { return r.CheckoutCommit(first[:10]) },
+			want:     git.HeadState{Commit: first, Detached: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := cloneOrigin(t, url)
+
+			err := tt.checkout(r)
+			if err != nil {
+				t.Fatalf("checkout = %v", err)
+			}
+
+			state, err := r.HeadState()
+			if err != nil {
+				t.Fatalf("HeadState() = %v", err)
+			}
+			if *state != tt.want {
+				t.Errorf("HeadState() = %+v, want %+v", *state, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncRefusesTag(t *testing.T) {
+	url, work := newOrigin(t)
+	run(t, work, "tag", "v1.0.0", "develop")
+	run(t, work, "push", "-q", "origin", "v1.0.0")
+
+	r := cloneOrigin(t, url)
+
+	err := r.Sync("v1.0.0")
+	if !errors.Is(err, git.ErrDetachedHead) {
+		t.Errorf("Sync() of a tag = %v, want ErrDetachedHead", err)
+	}
+
+	// the failed sync is rolled back, rather than leave HEAD detached
+	state, err := r.HeadState()
+	if err != nil {
+		t.Fatalf("HeadState() = %v", err)
+	}
+	if state.Detached || state.Branch != "master" {
+		t.Errorf("HeadState() after Sync() = %+v, want master", *state)
+	}
+}
+
+func TestSyncPolicyRange(t *testing.T) {
+	url, work := newOrigin(t)
+	one := run(t, work, "rev-parse", "master~1")
+	r := cloneOrigin(t, url)
+
+	four := commitFile(t, work, "d", "4\n", "four")
+	run(t, work, "push", "-q", "origin", "master")
+
+	empty := filepath.Join(t.TempDir(), "empty")
+	run(t, filepath.Dir(empty), "init", "-q", empty)
+	run(t, empty, "remote", "add", "origin", url)
+	e, err := git.Open(empty, git.WithEnv(gitEnv...))
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		repo   *git.Repo
+		branch string
+		want   string
+	}{
+		// only the commits master doesn't have yet are checked
+		{"checked out", r, "master", four},
+		// a branch new to the repo brings in all of origin's commits
+		{"new branch", r, "develop", one},
+		{"no HEAD", e, "master", one},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.repo.SyncWithOptions(tt.branch, git.SyncOptions{Policy: &git.SignaturePolicy{}})
+
+			var perr *git.PolicyError
+			if !errors.As(err, &perr) || perr.Commit != tt.want {
+				t.Errorf("SyncWithOptions() = %v, want a *PolicyError for %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployPath(t *testing.T) {
+	tests := []struct {
+		repo, destination, dir string
+		want                   string
+		// windows cases only hold where backslashes separate paths
+		windows bool
+	}{
+		{repo: "git@github.com:r3labs/verify.git", destination: "/srv/deployments", want: "/srv/deployments/verify"},
+		{repo: "git@github.com:r3labs/verify.git", destination: "/srv/deployments/", want: "/srv/deployments/verify"},
+		{repo: "git@github.com:r3labs/verify.git", destination: "/srv/deployments//", want: "/srv/deployments/verify"},
+		{repo: "https://github.com/r3labs/verify", destination: "/srv/deployments", want: "/srv/deployments/verify"},
+		{repo: "https://github.com/r3labs/verify", destination: "/srv/deployments/", dir: "current", want: "/srv/deployments/current"},
+		{repo: `C:\repos\verify.git`, destination: `D:\deployments`, want: `D:\deployments\verify`, windows: true},
+		{repo: `C:\repos\verify.git`, destination: `D:\deployments\`, want: `D:\deployments\verify`, windows: true},
+		{repo: "https://github.com/r3labs/verify", destination: `D:/deployments/`, want: `D:\deployments\verify`, windows: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			if tt.windows != (runtime.GOOS == "windows") {
+				t.Skip("paths for another os")
+			}
+
+			r := &git.Repo{Repo: tt.repo, Destination: tt.destination}
+			if tt.dir != "" {
+				git.WithDir(tt.dir)(r)
+			}
+
+			if got := r.DeployPath(); got != tt.want {
+				t.Errorf("DeployPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloneTrailingSlash(t *testing.T) {
+	url, _ := newOrigin(t)
+	dest := t.TempDir()
+
+	r, err := git.Clone(url, dest+string(filepath.Separator))
+	if err != nil {
+		t.Fatalf("Clone() = %v", err)
+	}
+
+	want := filepath.Join(dest, "origin")
+	if r.DeployPath() != want || !r.Exists() {
+		t.Errorf("cloned to %s, want %s", r.DeployPath(), want)
+	}
+
+	// cloning again finds the clone that is there
+	r, err = git.Clone(url, dest)
+	if err != nil || r.DeployPath() != want {
+		t.Errorf("Clone() again = %v, %v, want the clone at %s", r, err, want)
+	}
+}
+
+func TestCloneArgs(t *testing.T) {
+	const url = "https://git.example.com/org/repo.git"
+
+	tests := []struct {
+		name string
+		opts []git.Option
+		want string
+	}{
+		{"defaults", nil, "clone " + url + " repo"},
+		{"branch", []git.Option{git.WithBranch("develop")}, "clone --branch develop " + url + " repo"},
+		{"depth", []git.Option{git.WithDepth(1)}, "clone --no-single-branch --depth 1 " + url + " repo"},
+		{"single branch", []git.Option{git.WithBranch("develop"), git.WithSingleBranch()}, "clone --branch develop --single-branch " + url + " repo"},
+		{"single branch with depth", []git.Option{git.WithSingleBranch(), git.WithDepth(10)}, "clone --single-branch --depth 10 " + url + " repo"},
+		{"dir", []git.Option{git.WithDir("current")}, "clone " + url + " current"},
+		{"bare", []git.Option{git.WithBare()}, "clone --bare " + url + " repo.git"},
+		{"submodules", []git.Option{git.WithSubmodules()}, "clone --recurse-submodules " + url + " repo"},
+		{"filter", []git.Option{git.WithFilter("blob:none")}, "clone --filter=blob:none " + url + " repo"},
+		{
+			"everything",
+			[]git.Option{git.WithBranch("main"), git.WithDepth(5), git.WithDir("app"), git.WithSubmodules(), git.WithFilter("tree:0")},
+			"clone --branch main --no-single-branch --depth 5 --recurse-submodules --filter=tree:0 " + url + " app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := gittest.New()
+			fake.On(gittest.Response{Stdout: "git version 2.39.0\n"}, "--version")
+
+			_, err := git.Clone(url, t.TempDir(), append(tt.opts, git.WithRunner(fake))...)
+			if err != nil {
+				t.Fatalf("Clone() = %v", err)
+			}
+
+			var clone string
+			for _, command := range fake.Commands() {
+				if strings.HasPrefix(command, "clone ") {
+					clone = command
+				}
+			}
+			if clone != tt.want {
+				t.Errorf("ran %q, want %q", clone, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloneOptionsApplyLater(t *testing.T) {
+	r, fake := fakeRepo(t, git.WithEnv("VERIFY_TEST=1"), git.WithGitBinary("/opt/git/bin/git"))
+
+	err := r.Fetch()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+
+	for _, c := range fake.Calls() {
+		if c.Path != "/opt/git/bin/git" {
+			t.Errorf("ran %s, want /opt/git/bin/git", c.Path)
+		}
+		if got := lookupEnv(c.Env, "VERIFY_TEST"); got != "1" {
+			t.Errorf("VERIFY_TEST = %q, want the clone's env", got)
+		}
+	}
+}
+
+func TestFetchPruneLeavesPruneAlone(t *testing.T) {
+	r, fake := fakeRepo(t)
+
+	// Prune is only read while FetchPrune runs, leaving it safe to read
+	// alongside it
+	done := make(chan error)
+	go func() {
+		_, err := r.FetchPrune()
+		done <- err
+	}()
+	for pruning := true; pruning; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("FetchPrune() = %v", err)
+			}
+			pruning = false
+		default:
+			if r.Prune {
+				t.Fatalf("Prune = true while FetchPrune() runs, want it left as it was")
+			}
+		}
+	}
+
+	if commands := fake.Commands(); len(commands) != 1 || !strings.Contains(commands[0], "--prune") {
+		t.Errorf("FetchPrune() ran %q, want a pruning fetch", commands)
+	}
+
+	fake.Reset()
+
+	err := r.Fetch()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	if commands := fake.Commands(); len(commands) != 1 || strings.Contains(commands[0], "--prune") {
+		t.Errorf("Fetch() ran %q, want a fetch that doesn't prune", commands)
+	}
+}
+
+// killedClone is a git.Runner whose clone starts writing the repo, then
+// hangs until it is killed
+type killedClone struct{}
+
+func (killedClone) Run(ctx context.Context, cmd *git.Command) ([]byte, []byte, error) {
+	args := cmd.Args
+	if len(args) == 0 || !contains(args, "clone") {
+		return nil, nil, nil
+	}
+
+	err := os.MkdirAll(filepath.Join(cmd.Dir, args[len(args)-1], ".git", "objects"), 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCloneKilledLeavesNothing(t *testing.T) {
+	dest := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := git.CloneContext(ctx, "https://git.example.com/org/repo.git", dest, git.WithRunner(killedClone{}))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CloneContext() = %v, want DeadlineExceeded", err)
+	}
+
+	_, err = os.Stat(filepath.Join(dest, "repo"))
+	if !os.IsNotExist(err) {
+		t.Errorf("killed clone left %s behind", filepath.Join(dest, "repo"))
+	}
+}
+
+func TestCloneFailedLeavesNothing(t *testing.T) {
+	url, _ := newOrigin(t)
+	dest := t.TempDir()
+
+	_, err := git.Clone(filepath.Join(filepath.Dir(url), "missing.git"), dest)
+	if err == nil {
+		t.Fatalf("Clone() of a missing repo = nil, want an error")
+	}
+
+	entries, err := ioutil.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("failed clone left %s behind", entries[0].Name())
+	}
+}
+
+func TestCloneRecoversPartialClone(t *testing.T) {
+	url, work := newOrigin(t)
+	dest := t.TempDir()
+
+	// what a clone killed before it checked anything out leaves behind
+	err := os.MkdirAll(filepath.Join(dest, "origin", ".git", "objects"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := git.Clone(url, dest)
+	if err != nil {
+		t.Fatalf("Clone() over a partial clone = %v", err)
+	}
+
+	id, err := r.CommitID()
+	if want := run(t, work, "rev-parse", "master"); err != nil || id != want {
+		t.Errorf("CommitID() = %q, %v, want %s", id, err, want)
+	}
+}
+
+func TestCloneKeepsExistingDirectory(t *testing.T) {
+	url, _ := newOrigin(t)
+	dest := t.TempDir()
+	writeFile(t, dest, "keep", "1\n")
+
+	// a directory that isn't a clone is never removed
+	_, err := git.Clone(url, filepath.Dir(dest), git.WithDir(filepath.Base(dest)))
+	if !errors.Is(err, git.ErrNotRepository) {
+		t.Errorf("Clone() into a directory with files = %v, want ErrNotRepository", err)
+	}
+
+	_, err = os.Stat(filepath.Join(dest, "keep"))
+	if err != nil {
+		t.Errorf("Clone() removed what was in its destination: %v", err)
+	}
+}
+
+// missingObjects counts the objects a partial clone of r has yet to fetch
+func missingObjects(t *testing.T, r *git.Repo) int {
+	t.Helper()
+
+	missing := 0
+	for _, line := range strings.Split(run(t, r.DeployPath(), "rev-list", "--objects", "--all", "--missing=print"), "\n") {
+		if strings.HasPrefix(line, "?") {
+			missing++
+		}
+	}
+	return missing
+}
+
+func TestPartialClone(t *testing.T) {
+	url, _ := newOrigin(t)
+	run(t, url, "config", "uploadpack.allowFilter", "true")
+
+	r := cloneOrigin(t, "file://"+url, git.WithFilter("blob:none"))
+
+	if !r.Filtered() {
+		t.Errorf("Filtered() = false, want a partial clone")
+	}
+	if filter := run(t, r.DeployPath(), "config", "remote.origin.partialclonefilter"); filter != "blob:none" {
+		t.Errorf("remote.origin.partialclonefilter = %q, want blob:none", filter)
+	}
+
+	// only develop's blob is left out, master's being checked out
+	if missing := missingObjects(t, r); missing != 1 {
+		t.Errorf("%d objects missing, want develop's blob", missing)
+	}
+
+	contents, err := r.FileAt("origin/develop", "c")
+	if err != nil || string(contents) != "3\n" {
+		t.Errorf("FileAt() = %q, %v, want the blob fetched on demand", contents, err)
+	}
+
+	err = r.Checkout("develop")
+	if err != nil {
+		t.Errorf("Checkout() = %v", err)
+	}
+
+	// reopening the clone finds the filter it was made with
+	reopened, err := git.Open(r.DeployPath())
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+	if !reopened.Filtered() {
+		t.Errorf("Filtered() = false after Open(), want a partial clone")
+	}
+}
+
+func TestPartialCloneUnsupported(t *testing.T) {
+	url, _ := newOrigin(t)
+	run(t, url, "config", "uploadpack.allowFilter", "false")
+
+	// servers that don't support filters send everything instead
+	r := cloneOrigin(t, "file://"+url, git.WithFilter("blob:none"))
+
+	if r.Filtered() {
+		t.Errorf("Filtered() = true, want a full clone")
+	}
+	if missing := missingObjects(t, r); missing != 0 {
+		t.Errorf("%d objects missing, want a full clone", missing)
+	}
+}
+
+func TestCommits(t *testing.T) {
+	url, work := newOrigin(t)
+	r := cloneOrigin(t, url)
+
+	ids, err := r.Commits()
+	if err != nil {
+		t.Fatalf("Commits() = %v", err)
+	}
+
+	want := strings.Split(run(t, work, "rev-list", "master"), "\n")
+	if len(ids) != len(want) {
+		t.Fatalf("Commits() = %q, want %d commits", ids, len(want))
+	}
+	for i, id := range ids {
+		if strings.ContainsAny(id, "'\" \n") || len(id) < 4 || !strings.HasPrefix(want[i], id) {
+			t.Errorf("Commits()[%d] = %q, want an abbreviation of %s", i, id, want[i])
+		}
+	}
+
+	commits, err := r.Log(0)
+	if err != nil {
+		t.Fatalf("Log() = %v", err)
+	}
+	if len(commits) != 2 || commits[0].ID != want[0] || commits[0].Message != "two" || commits[1].Message != "one" {
+		t.Errorf("Log() = %+v, want two then one", commits)
+	}
+}
+
+func TestCommitsEmptyRepo(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "empty")
+	run(t, filepath.Dir(dir), "init", "-q", dir)
+
+	r, err := git.Open(dir)
+	if err != nil {
+		t.Fatalf("Open() = %v", err)
+	}
+
+	ids, err := r.Commits()
+	if err != nil {
+		t.Fatalf("Commits() = %v", err)
+	}
+	if ids == nil || len(ids) != 0 {
+		t.Errorf("Commits() = %#v, want an empty slice", ids)
+	}
+}
+
+func TestDiverged(t *testing.T) {
+	url, work := newOrigin(t)
+
+	// topic branches off master and gains a commit of its own
+	run(t, work, "checkout", "-q", "-b", "topic", "master")
+	commitFile(t, work, "topic", "1\n", "topic")
+	run(t, work, "checkout", "-q", "master")
+	run(t, work, "push", "-q", "origin", "topic")
+
+	r := cloneOrigin(t, url)
+
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{"master", "origin/master", false},
+		{"master", "master", false},
+		{"master", "origin/develop", false},
+		{"origin/develop", "master", false},
+		{"origin/develop", "origin/topic", true},
+		{"origin/topic", "origin/develop", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+" "+tt.to, func(t *testing.T) {
+			diverged, err := r.Diverged(tt.from, tt.to)
+			if err != nil {
+				t.Fatalf("Diverged() = %v", err)
+			}
+			if diverged != tt.want {
+				t.Errorf("Diverged() = %v, want %v", diverged, tt.want)
+			}
+		})
+	}
+
+	for _, refs := range [][2]string{{"nope", "master"}, {"master", "nope"}} {
+		_, err := r.Diverged(refs[0], refs[1])
+		if !errors.Is(err, git.ErrRefNotFound) {
+			t.Errorf("Diverged(%s, %s) = %v, want ErrRefNotFound", refs[0], refs[1], err)
+		}
+	}
+}
+
+func TestAheadBehind(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url)
+	dir := r.DeployPath()
+
+	// develop is behind origin's by a commit, then ahead by two of its own
+	run(t, dir, "branch", "develop", "origin/develop~1")
+	ahead, behind, err := r.AheadBehind("develop")
+	if err != nil || ahead != 0 || behind != 1 {
+		t.Errorf("AheadBehind() = %d, %d, %v, want 0, 1", ahead, behind, err)
+	}
+
+	run(t, dir, "checkout", "-q", "develop")
+	commitFile(t, dir, "x", "1\n", "x")
+	commitFile(t, dir, "y", "1\n", "y")
+	ahead, behind, err = r.AheadBehind("develop")
+	if err != nil || ahead != 2 || behind != 1 {
+		t.Errorf("AheadBehind() = %d, %d, %v, want 2, 1", ahead, behind, err)
+	}
+
+	_, _, err = r.AheadBehind("nope")
+	if !errors.Is(err, git.ErrBranchNotFound) {
+		t.Errorf("AheadBehind() of a missing branch = %v, want ErrBranchNotFound", err)
+	}
+
+	run(t, dir, "branch", "local")
+	_, _, err = r.AheadBehind("local")
+	if !errors.Is(err, git.ErrNoUpstream) {
+		t.Errorf("AheadBehind() of a local branch = %v, want ErrNoUpstream", err)
+	}
+}
@@ -0,0 +1,177 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package gittest provides a fake git.Runner, so code built on the git
+// package can be tested without a git binary or network access
+package gittest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r3labs/verify/git"
+)
+
+// Response is the canned reply to a git command
+type Response struct {
+	// Stdout and Stderr are what git appears to write
+	Stdout string
+	Stderr string
+	// ExitCode makes the command fail with an *ExitError when non-zero
+	ExitCode int
+	// Err makes the command fail with Err, as if git could not be started
+	Err error
+	// Delay holds the reply back. If the command's context is done first,
+	// e.g. because of a timeout, the command fails with the context's error
+	Delay time.Duration
+	// Times, if set, limits the response to that many commands, after
+	// which those registered before it apply again, so a fake repo's state
+	// can change part way through an operation
+	Times int
+}
+
+// ExitError is returned for responses with a non-zero ExitCode
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit code of the command
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+type rule struct {
+	args []string
+	resp Response
+	used int
+}
+
+// Runner is a fake git.Runner. It records every command it is asked to
+// run, and replies with the response registered for the command, or an
+// empty, successful one. It is safe for concurrent use
+type Runner struct {
+	mu    sync.Mutex
+	rules []rule
+	calls []git.Command
+}
+
+// New returns a Runner with no responses registered
+func New() *Runner {
+	return &Runner{}
+}
+
+// On registers resp as the reply to commands whose arguments, ignoring
+// leading -c options, start with args. Later registrations take precedence
+// over earlier ones
+func (f *Runner) On(resp Response, args ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, rule{args: args, resp: resp})
+}
+
+// Calls returns the commands run so far, in order
+func (f *Runner) Calls() []git.Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]git.Command(nil), f.calls...)
+}
+
+// Commands returns the arguments of the commands run so far, ignoring
+// leading -c options, each joined by spaces, e.g. "fetch --prune"
+func (f *Runner) Commands() []string {
+	var commands []string
+	for _, c := range f.Calls() {
+		commands = append(commands, strings.Join(stripConfig(c.Args), " "))
+	}
+	return commands
+}
+
+// Reset forgets the commands run so far, keeping registered responses
+func (f *Runner) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = nil
+}
+
+// Run records cmd and replies with the matching response
+func (f *Runner) Run(ctx context.Context, cmd *git.Command) ([]byte, []byte, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, *cmd)
+	resp := f.match(stripConfig(cmd.Args))
+	f.mu.Unlock()
+
+	if resp.Delay > 0 {
+		select {
+		case <-time.After(resp.Delay):
+		case <-ctx.Done():
+			return nil, []byte(resp.Stderr), ctx.Err()
+		}
+	}
+
+	if cmd.Stderr != nil && resp.Stderr != "" {
+		_, _ = cmd.Stderr.Write([]byte(resp.Stderr))
+	}
+
+	if resp.Err != nil {
+		return nil, nil, resp.Err
+	}
+
+	stdout := []byte(resp.Stdout)
+	if cmd.Stdout != nil {
+		_, _ = cmd.Stdout.Write(stdout)
+		stdout = nil
+	}
+
+	switch {
+	case resp.ExitCode != 0:
+		return stdout, []byte(resp.Stderr), &ExitError{Code: resp.ExitCode}
+	}
+
+	return stdout, []byte(resp.Stderr), nil
+}
+
+// match returns the response registered for args. f.mu must be held
+func (f *Runner) match(args []string) Response {
+	for i := len(f.rules) - 1; i >= 0; i-- {
+		rule := &f.rules[i]
+		if rule.resp.Times > 0 && rule.used >= rule.resp.Times {
+			continue
+		}
+		if hasPrefix(args, rule.args) {
+			rule.used++
+			return rule.resp
+		}
+	}
+	return Response{}
+}
+
+func hasPrefix(args, prefix []string) bool {
+	if len(prefix) > len(args) {
+		return false
+	}
+	for i := range prefix {
+		if args[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stripConfig drops the -c options git is run with before the subcommand
+func stripConfig(args []string) []string {
+	for len(args) >= 2 && args[0] == "-c" {
+		args = args[2:]
+	}
+	return args
+}
@@ -0,0 +1,122 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/r3labs/verify/git"
+	"github.com/r3labs/verify/git/gittest"
+)
+
+// gitEnv is the environment test repos are set up and used with, so
+// commits don't depend on the user's git config
+var gitEnv = []string{
+	"GIT_AUTHOR_NAME=test",
+	"GIT_AUTHOR_EMAIL=test@example.com",
+	"GIT_COMMITTER_NAME=test",
+	"GIT_COMMITTER_EMAIL=test@example.com",
+}
+
+// fakeRepo returns a repo run by a fake git, which has forgotten the
+// commands run to clone it
+func fakeRepo(t *testing.T, opts ...git.Option) (*git.Repo, *gittest.Runner) {
+	t.Helper()
+
+	fake := gittest.New()
+	r, err := git.Clone("https://git.example.com/org/repo.git", t.TempDir(), append(opts, git.WithRunner(fake))...)
+	if err != nil {
+		t.Fatalf("Clone() = %v", err)
+	}
+	fake.Reset()
+
+	return r, fake
+}
+
+// run runs git in dir, returning its trimmed output. Tests are skipped
+// where there is no git to run
+func run(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	_, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), gitEnv...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// commitFile writes contents to the file name in the work tree dir and
+// commits it, returning the new commit's id
+func commitFile(t *testing.T, dir, name, contents, message string) string {
+	t.Helper()
+
+	writeFile(t, dir, name, contents)
+	run(t, dir, "add", name)
+	run(t, dir, "commit", "-q", "-m", message)
+
+	return run(t, dir, "rev-parse", "HEAD")
+}
+
+// writeFile writes contents to the file name in dir
+func writeFile(t *testing.T, dir, name, contents string) {
+	t.Helper()
+
+	err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newOrigin creates a bare repo to clone from, returning its path and that
+// of a work repo pushing to it. master has the commits "one" and "two",
+// and develop is one commit, "three", ahead of it
+func newOrigin(t *testing.T) (url, work string) {
+	t.Helper()
+
+	base := t.TempDir()
+	work = filepath.Join(base, "work")
+	url = filepath.Join(base, "origin.git")
+
+	run(t, base, "init", "-q", work)
+	run(t, work, "symbolic-ref", "HEAD", "refs/heads/master")
+	commitFile(t, work, "a", "1\n", "one")
+	commitFile(t, work, "b", "2\n", "two")
+
+	run(t, work, "checkout", "-q", "-b", "develop")
+	commitFile(t, work, "c", "3\n", "three")
+	run(t, work, "checkout", "-q", "master")
+
+	run(t, base, "clone", "-q", "--bare", work, url)
+	run(t, work, "remote", "add", "origin", url)
+
+	return url, work
+}
+
+// cloneOrigin clones url into a temporary directory
+func cloneOrigin(t *testing.T, url string, opts ...git.Option) *git.Repo {
+	t.Helper()
+
+	r, err := git.Clone(url, t.TempDir(), append([]git.Option{git.WithEnv(gitEnv...)}, opts...)...)
+	if err != nil {
+		t.Fatalf("Clone() = %v", err)
+	}
+
+	return r
+}
@@ -0,0 +1,178 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// opLock serializes the operations that change a repo, while letting
+// read-only ones run alongside each other. Writers waiting for the lock
+// keep new readers out, so a steady stream of reads can't hold off a sync
+type opLock struct {
+	mu      sync.Mutex
+	readers int
+	writer  bool
+	waiting int
+	// wake is closed, and replaced, whenever the lock may have become free
+	wake chan struct{}
+}
+
+// acquire takes the lock, for writing if write is set. Unless wait is set
+// it fails with ErrBusy rather than wait for it to be free
+func (l *opLock) acquire(ctx context.Context, write, wait bool) error {
+	queued := false
+
+	for {
+		l.mu.Lock()
+		if !l.writer && (write && l.readers == 0 || !write && l.waiting == 0) {
+			if write {
+				l.writer = true
+				if queued {
+					l.waiting--
+				}
+			} else {
+				l.readers++
+			}
+			l.mu.Unlock()
+			return nil
+		}
+
+		if !wait {
+			l.mu.Unlock()
+			return ErrBusy
+		}
+
+		if write && !queued {
+			l.waiting++
+			queued = true
+		}
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			if queued {
+				l.mu.Lock()
+				l.waiting--
+				l.broadcast()
+				l.mu.Unlock()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// release gives up the lock taken by acquire
+func (l *opLock) release(write bool) {
+	l.mu.Lock()
+	if write {
+		l.writer = false
+	} else {
+		l.readers--
+	}
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+// broadcast wakes everything waiting for the lock. l.mu must be held
+func (l *opLock) broadcast() {
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// heldKey is the context key marking the operations of a repo that holds
+// its lock, so the operations they call don't wait for it themselves
+type heldKey struct{}
+
+// held records which repo's lock an operation holds, and how
+type held struct {
+	repo  *Repo
+	write bool
+}
+
+// noWaitKey is the context key set by NoWait
+type noWaitKey struct{}
+
+// NoWait returns a copy of ctx that makes operations fail with ErrBusy,
+// rather than wait, while another goroutine is changing the repo
+func NoWait(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noWaitKey{}, true)
+}
+
+// lock takes the repo's operation lock, for writing if write is set,
+// unless ctx comes from an operation already holding it. It returns the
+// ctx to run the operation with and a func releasing the lock. An
+// operation holding the lock for reading must not change the repo
+func (r *Repo) lock(ctx context.Context, write bool) (context.Context, func(), error) {
+	if h, ok := ctx.Value(heldKey{}).(held); ok && h.repo == r && (h.write || !write) {
+		return ctx, func() {}, nil
+	}
+
+	wait := ctx.Value(noWaitKey{}) == nil
+
+	err := r.ops.acquire(ctx, write, wait)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("could not lock repo %s: %w", r.Name(), err)
+	}
+
+	unlock := func() { r.ops.release(write) }
+
+	// a DryRun changes nothing, so has no need to keep other processes out
+	if write && r.LockFile && !r.DryRun {
+		unlockFile, err := r.lockFile(ctx, wait)
+		if err != nil {
+			unlock()
+			return ctx, nil, err
+		}
+
+		unlock = func() {
+			unlockFile()
+			r.ops.release(write)
+		}
+	}
+
+	return context.WithValue(ctx, heldKey{}, held{repo: r, write: write}), unlock, nil
+}
+
+// TrySync is Sync, except that it fails with ErrBusy straight away if
+// another goroutine is using the repo, so a sync that would only queue up
+// behind it can be skipped
+func (r *Repo) TrySync(branch string) error {
+	return r.TrySyncContext(context.Background(), branch)
+}
+
+// TrySyncContext is SyncContext, failing with ErrBusy if another goroutine
+// is using the repo
+func (r *Repo) TrySyncContext(ctx context.Context, branch string) error {
+	return r.SyncContext(NoWait(ctx), branch)
+}
+
+// uncancelled is a context with the values of another, which is never
+// done, for cleaning up after an operation whose ctx was cancelled
+type uncancelled struct {
+	context.Context
+}
+
+func (uncancelled) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (uncancelled) Done() <-chan struct{} {
+	return nil
+}
+
+func (uncancelled) Err() error {
+	return nil
+}
@@ -0,0 +1,170 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/r3labs/verify/git"
+	"github.com/r3labs/verify/git/gittest"
+)
+
+func TestConcurrentSyncAndCommitID(t *testing.T) {
+	url, work := newOrigin(t)
+	commits := map[string]bool{
+		run(t, work, "rev-parse", "master"):  true,
+		run(t, work, "rev-parse", "develop"): true,
+	}
+
+	r := cloneOrigin(t, url)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+
+	for i := 0; i < 4; i++ {
+		branch := "master"
+		if i%2 == 1 {
+			branch = "develop"
+		}
+
+		wg.Add(1)
+		go func(branch string) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				errs <- r.Sync(branch)
+			}
+		}(branch)
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				id, err := r.CommitID()
+				if err == nil && !commits[id] {
+					t.Errorf("CommitID() = %s, which is neither branch", id)
+				}
+				errs <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent Sync or CommitID = %v", err)
+		}
+	}
+}
+
+func TestConcurrentSetRemoteURL(t *testing.T) {
+	r, _ := fakeRepo(t, git.WithObserver(git.NewMetrics()))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			err := r.SetRemoteURL("origin", fmt.Sprintf("https://git.example.com/org/repo%d.git", i))
+			if err != nil {
+				t.Errorf("SetRemoteURL() = %v", err)
+				return
+			}
+		}
+	}()
+
+	// Name and the Observer's label read the url SetRemoteURL changes
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			r.Name()
+			r.CommitID()
+		}
+	}()
+
+	wg.Wait()
+
+	if name := r.Name(); name != "repo49" {
+		t.Errorf("Name() = %s, want repo49", name)
+	}
+}
+
+// syncing starts a sync of r whose git commands are held back by fake,
+// returning once the sync holds the repo's lock and a channel its result
+// is sent on
+func syncing(t *testing.T, r *git.Repo, fake *gittest.Runner) <-chan error {
+	t.Helper()
+
+	fake.On(gittest.Response{Delay: 20 * time.Millisecond})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Sync("master")
+	}()
+
+	// the first command is only run once the lock is held
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.Calls()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Sync() ran no git commands")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return done
+}
+
+func TestTrySyncBusy(t *testing.T) {
+	r, fake := fakeRepo(t)
+	done := syncing(t, r, fake)
+
+	err := r.TrySync("master")
+	if !errors.Is(err, git.ErrBusy) {
+		t.Errorf("TrySync() during Sync = %v, want ErrBusy", err)
+	}
+
+	_, err = r.CommitIDContext(git.NoWait(context.Background()))
+	if !errors.Is(err, git.ErrBusy) {
+		t.Errorf("CommitIDContext(NoWait) during Sync = %v, want ErrBusy", err)
+	}
+
+	<-done
+
+	fake.Reset()
+	fake.On(gittest.Response{})
+
+	err = r.TrySync("master")
+	if errors.Is(err, git.ErrBusy) {
+		t.Errorf("TrySync() after Sync = %v, want the repo free", err)
+	}
+	if len(fake.Calls()) == 0 {
+		t.Errorf("TrySync() after Sync ran no git commands")
+	}
+}
+
+func TestSyncWaitsForSync(t *testing.T) {
+	r, fake := fakeRepo(t)
+	done := syncing(t, r, fake)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// a second sync queues up behind the first, until it gives up
+	err := r.SyncContext(ctx, "master")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SyncContext() during Sync = %v, want DeadlineExceeded", err)
+	}
+
+	<-done
+}
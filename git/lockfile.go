@@ -0,0 +1,181 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the lock file LockFile repos hold, kept in the git
+// directory rather than the work tree, so it is never seen as untracked
+const lockFileName = "verify.lock"
+
+// lockPoll is how often a lock file held by another process is checked
+const lockPoll = 100 * time.Millisecond
+
+// lockAbandoned is how old an unreadable lock file, or the guard taken to
+// break a stale one, must be before it is taken for the leftover of a
+// process that crashed while writing it
+const lockAbandoned = time.Minute
+
+// lockFile takes the lock file in the repo's git directory, waiting up to
+// LockWait for another process holding it, unless wait is unset. It
+// returns a func releasing it. A lock left by a process that is no longer
+// running on this host is broken
+func (r *Repo) lockFile(ctx context.Context, wait bool) (func(), error) {
+	// there is nowhere to keep the lock until the repo is cloned
+	_, err := os.Stat(r.gitDir())
+	if os.IsNotExist(err) {
+		return func() {}, nil
+	}
+
+	path := filepath.Join(r.gitDir(), lockFileName)
+	deadline := time.Now().Add(r.LockWait)
+
+	for {
+		err := createLock(path)
+		if err == nil {
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("could not lock repo %s: %w", r.Name(), err)
+		}
+
+		holder, contents, err := readLock(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not lock repo %s: %w", r.Name(), err)
+		}
+
+		if holder.stale() && breakLock(path, contents) {
+			continue
+		}
+
+		if !wait || !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("could not lock repo %s: %w", r.Name(), holder)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("could not lock repo %s: %w", r.Name(), ctx.Err())
+		case <-time.After(lockPoll):
+		}
+	}
+}
+
+// createLock creates the lock file at path, recording the process holding
+// it, or fails with an error matching os.ErrExist if it is already held
+func createLock(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	_, err = fmt.Fprintf(f, "%d\n%s\n%s\n", os.Getpid(), host, time.Now().UTC().Format(time.RFC3339))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+
+	return err
+}
+
+// readLock reads who holds the lock file at path, returning its contents
+// too. The holder of a lock file that is still being written, or was left
+// half written, is unknown
+func readLock(path string) (*LockedError, []byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	holder := &LockedError{Path: path}
+
+	// "pid\nhost\nsince\n"
+	fields := strings.Split(string(contents), "\n")
+	if len(fields) == 4 && fields[3] == "" {
+		holder.PID, _ = strconv.Atoi(fields[0])
+		holder.Host = fields[1]
+		holder.Since, _ = time.Parse(time.RFC3339, fields[2])
+	}
+
+	if holder.PID == 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		holder.Since = info.ModTime()
+	}
+
+	return holder, contents, nil
+}
+
+// stale reports whether the process holding the lock is gone. Locks held
+// on other hosts are never stale, as there is no telling
+func (e *LockedError) stale() bool {
+	if e.PID == 0 {
+		return time.Since(e.Since) > lockAbandoned
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host != e.Host {
+		return false
+	}
+
+	return !processRunning(e.PID)
+}
+
+// processRunning reports whether the process pid is running. It errs
+// towards reporting processes as running where it can't tell
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	err = p.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone) && !errors.Is(err, syscall.ESRCH)
+}
+
+// breakLock removes the stale lock file at path, if it still has the
+// given contents, reporting whether it is worth trying to lock again
+// straight away. Processes finding it stale together take turns through a
+// guard file, so none of them removes a lock another took in between
+func breakLock(path string, contents []byte) bool {
+	guard := path + ".break"
+
+	f, err := os.OpenFile(guard, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		info, serr := os.Stat(guard)
+		if serr == nil && time.Since(info.ModTime()) > lockAbandoned {
+			os.Remove(guard)
+			return true
+		}
+		return false
+	}
+	f.Close()
+	defer os.Remove(guard)
+
+	current, err := ioutil.ReadFile(path)
+	if err == nil && string(current) == string(contents) {
+		os.Remove(path)
+	}
+
+	return true
+}
@@ -0,0 +1,132 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Observer is told about every operation on a repo: clone, open, fetch,
+// fetch-tags, checkout, pull, sync, push, update-submodules, update-cache
+// and ls-remote. Operations made up of others, such as sync, are reported
+// after each of their parts. repo is the repo's url, with credentials
+// redacted, or its path if it has no origin
+type Observer interface {
+	ObserveOperation(repo, op string, dur time.Duration, err error)
+}
+
+// OperationStats sums up the runs of an operation on a repo
+type OperationStats struct {
+	Repo     string
+	Op       string
+	Count    int
+	Failures int
+	// Total is the time taken by all runs, Last by the latest one
+	Total time.Duration
+	Last  time.Duration
+	// LastErr is the error the latest run failed with, if any
+	LastErr error
+}
+
+// Metrics is an Observer that keeps OperationStats in memory. It is safe
+// for concurrent use, so can be shared between repos
+type Metrics struct {
+	mu    sync.Mutex
+	stats map[[2]string]*OperationStats
+}
+
+// NewMetrics returns an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[[2]string]*OperationStats)}
+}
+
+// ObserveOperation records a run of op on repo
+func (m *Metrics) ObserveOperation(repo, op string, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{repo, op}
+
+	s, ok := m.stats[key]
+	if !ok {
+		s = &OperationStats{Repo: repo, Op: op}
+		m.stats[key] = s
+	}
+
+	s.Count++
+	if err != nil {
+		s.Failures++
+	}
+	s.Total += dur
+	s.Last = dur
+	s.LastErr = err
+}
+
+// Operation returns the stats for op on repo
+func (m *Metrics) Operation(repo, op string) OperationStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.stats[[2]string{repo, op}]
+	if !ok {
+		return OperationStats{Repo: repo, Op: op}
+	}
+
+	return *s
+}
+
+// Operations returns the stats for every operation seen, sorted by repo
+// and operation
+func (m *Metrics) Operations() []OperationStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make([]OperationStats, 0, len(m.stats))
+	for _, s := range m.stats {
+		stats = append(stats, *s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Repo != stats[j].Repo {
+			return stats[i].Repo < stats[j].Repo
+		}
+		return stats[i].Op < stats[j].Op
+	})
+
+	return stats
+}
+
+// Stats returns the stats for op on the repo, if its Observer is a
+// *Metrics
+func (r *Repo) Stats(op string) OperationStats {
+	m, ok := r.Observer.(*Metrics)
+	if !ok {
+		return OperationStats{Repo: r.label(), Op: op}
+	}
+
+	return m.Operation(r.label(), op)
+}
+
+// observe reports the operation op, started at start, to the repo's
+// Observer. err is a pointer so observe can be deferred
+func (r *Repo) observe(op string, start time.Time, err *error) {
+	if r.Observer == nil {
+		return
+	}
+
+	r.Observer.ObserveOperation(r.label(), op, time.Since(start), *err)
+}
+
+// label identifies the repo to its Observer
+func (r *Repo) label() string {
+	url := r.repoURL()
+	if url == "" {
+		return r.DeployPath()
+	}
+
+	return redactURL(url)
+}
@@ -0,0 +1,316 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// Option configures a Repo when it is cloned or opened. Settings that
+// affect later operations, such as the environment, are kept on the Repo
+// and apply to every git command it runs
+type Option func(*Repo)
+
+// WithDepth truncates the cloned history to the given number of commits
+// on every branch. Zero clones the full history
+func WithDepth(depth int) Option {
+	return func(r *Repo) {
+		r.depth = depth
+	}
+}
+
+// WithBranch checks out branch after cloning instead of the remote's HEAD
+func WithBranch(branch string) Option {
+	return func(r *Repo) {
+		r.branch = branch
+	}
+}
+
+// WithSingleBranch only clones the history of the branch set by
+// WithBranch, or of the remote's HEAD. Later fetches are restricted to
+// that branch
+func WithSingleBranch() Option {
+	return func(r *Repo) {
+		r.singleBranch = true
+	}
+}
+
+// WithDir clones the repo into the directory dir under the destination,
+// rather than one named after the repo
+func WithDir(dir string) Option {
+	return func(r *Repo) {
+		r.dir = dir
+	}
+}
+
+// WithBare clones the repo without a work tree. Operations that need a
+// work tree, such as Checkout and Pull, fail with ErrBareRepo
+func WithBare() Option {
+	return func(r *Repo) {
+		r.bare = true
+	}
+}
+
+// WithFilter makes a partial clone, omitting objects matching the filter
+// spec, e.g. "blob:none". Missing objects are fetched from the remote when
+// they are needed, such as on checkout. If the remote does not support
+// filters a full clone is made, and Filtered reports false
+func WithFilter(spec string) Option {
+	return func(r *Repo) {
+		r.filter = spec
+	}
+}
+
+// WithReference borrows objects from the local repo at cache when cloning,
+// such as one maintained by UpdateCache, to avoid fetching them from the
+// remote. Unless dissociate is set the clone keeps depending on the cache,
+// so it must not be deleted. A missing or corrupt cache is ignored
+func WithReference(cache string, dissociate bool) Option {
+	return func(r *Repo) {
+		r.reference = cache
+		r.dissociate = dissociate
+	}
+}
+
+// WithSubmodules clones submodules recursively, and makes Sync update them
+// after pulling
+func WithSubmodules() Option {
+	return func(r *Repo) {
+		r.submodules = true
+	}
+}
+
+// WithPrune removes remote-tracking branches, and tags if tags is true,
+// that no longer exist on the remote when fetching
+func WithPrune(tags bool) Option {
+	return func(r *Repo) {
+		r.Prune = true
+		r.PruneTags = tags
+	}
+}
+
+// WithSyncTags makes Sync fetch all tags from origin, updating any that
+// were moved there
+func WithSyncTags() Option {
+	return func(r *Repo) {
+		r.SyncTags = true
+	}
+}
+
+// WithAllowDirty lets Checkout and Sync run over uncommitted changes
+func WithAllowDirty() Option {
+	return func(r *Repo) {
+		r.AllowDirty = true
+	}
+}
+
+// WithDirtyUntracked makes untracked files count as uncommitted changes
+func WithDirtyUntracked() Option {
+	return func(r *Repo) {
+		r.DirtyUntracked = true
+	}
+}
+
+// WithAutoDeepen lets operations that need more history than a shallow
+// clone has fetch it and try again
+func WithAutoDeepen() Option {
+	return func(r *Repo) {
+		r.AutoDeepen = true
+	}
+}
+
+// WithProgress streams git's progress output from clone, fetch and pull
+// to w as it is written
+func WithProgress(w io.Writer) Option {
+	return func(r *Repo) {
+		r.Progress = w
+	}
+}
+
+// WithSSHKey authenticates with ssh remotes using the private key at path
+func WithSSHKey(path string) Option {
+	return func(r *Repo) {
+		r.SSHKeyPath = path
+	}
+}
+
+// WithTokenAuth authenticates with https remotes using username and
+// token. The token is supplied to git per invocation and never written to
+// disk, and only offered to origin's host
+func WithTokenAuth(username, token string) Option {
+	return func(r *Repo) {
+		r.TokenUsername = username
+		r.Token = token
+	}
+}
+
+// WithPrompts lets git prompt for credentials interactively, for use by
+// tools with a user at the terminal
+func WithPrompts() Option {
+	return func(r *Repo) {
+		r.AllowPrompts = true
+	}
+}
+
+// WithHostKeyPolicy sets whether ssh accepts the keys of hosts it has not
+// seen before
+func WithHostKeyPolicy(policy HostKeyPolicy) Option {
+	return func(r *Repo) {
+		r.HostKeyPolicy = policy
+	}
+}
+
+// WithKnownHosts trusts the host keys listed in the known_hosts file at
+// path, instead of the user's
+func WithKnownHosts(path string) Option {
+	return func(r *Repo) {
+		r.KnownHostsFile = path
+	}
+}
+
+// WithGnuPGHome checks signatures against the keyring in the gpg home
+// directory dir, instead of the user's
+func WithGnuPGHome(dir string) Option {
+	return func(r *Repo) {
+		r.GnuPGHome = dir
+	}
+}
+
+// WithAllowedSignersFile checks ssh signatures against the keys in the
+// allowed signers file at path
+func WithAllowedSignersFile(path string) Option {
+	return func(r *Repo) {
+		r.AllowedSignersFile = path
+	}
+}
+
+// WithAllowedSigners checks ssh signatures against the keys of signers
+func WithAllowedSigners(signers ...AllowedSigner) Option {
+	return func(r *Repo) {
+		r.AllowedSigners = append(r.AllowedSigners, signers...)
+	}
+}
+
+// WithRepo sets the url of the repo. Open checks the origin of the repo
+// it attaches to against it, as Clone does
+func WithRepo(url string) Option {
+	return func(r *Repo) {
+		r.Repo = url
+	}
+}
+
+// WithReconcile sets what Clone and Open do with an existing clone whose
+// origin url is not the repo's
+func WithReconcile(reconcile Reconcile) Option {
+	return func(r *Repo) {
+		r.Reconcile = reconcile
+	}
+}
+
+// WithGitBinary runs the git executable at path, instead of
+// DefaultGitBinary
+func WithGitBinary(path string) Option {
+	return func(r *Repo) {
+		r.GitBinary = path
+	}
+}
+
+// WithObserver reports how long each operation on the repo takes to
+// observer
+func WithObserver(observer Observer) Option {
+	return func(r *Repo) {
+		r.Observer = observer
+	}
+}
+
+// WithLogger tells logger about every git command run for the repo
+func WithLogger(logger Logger) Option {
+	return func(r *Repo) {
+		r.Logger = logger
+	}
+}
+
+// WithBeforeSync calls hook before every sync, which an error from it
+// aborts
+func WithBeforeSync(hook func(*Repo) error) Option {
+	return func(r *Repo) {
+		r.BeforeSync = hook
+	}
+}
+
+// WithAfterSync calls hook with what every successful sync did
+func WithAfterSync(hook func(*Repo, SyncResult) error) Option {
+	return func(r *Repo) {
+		r.AfterSync = hook
+	}
+}
+
+// WithOnError calls hook with the error of every sync that fails
+func WithOnError(hook func(*Repo, error)) Option {
+	return func(r *Repo) {
+		r.OnError = hook
+	}
+}
+
+// WithLockFile makes operations that change the repo hold a lock file, so
+// they don't run at the same time as those of other processes, waiting up
+// to wait for one held by another process
+func WithLockFile(wait time.Duration) Option {
+	return func(r *Repo) {
+		r.LockFile = true
+		r.LockWait = wait
+	}
+}
+
+// WithDryRun records the commands that would change the repo instead of
+// running them
+func WithDryRun() Option {
+	return func(r *Repo) {
+		r.DryRun = true
+	}
+}
+
+// WithRunner runs the repo's git commands through runner
+func WithRunner(runner Runner) Option {
+	return func(r *Repo) {
+		r.Runner = runner
+	}
+}
+
+// WithEnv adds environment variables, in the form "KEY=value", to every
+// git command run for the repo
+func WithEnv(env ...string) Option {
+	return func(r *Repo) {
+		if r.Env == nil {
+			r.Env = make(map[string]string)
+		}
+		for _, kv := range env {
+			kv := strings.SplitN(kv, "=", 2)
+			if len(kv) == 2 {
+				r.Env[kv[0]] = kv[1]
+			}
+		}
+	}
+}
+
+// WithTimeout bounds every git command run for the repo
+func WithTimeout(timeout time.Duration) Option {
+	return func(r *Repo) {
+		r.Timeout = timeout
+	}
+}
+
+// WithOperationTimeout bounds the given git subcommand, e.g. "clone",
+// overriding any timeout set with WithTimeout
+func WithOperationTimeout(op string, timeout time.Duration) Option {
+	return func(r *Repo) {
+		if r.Timeouts == nil {
+			r.Timeouts = make(map[string]time.Duration)
+		}
+		r.Timeouts[op] = timeout
+	}
+}
@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"strings"
+)
+
+// SignaturePolicy decides which commits are trusted, by their signatures
+type SignaturePolicy struct {
+	// AllowedFingerprints, if set, only trusts signatures made by these
+	// keys, or subkeys of them. gpg fingerprints are compared ignoring
+	// case
+	AllowedFingerprints []string
+	// AllowedSignersFile, if set, checks ssh signatures against this
+	// allowed signers file instead of the repo's
+	AllowedSignersFile string
+	// ExemptMerges trusts merge commits without checking their signature
+	ExemptMerges bool
+}
+
+// allows returns the error for a commit the policy doesn't trust, or nil
+// if it does
+func (p *SignaturePolicy) allows(c *CommitVerification) error {
+	if p.ExemptMerges && c.Merge {
+		return nil
+	}
+
+	perr := &PolicyError{Commit: c.ID, Author: c.Author, Status: c.Status, Fingerprint: c.Fingerprint}
+
+	if c.Status != SignatureGood {
+		return perr
+	}
+
+	if len(p.AllowedFingerprints) == 0 {
+		return nil
+	}
+
+	for _, fp := range p.AllowedFingerprints {
+		if sameFingerprint(fp, c.Fingerprint) || c.PrimaryFingerprint != "" && sameFingerprint(fp, c.PrimaryFingerprint) {
+			return nil
+		}
+	}
+
+	perr.Reason = "key is not allowed"
+	return perr
+}
+
+// sameFingerprint reports whether a and b are the same key's fingerprint.
+// gpg fingerprints are hex, so case doesn't matter, but ssh ones are
+// base64, where it does
+func sameFingerprint(a, b string) bool {
+	if strings.HasPrefix(a, sshFingerprintPrefix) || strings.HasPrefix(b, sshFingerprintPrefix) {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
+}
+
+// checkPolicy returns a *PolicyError for the oldest commit in rng, a git
+// log range such as "refs/heads/main..refs/remotes/origin/main", that
+// policy doesn't trust
+func (r *Repo) checkPolicy(ctx context.Context, policy *SignaturePolicy, rng string) error {
+	var violation error
+
+	check := func(c *CommitVerification) error {
+		violation = policy.allows(c)
+		if violation != nil {
+			return ErrStop
+		}
+		return nil
+	}
+
+	err := r.forEachVerification(ctx, policy.AllowedSignersFile, check, "--reverse", rng)
+	if err != nil {
+		return err
+	}
+	return violation
+}
@@ -0,0 +1,520 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// RemoteInfo describes a remote configured for a repo
+type RemoteInfo struct {
+	// FetchURL is fetched from, and PushURL pushed to. They are the same
+	// unless the remote has a pushurl configured
+	FetchURL string
+	PushURL  string
+}
+
+// Remotes returns the remotes configured for the repo, keyed by name, or
+// an empty map if there are none
+func (r *Repo) Remotes() (map[string]RemoteInfo, error) {
+	return r.RemotesContext(context.Background())
+}
+
+// RemotesContext returns the remotes configured for the repo, aborting if
+// ctx is done
+func (r *Repo) RemotesContext(ctx context.Context) (map[string]RemoteInfo, error) {
+	output, err := r.output(ctx, r.deploymentPath, "could not list remotes", "remote", "--verbose")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseRemotes(string(output)), nil
+}
+
+// parseRemotes reads the output of git remote --verbose, e.g.
+// "origin\thttps://github.com/r3labs/verify (fetch)"
+func parseRemotes(output string) map[string]RemoteInfo {
+	remotes := make(map[string]RemoteInfo)
+
+	for _, line := range strings.Split(output, "\n") {
+		f := strings.SplitN(line, "\t", 2)
+		if len(f) != 2 {
+			continue
+		}
+
+		name := f[0]
+		i := strings.LastIndex(f[1], " (")
+		if i < 0 {
+			continue
+		}
+		url, kind := f[1][:i], f[1][i:]
+
+		// only the first of several push urls is kept
+		remote := remotes[name]
+		switch {
+		case kind == " (fetch)":
+			remote.FetchURL = url
+		case kind == " (push)" && remote.PushURL == "":
+			remote.PushURL = url
+		}
+		remotes[name] = remote
+	}
+
+	return remotes
+}
+
+// LsRemote lists the refs of the remote repo at url, mapping each ref name,
+// e.g. "refs/heads/main", to the id it points to, without cloning it. The
+// remote's HEAD is listed as "HEAD", and the commits annotated tags point
+// to with a "^{}" suffix, e.g. "refs/tags/v1.0.0^{}". opts configure
+// authentication and timeouts as they do for Clone
+func LsRemote(url string, opts ...Option) (map[string]string, error) {
+	return LsRemoteContext(context.Background(), url, opts...)
+}
+
+// LsRemoteContext lists the refs of the remote repo at url, aborting if
+// ctx is done
+func LsRemoteContext(ctx context.Context, url string, opts ...Option) (map[string]string, error) {
+	refs, _, err := lsRemoteURL(ctx, url, opts)
+	return refs, err
+}
+
+// RemoteDefaultBranch returns the branch the HEAD of the remote repo at
+// url points to, e.g. "main", without cloning it. It fails with
+// ErrBranchNotFound if the remote's HEAD isn't a branch
+func RemoteDefaultBranch(url string, opts ...Option) (string, error) {
+	return RemoteDefaultBranchContext(context.Background(), url, opts...)
+}
+
+// RemoteDefaultBranchContext returns the branch the HEAD of the remote
+// repo at url points to, aborting if ctx is done
+func RemoteDefaultBranchContext(ctx context.Context, url string, opts ...Option) (string, error) {
+	_, head, err := lsRemoteURL(ctx, url, opts, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if head == "" {
+		return "", fmt.Errorf("could not read default branch of %s: %w", redactURL(url), ErrBranchNotFound)
+	}
+
+	return head, nil
+}
+
+// AccessTimeout bounds CheckAccess when no timeout is set for ls-remote,
+// WithTimeout or WithOperationTimeout
+var AccessTimeout = 10 * time.Second
+
+// CheckAccess checks that the remote repo at url can be read with the
+// credentials configured by opts, without cloning it or writing anything
+// to disk. Failures match ErrAuthFailed, ErrRepoNotFound, ErrHostNotFound
+// or ErrNetwork where git's output says why. It gives up after
+// AccessTimeout unless opts set a timeout of their own
+func CheckAccess(url string, opts ...Option) error {
+	return CheckAccessContext(context.Background(), url, opts...)
+}
+
+// CheckAccessContext checks that the remote repo at url can be read,
+// aborting if ctx is done
+func CheckAccessContext(ctx context.Context, url string, opts ...Option) error {
+	bounded := func(r *Repo) {
+		if r.timeout("ls-remote") == 0 {
+			WithOperationTimeout("ls-remote", AccessTimeout)(r)
+		}
+	}
+
+	// listing only HEAD keeps the check cheap on repos with many refs
+	_, _, err := lsRemoteURL(ctx, url, append(opts, bounded), "HEAD")
+	return err
+}
+
+// lsRemoteURL lists the refs of the remote repo at url matching patterns,
+// and the branch its HEAD points to
+func lsRemoteURL(ctx context.Context, url string, opts []Option, patterns ...string) (refs map[string]string, head string, err error) {
+	r := Repo{Repo: url}
+	for _, opt := range opts {
+		opt(&r)
+	}
+
+	defer r.observe("ls-remote", time.Now(), &err)
+
+	err = checkURL(url)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = r.lookGit()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return r.lsRemote(ctx, "", "could not list refs of "+redactURL(url), url, patterns...)
+}
+
+// lsRemote runs ls-remote against remote in dir, returning the refs it
+// lists matching patterns, and the branch the remote's HEAD points to if
+// HEAD was listed
+func (r *Repo) lsRemote(ctx context.Context, dir, msg, remote string, patterns ...string) (map[string]string, string, error) {
+	output, err := r.output(ctx, dir, msg, append([]string{"ls-remote", "--symref", remote}, patterns...)...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	refs := make(map[string]string)
+	var head string
+
+	// "<id>	<ref>", preceded by "ref: refs/heads/main	HEAD" for HEAD
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD":
+			head = strings.TrimPrefix(fields[1], "refs/heads/")
+		case len(fields) == 2:
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	return refs, head, nil
+}
+
+// RemoteOptions configures AddRemoteWithOptions
+type RemoteOptions struct {
+	// Fetch fetches from the remote once it is added, so its
+	// remote-tracking branches exist straight away
+	Fetch bool
+}
+
+// AddRemote adds the remote name, fetching from url. It fails with
+// ErrRemoteExists if there already is a remote of that name, and with
+// ErrInvalidURL if url is not one git could fetch
+func (r *Repo) AddRemote(name, url string) error {
+	return r.AddRemoteWithOptionsContext(context.Background(), name, url, RemoteOptions{})
+}
+
+// AddRemoteContext adds the remote name, aborting if ctx is done
+func (r *Repo) AddRemoteContext(ctx context.Context, name, url string) error {
+	return r.AddRemoteWithOptionsContext(ctx, name, url, RemoteOptions{})
+}
+
+// AddRemoteWithOptions adds the remote name, as configured by opts. If
+// fetching fails the remote is kept
+func (r *Repo) AddRemoteWithOptions(name, url string, opts RemoteOptions) error {
+	return r.AddRemoteWithOptionsContext(context.Background(), name, url, opts)
+}
+
+// AddRemoteWithOptionsContext adds the remote name, as configured by opts,
+// aborting if ctx is done
+func (r *Repo) AddRemoteWithOptionsContext(ctx context.Context, name, url string, opts RemoteOptions) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = checkURL(url)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not add remote "+name, "remote", "add", name, url)
+	if err != nil {
+		return err
+	}
+
+	if opts.Fetch {
+		return r.FetchRemoteContext(ctx, name)
+	}
+
+	return nil
+}
+
+// RemoveRemote removes the remote name, along with its remote-tracking
+// branches. Branches that tracked it, even the checked out one, are left
+// without an upstream, so Sync pulls them from origin's branch of the
+// same name. It fails with ErrRemoteNotFound if there is no such remote
+func (r *Repo) RemoveRemote(name string) error {
+	return r.RemoveRemoteContext(context.Background(), name)
+}
+
+// RemoveRemoteContext removes the remote name, aborting if ctx is done
+func (r *Repo) RemoveRemoteContext(ctx context.Context, name string) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not remove remote "+name, "remote", "remove", name)
+	return err
+}
+
+// RemoteURL returns the url fetched from for the remote name. It fails
+// with ErrRemoteNotFound if there is no such remote
+func (r *Repo) RemoteURL(name string) (string, error) {
+	return r.RemoteURLContext(context.Background(), name)
+}
+
+// RemoteURLContext returns the url fetched from for the remote name,
+// aborting if ctx is done
+func (r *Repo) RemoteURLContext(ctx context.Context, name string) (string, error) {
+	return r.remoteURL(ctx, name, false)
+}
+
+// RemotePushURL returns the url pushed to for the remote name, which is
+// its fetch url unless it has a push url of its own
+func (r *Repo) RemotePushURL(name string) (string, error) {
+	return r.RemotePushURLContext(context.Background(), name)
+}
+
+// RemotePushURLContext returns the url pushed to for the remote name,
+// aborting if ctx is done
+func (r *Repo) RemotePushURLContext(ctx context.Context, name string) (string, error) {
+	return r.remoteURL(ctx, name, true)
+}
+
+func (r *Repo) remoteURL(ctx context.Context, name string, push bool) (string, error) {
+	args := []string{"remote", "get-url"}
+	if push {
+		args = append(args, "--push")
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not get url of remote "+name, append(args, name)...)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// SetRemoteURL changes the url the remote name is fetched from, and pushed
+// to unless it has a push url of its own. Setting origin's url changes the
+// repo's Repo too, which read-only operations running meanwhile may see
+// either side of. It fails with ErrInvalidURL if url is not one git
+// could fetch, and with ErrRemoteNotFound if there is no such remote
+func (r *Repo) SetRemoteURL(name, url string) error {
+	return r.SetRemoteURLContext(context.Background(), name, url)
+}
+
+// SetRemoteURLContext changes the url the remote name is fetched from,
+// aborting if ctx is done
+func (r *Repo) SetRemoteURLContext(ctx context.Context, name, url string) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return r.setRemoteURL(ctx, name, url, false)
+}
+
+// SetRemotePushURL changes the url the remote name is pushed to, leaving
+// the one it is fetched from
+func (r *Repo) SetRemotePushURL(name, url string) error {
+	return r.SetRemotePushURLContext(context.Background(), name, url)
+}
+
+// SetRemotePushURLContext changes the url the remote name is pushed to,
+// aborting if ctx is done
+func (r *Repo) SetRemotePushURLContext(ctx context.Context, name, url string) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return r.setRemoteURL(ctx, name, url, true)
+}
+
+func (r *Repo) setRemoteURL(ctx context.Context, name, url string, push bool) error {
+	err := checkURL(url)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"remote", "set-url"}
+	if push {
+		args = append(args, "--push")
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not set url of remote "+name, append(args, name, url)...)
+	if err != nil {
+		return err
+	}
+
+	if name == "origin" && !push {
+		r.setRepoURL(url)
+	}
+
+	return nil
+}
+
+// urlSchemes are the schemes of the urls git can fetch from natively
+var urlSchemes = map[string]bool{
+	"ssh":     true,
+	"git+ssh": true,
+	"ssh+git": true,
+	"git":     true,
+	"http":    true,
+	"https":   true,
+	"ftp":     true,
+	"ftps":    true,
+	"file":    true,
+}
+
+// checkURL returns an ErrInvalidURL error unless rawurl has the shape of
+// a url git can fetch from: a url with a known scheme, an scp-like
+// address such as "git@github.com:r3labs/verify.git", or a path
+func checkURL(rawurl string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%q %s: %w", redactURL(rawurl), reason, ErrInvalidURL)
+	}
+
+	switch {
+	case rawurl == "":
+		return invalid("is empty")
+	case strings.HasPrefix(rawurl, "-"):
+		return invalid("looks like an option")
+	case strings.IndexFunc(rawurl, unicode.IsControl) >= 0:
+		return invalid("contains control characters")
+	case !strings.Contains(rawurl, "://"):
+		return nil
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return invalid("can't be parsed")
+	}
+	if !urlSchemes[strings.ToLower(u.Scheme)] {
+		return invalid("has an unsupported scheme")
+	}
+	if u.Host == "" && u.Scheme != "file" {
+		return invalid("has no host")
+	}
+
+	return nil
+}
+
+// Reconcile decides what Clone and Open do with an existing clone whose
+// origin url is not the repo's
+type Reconcile int
+
+const (
+	// ReconcileNone fails with an *OriginMismatchError
+	ReconcileNone Reconcile = iota
+	// ReconcileURL points origin at the repo's url, keeping the clone and
+	// any local branches in it. The next fetch brings in the new origin's
+	// history
+	ReconcileURL
+	// ReconcileReclone removes the clone, with any local changes, and
+	// clones the repo afresh
+	ReconcileReclone
+)
+
+// origin returns the url of the clone's origin remote, or "" if it has
+// none. It is read from the clone's own config, so that a directory
+// inside some other repo isn't taken for a clone of that repo
+func (r *Repo) origin(ctx context.Context) (string, error) {
+	config := filepath.Join(r.gitDir(), "config")
+
+	_, err := os.Stat(config)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", r.deploymentPath, ErrNotRepository)
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not read origin url", "config", "--file", config, "remote.origin.url")
+	ok, err := exitStatus(err, 1)
+	if !ok {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// reconcile deals with a clone whose origin url is origin rather than
+// Repo as Reconcile says, reporting whether the clone should be replaced
+func (r *Repo) reconcile(ctx context.Context, origin string) (bool, error) {
+	want := r.repoURL()
+
+	switch r.Reconcile {
+	case ReconcileURL:
+		if origin == "" {
+			return false, r.AddRemoteContext(ctx, "origin", want)
+		}
+		return false, r.setRemoteURL(ctx, "origin", want, false)
+	case ReconcileReclone:
+		return true, nil
+	}
+
+	return false, &OriginMismatchError{Path: r.deploymentPath, Want: want, Got: origin}
+}
+
+// defaultPorts are the ports urls of each scheme use when they give none
+var defaultPorts = map[string]string{
+	"ssh":     "22",
+	"git+ssh": "22",
+	"ssh+git": "22",
+	"git":     "9418",
+	"http":    "80",
+	"https":   "443",
+	"ftp":     "21",
+	"ftps":    "990",
+}
+
+// sameURL reports whether a and b are urls of the same repo, e.g.
+// "git@github.com:r3labs/verify.git" and "https://github.com/r3labs/verify"
+func sameURL(a, b string) bool {
+	return normalizeURL(a) == normalizeURL(b)
+}
+
+// normalizeURL reduces rawurl to the host and path of the repo it names,
+// dropping the scheme, user, default port and any .git suffix. Local
+// paths are made absolute
+func normalizeURL(rawurl string) string {
+	var host, path string
+
+	switch colon := strings.Index(rawurl, ":"); {
+	case strings.Contains(rawurl, "://"):
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return rawurl
+		}
+
+		scheme := strings.ToLower(u.Scheme)
+		if scheme == "file" {
+			return localPath(u.Path)
+		}
+
+		host = u.Hostname()
+		if port := u.Port(); port != "" && port != defaultPorts[scheme] {
+			host += ":" + port
+		}
+		path = u.Path
+	case colon > 1 && !strings.ContainsAny(rawurl[:colon], "/\\"):
+		// scp-like addresses, but not windows drive letters
+		host = rawurl[strings.LastIndex(rawurl[:colon], "@")+1 : colon]
+		path = rawurl[colon+1:]
+	default:
+		return localPath(rawurl)
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.ToLower(host) + "/" + strings.TrimSuffix(path, "/")
+}
+
+// localPath cleans path and makes it absolute, as git records the urls of
+// local clones
+func localPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
@@ -0,0 +1,58 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSameURL(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+		// windows cases only hold where backslashes separate paths
+		windows bool
+	}{
+		{a: "https://github.com/r3labs/verify", b: "https://github.com/r3labs/verify/", want: true},
+		{a: "https://github.com/r3labs/verify.git/", b: "git@github.com:r3labs/verify", want: true},
+		{a: "ssh://git@github.com:22/r3labs/verify.git", b: "git@github.com:r3labs/verify.git/", want: true},
+		{a: "https://GitHub.com/r3labs/verify", b: "https://github.com/r3labs/verify", want: true},
+		{a: "https://github.com:443/r3labs/verify", b: "https://github.com/r3labs/verify", want: true},
+		{a: "https://github.com:8443/r3labs/verify", b: "https://github.com/r3labs/verify", want: false},
+		{a: "https://github.com/r3labs/verify", b: "https://github.com/r3labs/other", want: false},
+		{a: "https://github.com/r3labs/verify", b: "https://gitlab.com/r3labs/verify", want: false},
+		{a: "/srv/repos/verify.git", b: "/srv/repos/verify.git/", want: true},
+		{a: "/srv/repos/verify.git", b: "/srv/repos//verify.git", want: true},
+		{a: "/srv/repos/old/../verify.git", b: "/srv/repos/verify.git", want: true},
+		{a: "/srv/repos/verify.git", b: "file:///srv/repos/verify.git", want: true},
+		{a: "/srv/repos/verify.git", b: "/srv/repos/other.git", want: false},
+		{a: `C:\repos\verify.git`, b: `C:\repos\verify.git\`, want: true, windows: true},
+		{a: `C:\repos\verify.git`, b: `C:/repos/verify.git`, want: true, windows: true},
+		{a: `C:\repos\verify.git`, b: `D:\repos\verify.git`, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			if tt.windows && runtime.GOOS != "windows" {
+				t.Skip("windows paths")
+			}
+
+			if got := sameURL(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameURL() = %v, want %v (%q, %q)", got, tt.want, normalizeURL(tt.a), normalizeURL(tt.b))
+			}
+		})
+	}
+}
+
+func TestNormalizeURLDriveLetter(t *testing.T) {
+	// a drive letter is not the host of an scp-like address
+	for _, path := range []string{`C:\repos\verify.git`, `C:/repos/verify.git`} {
+		if got := normalizeURL(path); strings.HasPrefix(strings.ToLower(got), "c/") {
+			t.Errorf("normalizeURL(%q) = %q, want a local path", path, got)
+		}
+	}
+}
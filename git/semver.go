@@ -0,0 +1,108 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// semverPattern matches a semantic version, e.g. "1.2.0-rc.1+build.5",
+// optionally prefixed with "v"
+var semverPattern = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?$`)
+
+// semver is a parsed semantic version. Build metadata is dropped, as it
+// doesn't affect precedence
+type semver struct {
+	release    [3]uint64
+	prerelease []string
+}
+
+// parseSemver parses s, reporting whether it is a semantic version
+func parseSemver(s string) (semver, bool) {
+	m := semverPattern.FindStringSubmatch(s)
+	if m == nil {
+		return semver{}, false
+	}
+
+	var v semver
+	for i := range v.release {
+		n, err := strconv.ParseUint(m[i+1], 10, 64)
+		if err != nil {
+			return semver{}, false
+		}
+		v.release[i] = n
+	}
+
+	if m[4] != "" {
+		v.prerelease = strings.Split(m[4], ".")
+	}
+
+	return v, true
+}
+
+// compare returns -1, 0 or 1 as v has lower, equal or higher precedence
+// than o
+func (v semver) compare(o semver) int {
+	for i := range v.release {
+		switch {
+		case v.release[i] < o.release[i]:
+			return -1
+		case v.release[i] > o.release[i]:
+			return 1
+		}
+	}
+
+	// a pre-release sorts below its release
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		c := compareIdentifier(v.prerelease[i], o.prerelease[i])
+		if c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(v.prerelease) < len(o.prerelease):
+		return -1
+	case len(v.prerelease) > len(o.prerelease):
+		return 1
+	}
+
+	return 0
+}
+
+// compareIdentifier compares pre-release identifiers: numeric ones
+// numerically and below alphanumeric ones, which compare lexically
+func compareIdentifier(a, b string) int {
+	an, aerr := strconv.ParseUint(a, 10, 64)
+	bn, berr := strconv.ParseUint(b, 10, 64)
+
+	switch {
+	case aerr == nil && berr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,479 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SignatureStatus is the outcome of checking a signature
+type SignatureStatus int
+
+const (
+	// SignatureUnsigned is reported for commits and tags without a
+	// signature
+	SignatureUnsigned SignatureStatus = iota
+	// SignatureGood is a valid signature from a trusted key
+	SignatureGood
+	// SignatureUntrusted is a valid signature from a key that isn't
+	// trusted: a gpg key of unknown validity, or an ssh key that isn't an
+	// allowed signer
+	SignatureUntrusted
+	// SignatureUnknownKey is a signature that can't be checked, usually
+	// because the key is missing from the keyring
+	SignatureUnknownKey
+	// SignatureExpired is a valid signature that has expired, or was made
+	// by a key that has
+	SignatureExpired
+	// SignatureRevoked is a valid signature made by a revoked key
+	SignatureRevoked
+	// SignatureBad is a signature that doesn't match what was signed
+	SignatureBad
+)
+
+func (s SignatureStatus) String() string {
+	switch s {
+	case SignatureGood:
+		return "good"
+	case SignatureUntrusted:
+		return "untrusted"
+	case SignatureUnknownKey:
+		return "unknown key"
+	case SignatureExpired:
+		return "expired"
+	case SignatureRevoked:
+		return "revoked"
+	case SignatureBad:
+		return "bad"
+	}
+	return "unsigned"
+}
+
+// signatureStatuses maps git's %G? placeholder to the status it stands for
+var signatureStatuses = map[string]SignatureStatus{
+	"G": SignatureGood,
+	"U": SignatureUntrusted,
+	"E": SignatureUnknownKey,
+	"X": SignatureExpired,
+	"Y": SignatureExpired,
+	"R": SignatureRevoked,
+	"B": SignatureBad,
+	"N": SignatureUnsigned,
+}
+
+// AllowedSigner is a key trusted to make ssh signatures
+type AllowedSigner struct {
+	// Principal names the signer, e.g. "jo@r3labs.io"
+	Principal string
+	// Key is the signer's public key, as in an authorized_keys file, e.g.
+	// "ssh-ed25519 AAAAC3Nza..."
+	Key string
+}
+
+// SignatureInfo describes the signature on a commit or tag
+type SignatureInfo struct {
+	// ID is the id of the signed commit or tag object
+	ID     string
+	Status SignatureStatus
+	// Fingerprint is the fingerprint of the signing key, and
+	// PrimaryFingerprint that of its primary key, if it is a subkey
+	Fingerprint        string
+	PrimaryFingerprint string
+	// KeyID is the id of the signing key, which is known even when the
+	// key isn't
+	KeyID string
+	// Signer is the identity the key belongs to, e.g. "Jo <jo@r3labs.io>"
+	Signer string
+	// Principal is the allowed signers principal an ssh signature's key
+	// matched. A valid ssh signature from a key that isn't allowed has
+	// none, and the status SignatureUntrusted
+	Principal string
+	// Raw is the output of checking the signature, for audit logs
+	Raw string
+}
+
+// Good reports whether the signature is valid and from a trusted key
+func (s *SignatureInfo) Good() bool {
+	return s.Status == SignatureGood
+}
+
+// sshFingerprintPrefix starts the fingerprints of ssh keys, unlike those
+// of gpg keys, which are hex
+const sshFingerprintPrefix = "SHA256:"
+
+// signersKey is the context key for an allowed signers file that
+// replaces the repo's for the commands run with the context
+type signersKey struct{}
+
+// allowedSignersFile returns the allowed signers file ssh signatures are
+// checked against by commands run with ctx, if there is one
+func (r *Repo) allowedSignersFile(ctx context.Context) string {
+	if signers, ok := ctx.Value(signersKey{}).(string); ok {
+		return signers
+	}
+	if r.AllowedSignersFile != "" {
+		return r.AllowedSignersFile
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.signersFile
+}
+
+// withAllowedSigners runs fn with the repo's AllowedSigners written to a
+// temporary allowed signers file, if it lists them directly and ctx
+// doesn't replace them. The file is shared by every fn running at the
+// time, and removed after the last
+func (r *Repo) withAllowedSigners(ctx context.Context, fn func() error) error {
+	_, replaced := ctx.Value(signersKey{}).(string)
+	if replaced || r.AllowedSignersFile != "" || len(r.AllowedSigners) == 0 {
+		return fn()
+	}
+
+	err := r.acquireSigners()
+	if err != nil {
+		return err
+	}
+	defer r.releaseSigners()
+
+	return fn()
+}
+
+// acquireSigners writes the repo's AllowedSigners to the allowed signers
+// file, unless an fn run by withAllowedSigners already has
+func (r *Repo) acquireSigners() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.signersFile != "" {
+		r.signersUsers++
+		return nil
+	}
+
+	f, err := ioutil.TempFile("", "allowed-signers")
+	if err != nil {
+		return fmt.Errorf("could not write allowed signers: %w", err)
+	}
+
+	for _, s := range r.AllowedSigners {
+		_, err = fmt.Fprintf(f, "%s %s\n", s.Principal, s.Key)
+		if err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("could not write allowed signers: %w", err)
+	}
+
+	r.signersFile = f.Name()
+	r.signersUsers++
+	return nil
+}
+
+// releaseSigners is called when an fn run by withAllowedSigners returns,
+// removing the allowed signers file once none are left using it
+func (r *Repo) releaseSigners() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.signersUsers--
+	if r.signersUsers == 0 {
+		os.Remove(r.signersFile)
+		r.signersFile = ""
+	}
+}
+
+// signatureFormat has git log write each field of a commit's signature
+// NUL terminated
+const signatureFormat = "--format=%H%x00%G?%x00%GF%x00%GP%x00%GK%x00%GS%x00%GG"
+
+// signatureFields is the number of fields signatureFormat writes per
+// commit
+const signatureFields = 7
+
+// VerifyCommit checks the signature on the commit ref names, against the
+// keys in the keyring of the repo's GnuPGHome, or the user's, or for ssh
+// signatures the repo's allowed signers, or git's. Without allowed
+// signers, ssh signatures appear unsigned. An unsigned commit isn't an
+// error, it is reported with the status SignatureUnsigned, so that
+// callers can apply their own policy. ErrRefNotFound is returned if ref
+// doesn't name a commit
+func (r *Repo) VerifyCommit(ref string) (*SignatureInfo, error) {
+	return r.VerifyCommitContext(context.Background(), ref)
+}
+
+// VerifyCommitContext checks the signature on the commit ref names,
+// aborting if ctx is done
+func (r *Repo) VerifyCommitContext(ctx context.Context, ref string) (*SignatureInfo, error) {
+	id, err := r.CommitIDForContext(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var output []byte
+	err = r.withAllowedSigners(ctx, func() error {
+		output, err = r.output(ctx, r.deploymentPath, "could not verify commit "+ref, "log", "-z", "-1", signatureFormat, id, "--")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(string(output), "\x00")
+	if len(fields) < signatureFields {
+		return nil, fmt.Errorf("could not verify commit %s: unexpected output from git", ref)
+	}
+
+	return parseSignature(fields[:signatureFields]), nil
+}
+
+// VerifyTag checks the signature on the tag name, against the same keys as
+// VerifyCommit. Lightweight tags, and
+// annotated tags without a signature, are reported with the status
+// SignatureUnsigned rather than as errors. Raw holds gpg's status lines.
+// ErrTagNotFound is returned if there is no such local tag
+func (r *Repo) VerifyTag(name string) (*SignatureInfo, error) {
+	return r.VerifyTagContext(context.Background(), name)
+}
+
+// VerifyTagContext checks the signature on the tag name, aborting if ctx
+// is done
+func (r *Repo) VerifyTagContext(ctx context.Context, name string) (*SignatureInfo, error) {
+	tags, err := r.listTags(ctx, "refs/tags/"+name)
+	if err != nil {
+		return nil, err
+	}
+
+	// for-each-ref patterns also match whole path components, e.g.
+	// "release" matches "release/v1"
+	var tag *Tag
+	for i := range tags {
+		if tags[i].Name == name {
+			tag = &tags[i]
+		}
+	}
+	if tag == nil {
+		return nil, fmt.Errorf("could not verify tag %s: %w", name, ErrTagNotFound)
+	}
+
+	info := &SignatureInfo{ID: tag.ID}
+	if !tag.Annotated {
+		return info, nil
+	}
+
+	var stderr []byte
+	err = r.withAllowedSigners(ctx, func() error {
+		_, stderr, err = r.run(ctx, r.deploymentPath, "could not verify tag "+name, "verify-tag", "--raw", "refs/tags/"+name)
+		return err
+	})
+
+	switch {
+	case bytes.Contains(stderr, []byte("[GNUPG:] ")):
+		parseGPGStatus(info, string(stderr))
+	case bytes.Contains(stderr, []byte(`"git" signature`)), bytes.Contains(stderr, []byte("Signature verification failed")):
+		parseSSHStatus(info, string(stderr))
+	case err == nil, bytes.Contains(stderr, []byte("no signature found")):
+	default:
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// parseSSHStatus fills in info from what ssh-keygen said checking a
+// signature, as git verify-tag passes it on
+func parseSSHStatus(info *SignatureInfo, status string) {
+	info.Status = SignatureBad
+	info.Raw = strings.TrimSpace(status)
+
+	for _, line := range strings.Split(status, "\n") {
+		// `Good "git" signature for jo@r3labs.io with ED25519 key SHA256:...`,
+		// or without "for <principal>" if the key isn't allowed
+		if !strings.HasPrefix(line, `Good "git" signature `) {
+			continue
+		}
+
+		f := strings.Fields(strings.TrimPrefix(line, `Good "git" signature `))
+		if len(f) > 0 && strings.HasPrefix(f[len(f)-1], sshFingerprintPrefix) {
+			info.Fingerprint = f[len(f)-1]
+			info.KeyID = info.Fingerprint
+		}
+
+		info.Status = SignatureUntrusted
+		if len(f) > 1 && f[0] == "for" {
+			info.Status = SignatureGood
+			info.Principal = f[1]
+			info.Signer = f[1]
+		}
+	}
+}
+
+// parseGPGStatus fills in info from gpg's machine readable status lines,
+// as git verify-tag --raw passes them on
+func parseGPGStatus(info *SignatureInfo, status string) {
+	var raw []string
+
+	for _, line := range strings.Split(status, "\n") {
+		if !strings.HasPrefix(line, "[GNUPG:] ") {
+			continue
+		}
+		raw = append(raw, line)
+
+		f := strings.Fields(strings.TrimPrefix(line, "[GNUPG:] "))
+		if len(f) < 2 {
+			continue
+		}
+
+		switch f[0] {
+		case "GOODSIG", "BADSIG", "EXPSIG", "EXPKEYSIG", "REVKEYSIG":
+			info.Status = gpgStatuses[f[0]]
+			info.KeyID = f[1]
+			// "[GNUPG:] GOODSIG <keyid> <uid>", where uid may contain
+			// spaces
+			if len(f) > 2 {
+				info.Signer = strings.SplitN(line, " ", 4)[3]
+			}
+		case "ERRSIG":
+			info.Status = SignatureUnknownKey
+			info.KeyID = f[1]
+			if len(f) > 7 {
+				info.Fingerprint = f[7]
+			}
+		case "VALIDSIG":
+			info.Fingerprint = f[1]
+			if len(f) > 10 {
+				info.PrimaryFingerprint = f[10]
+			}
+		case "TRUST_UNDEFINED", "TRUST_NEVER":
+			if info.Status == SignatureGood {
+				info.Status = SignatureUntrusted
+			}
+		}
+	}
+
+	info.Raw = strings.Join(raw, "\n")
+}
+
+// gpgStatuses maps gpg's status keywords to the status they stand for
+var gpgStatuses = map[string]SignatureStatus{
+	"GOODSIG":   SignatureGood,
+	"BADSIG":    SignatureBad,
+	"EXPSIG":    SignatureExpired,
+	"EXPKEYSIG": SignatureExpired,
+	"REVKEYSIG": SignatureRevoked,
+}
+
+// CommitVerification is the signature on a commit in a range checked by
+// VerifyRange
+type CommitVerification struct {
+	SignatureInfo
+	// Author is the commit's author, e.g. "Jo <jo@r3labs.io>"
+	Author string
+	// Merge is set for merge commits
+	Merge bool
+}
+
+// CommitVerifications are the results of verifying a range of commits
+type CommitVerifications []CommitVerification
+
+// AllGood reports whether every commit has a good signature
+func (v CommitVerifications) AllGood() bool {
+	for i := range v {
+		if !v[i].Good() {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyRange checks the signatures on the commits reachable from to but
+// not from from, like VerifyCommit does, returning them in git log order,
+// newest first. Signatures are all checked by a single git command,
+// however many commits there are. ErrRefNotFound is returned if either
+// ref doesn't name a commit
+func (r *Repo) VerifyRange(from, to string) (CommitVerifications, error) {
+	return r.VerifyRangeContext(context.Background(), from, to)
+}
+
+// VerifyRangeContext checks the signatures on the commits reachable from to
+// but not from from, aborting if ctx is done
+func (r *Repo) VerifyRangeContext(ctx context.Context, from, to string) (CommitVerifications, error) {
+	for _, ref := range []string{from, to} {
+		_, err := r.CommitIDForContext(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := CommitVerifications{}
+	err := r.forEachVerification(ctx, "", func(c *CommitVerification) error {
+		results = append(results, *c)
+		return nil
+	}, from+".."+to)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// verificationFormat has git log write a commit's signature, followed by
+// its parents and author
+const verificationFormat = signatureFormat + "%x00%P%x00%an <%ae>"
+
+// verificationFields is the number of fields verificationFormat writes per
+// commit
+const verificationFields = signatureFields + 2
+
+// forEachVerification calls fn with the signature on each commit git log
+// selects with args, as git checks them. ssh signatures are checked
+// against signersFile, if set, instead of the repo's allowed signers
+func (r *Repo) forEachVerification(ctx context.Context, signersFile string, fn func(*CommitVerification) error, args ...string) error {
+	args = append(append([]string{"log", "-z", verificationFormat}, args...), "--")
+
+	if signersFile != "" {
+		ctx = context.WithValue(ctx, signersKey{}, signersFile)
+	}
+
+	return r.withAllowedSigners(ctx, func() error {
+		return r.forEachRecord(ctx, "could not verify commits", verificationFields, args, func(f []string) error {
+			return fn(&CommitVerification{
+				SignatureInfo: *parseSignature(f[:signatureFields]),
+				Merge:         len(strings.Fields(f[signatureFields])) > 1,
+				Author:        f[signatureFields+1],
+			})
+		})
+	})
+}
+
+// parseSignature reads a signature from its signatureFormat fields
+func parseSignature(f []string) *SignatureInfo {
+	info := &SignatureInfo{
+		ID:                 f[0],
+		Status:             signatureStatuses[f[1]],
+		Fingerprint:        f[2],
+		PrimaryFingerprint: f[3],
+		KeyID:              f[4],
+		Signer:             f[5],
+		Raw:                strings.TrimSuffix(f[6], "\n"),
+	}
+
+	// git reports the principal as the signer of ssh signatures
+	if strings.HasPrefix(info.Fingerprint, sshFingerprintPrefix) {
+		info.Principal = info.Signer
+	}
+
+	return info
+}
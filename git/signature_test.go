@@ -0,0 +1,157 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/r3labs/verify/git"
+)
+
+// signingKey generates an ssh key to sign with, returning the path to its
+// private key and an allowed signers file trusting it for
+// test@example.com. Tests are skipped where there is no ssh-keygen
+func signingKey(t *testing.T) (string, string) {
+	t.Helper()
+
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	dir := t.TempDir()
+	key := filepath.Join(dir, "id_ed25519")
+
+	output, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "test", "-f", key).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen: %v\n%s", err, output)
+	}
+
+	pub, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers := filepath.Join(dir, "allowed_signers")
+	err = ioutil.WriteFile(signers, []byte("test@example.com "+string(pub)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, signers
+}
+
+// signed runs git in dir, signing with the ssh key
+func signed(t *testing.T, dir, key string, args ...string) string {
+	t.Helper()
+	return run(t, dir, append([]string{"-c", "gpg.format=ssh", "-c", "user.signingkey=" + key}, args...)...)
+}
+
+func TestVerifyTagUnsigned(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url)
+
+	err := r.Tag("v1.0.1", "", "")
+	if err != nil {
+		t.Fatalf("Tag() = %v", err)
+	}
+	err = r.Tag("v1.0.2", "", "not signed")
+	if err != nil {
+		t.Fatalf("Tag() = %v", err)
+	}
+
+	for _, name := range []string{"v1.0.1", "v1.0.2"} {
+		info, err := r.VerifyTag(name)
+		if err != nil || info.Status != git.SignatureUnsigned {
+			t.Errorf("VerifyTag(%s) = %+v, %v, want it unsigned", name, info, err)
+		}
+	}
+
+	_, err = r.VerifyTag("v2.0.0")
+	if !errors.Is(err, git.ErrTagNotFound) {
+		t.Errorf("VerifyTag() of a missing tag = %v, want ErrTagNotFound", err)
+	}
+}
+
+func TestVerifyTagSSH(t *testing.T) {
+	key, signers := signingKey(t)
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url, git.WithAllowedSignersFile(signers))
+
+	signed(t, r.DeployPath(), key, "tag", "-s", "-m", "Release 1.0.0", "v1.0.0")
+
+	info, err := r.VerifyTag("v1.0.0")
+	if err != nil {
+		t.Fatalf("VerifyTag() = %v", err)
+	}
+	if !info.Good() || info.Principal != "test@example.com" || !strings.HasPrefix(info.Fingerprint, "SHA256:") {
+		t.Errorf("VerifyTag() = %+v, want a good signature from test@example.com", info)
+	}
+	if id := run(t, r.DeployPath(), "rev-parse", "refs/tags/v1.0.0"); info.ID != id {
+		t.Errorf("VerifyTag().ID = %s, want the tag object %s", info.ID, id)
+	}
+}
+
+func TestVerifyTagSSHUntrusted(t *testing.T) {
+	key, _ := signingKey(t)
+	_, other := signingKey(t)
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url, git.WithAllowedSignersFile(other))
+
+	signed(t, r.DeployPath(), key, "tag", "-s", "-m", "Release 1.0.0", "v1.0.0")
+
+	info, err := r.VerifyTag("v1.0.0")
+	if err != nil {
+		t.Fatalf("VerifyTag() = %v", err)
+	}
+	if info.Good() || info.Principal != "" {
+		t.Errorf("VerifyTag() = %+v, want the signature not trusted", info)
+	}
+}
+
+func TestVerifyCommitSSH(t *testing.T) {
+	key, signers := signingKey(t)
+	pub, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, _ := newOrigin(t)
+
+	// the allowed signers are written out for each check
+	r := cloneOrigin(t, url, git.WithAllowedSigners(git.AllowedSigner{
+		Principal: "test@example.com",
+		Key:       strings.TrimSpace(string(pub)),
+	}))
+
+	writeFile(t, r.DeployPath(), "d", "4\n")
+	run(t, r.DeployPath(), "add", "d")
+	signed(t, r.DeployPath(), key, "commit", "-q", "-S", "-m", "four")
+
+	info, err := r.VerifyCommit("HEAD")
+	if err != nil {
+		t.Fatalf("VerifyCommit() = %v", err)
+	}
+	if !info.Good() || info.Signer != "test@example.com" {
+		t.Errorf("VerifyCommit() = %+v, want a good signature from test@example.com", info)
+	}
+
+	info, err = r.VerifyCommit("HEAD~1")
+	if err != nil || info.Status != git.SignatureUnsigned {
+		t.Errorf("VerifyCommit(HEAD~1) = %+v, %v, want it unsigned", info, err)
+	}
+
+	// the same key is trusted through a file
+	r.AllowedSigners = nil
+	r.AllowedSignersFile = signers
+	info, err = r.VerifyCommit("HEAD")
+	if err != nil || !info.Good() {
+		t.Errorf("VerifyCommit() = %+v, %v, want a good signature", info, err)
+	}
+}
@@ -0,0 +1,355 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileState is the state of a file in the index or the work tree, as the
+// letter git status shows for it
+type FileState byte
+
+const (
+	FileUnmodified  FileState = '.'
+	FileModified    FileState = 'M'
+	FileTypeChanged FileState = 'T'
+	FileAdded       FileState = 'A'
+	FileDeleted     FileState = 'D'
+	FileRenamed     FileState = 'R'
+	FileCopied      FileState = 'C'
+	// FileUnmerged marks the side of a conflicted file that is unmerged
+	FileUnmerged FileState = 'U'
+	// FileUntracked is the state of both sides of an untracked file
+	FileUntracked FileState = '?'
+)
+
+func (s FileState) String() string {
+	switch s {
+	case FileUnmodified:
+		return "unmodified"
+	case FileModified:
+		return "modified"
+	case FileTypeChanged:
+		return "type changed"
+	case FileAdded:
+		return "added"
+	case FileDeleted:
+		return "deleted"
+	case FileRenamed:
+		return "renamed"
+	case FileCopied:
+		return "copied"
+	case FileUnmerged:
+		return "unmerged"
+	case FileUntracked:
+		return "untracked"
+	}
+	return string(s)
+}
+
+// StatusEntry describes a file that differs from HEAD, or is untracked
+type StatusEntry struct {
+	Path string
+	// OrigPath is the path a renamed or copied file was staged from
+	OrigPath string
+	// Staged is the state of the file in the index, compared to HEAD, and
+	// Worktree its state in the work tree, compared to the index. For
+	// conflicted files they describe each side of the merge instead, e.g.
+	// "UU" for a file both sides modified, or "AA" for one both added
+	Staged   FileState
+	Worktree FileState
+}
+
+// Status lists the files in the work tree that differ from HEAD. A file
+// with staged changes and further ones in the work tree is in both Staged
+// and Modified
+type Status struct {
+	// Staged are the files with changes in the index
+	Staged []StatusEntry
+	// Modified are the tracked files with changes in the work tree that
+	// aren't staged
+	Modified []StatusEntry
+	// Untracked are the files git doesn't track and doesn't ignore
+	Untracked []StatusEntry
+	// Conflicted are the files left unmerged by a merge, rebase or stash
+	// that stopped
+	Conflicted []StatusEntry
+}
+
+// Clean reports whether nothing in the work tree differs from HEAD,
+// including untracked files
+func (s *Status) Clean() bool {
+	return len(s.Staged) == 0 && len(s.Modified) == 0 && len(s.Untracked) == 0 && len(s.Conflicted) == 0
+}
+
+// HasConflicts reports whether any files are unmerged
+func (s *Status) HasConflicts() bool {
+	return len(s.Conflicted) > 0
+}
+
+// Status returns the state of the work tree. Untracked files are listed
+// individually, rather than by the directories holding them, and ignored
+// files are left out
+func (r *Repo) Status() (*Status, error) {
+	return r.StatusContext(context.Background())
+}
+
+// StatusContext returns the state of the work tree, aborting if ctx is
+// done
+func (r *Repo) StatusContext(ctx context.Context) (*Status, error) {
+	if r.bare {
+		return nil, fmt.Errorf("could not read work tree status: %w", ErrBareRepo)
+	}
+
+	err := r.requireVersion(ctx, "--porcelain=v2", 2, 11)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not read work tree status", "status", "--porcelain=v2", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+
+	return parseStatus(output)
+}
+
+// parseStatus reads the output of git status --porcelain=v2 -z. Each
+// entry starts with its kind: "1" for changed files, "2" for renamed or
+// copied ones, followed by an entry holding the original path, "u" for
+// unmerged ones, and "?" and "!" for untracked and ignored ones
+func parseStatus(output []byte) (*Status, error) {
+	s := &Status{}
+
+	entries := strings.Split(string(output), "\x00")
+	for i := 0; i < len(entries); i++ {
+		e := entries[i]
+		if e == "" {
+			continue
+		}
+
+		// fields coming before the path, which may contain spaces
+		var n int
+		switch e[0] {
+		case '1':
+			n = 8
+		case '2':
+			n = 9
+		case 'u':
+			n = 10
+		case '?':
+			s.Untracked = append(s.Untracked, StatusEntry{Path: e[2:], Staged: FileUntracked, Worktree: FileUntracked})
+			continue
+		default:
+			continue
+		}
+
+		fields := strings.SplitN(e, " ", n+1)
+		if len(fields) != n+1 || len(fields[1]) != 2 {
+			return nil, fmt.Errorf("could not parse work tree status entry %q", e)
+		}
+
+		entry := StatusEntry{
+			Path:     fields[n],
+			Staged:   FileState(fields[1][0]),
+			Worktree: FileState(fields[1][1]),
+		}
+
+		if e[0] == '2' {
+			i++
+			if i == len(entries) {
+				return nil, fmt.Errorf("could not parse work tree status entry %q", e)
+			}
+			entry.OrigPath = entries[i]
+		}
+
+		if e[0] == 'u' {
+			s.Conflicted = append(s.Conflicted, entry)
+			continue
+		}
+
+		if entry.Staged != FileUnmodified {
+			s.Staged = append(s.Staged, entry)
+		}
+		if entry.Worktree != FileUnmodified {
+			s.Modified = append(s.Modified, entry)
+		}
+	}
+
+	return s, nil
+}
+
+// IsClean reports whether the work tree has no uncommitted changes to
+// tracked files, nor to untracked ones if DirtyUntracked is set, and no
+// merge, rebase, cherry-pick or revert stopped part way through in it. It
+// is cheaper than Status. CheckClean says why a work tree isn't clean
+func (r *Repo) IsClean() (bool, error) {
+	return r.IsCleanContext(context.Background())
+}
+
+// IsCleanContext reports whether the work tree is clean, aborting if ctx
+// is done
+func (r *Repo) IsCleanContext(ctx context.Context) (bool, error) {
+	err := r.CheckCleanContext(ctx)
+
+	var derr *DirtyError
+	if errors.As(err, &derr) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// CheckClean returns a *DirtyError saying why the work tree isn't clean,
+// as IsClean decides, or nil if it is
+func (r *Repo) CheckClean() error {
+	return r.CheckCleanContext(context.Background())
+}
+
+// CheckCleanContext returns a *DirtyError if the work tree isn't clean,
+// aborting if ctx is done
+func (r *Repo) CheckCleanContext(ctx context.Context) error {
+	if r.bare {
+		return fmt.Errorf("could not read work tree status: %w", ErrBareRepo)
+	}
+
+	untracked := "--untracked-files=no"
+	if r.DirtyUntracked {
+		untracked = "--untracked-files=normal"
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not read work tree status", "status", "--porcelain", "-z", untracked)
+	if err != nil {
+		return err
+	}
+
+	paths := parseStatusPaths(output)
+	op := r.inProgress()
+	if len(paths) > 0 || op != "" {
+		return &DirtyError{Paths: paths, Operation: op}
+	}
+
+	return nil
+}
+
+// inProgress names the operation that stopped part way through in the
+// work tree, e.g. "merge", or returns "" if there is none
+func (r *Repo) inProgress() string {
+	ops := []struct {
+		name string
+		path string
+	}{
+		{"merge", "MERGE_HEAD"},
+		{"rebase", "rebase-merge"},
+		{"rebase", "rebase-apply"},
+		{"cherry-pick", "CHERRY_PICK_HEAD"},
+		{"revert", "REVERT_HEAD"},
+	}
+
+	for _, op := range ops {
+		_, err := os.Stat(filepath.Join(r.gitDir(), op.path))
+		if err == nil {
+			return op.name
+		}
+	}
+
+	return ""
+}
+
+// UntrackedOptions configures which files UntrackedFiles lists
+type UntrackedOptions struct {
+	// Ignored lists the files .gitignore and the like exclude too
+	Ignored bool
+}
+
+// UntrackedFiles returns the paths, relative to the work tree, of the
+// files git doesn't track and doesn't ignore, or an empty slice if there
+// are none
+func (r *Repo) UntrackedFiles() ([]string, error) {
+	return r.UntrackedFilesWithOptionsContext(context.Background(), UntrackedOptions{})
+}
+
+// UntrackedFilesContext returns the paths of the files git doesn't track
+// and doesn't ignore, aborting if ctx is done
+func (r *Repo) UntrackedFilesContext(ctx context.Context) ([]string, error) {
+	return r.UntrackedFilesWithOptionsContext(ctx, UntrackedOptions{})
+}
+
+// UntrackedFilesWithOptions returns the paths of the files git doesn't
+// track, as configured by opts
+func (r *Repo) UntrackedFilesWithOptions(opts UntrackedOptions) ([]string, error) {
+	return r.UntrackedFilesWithOptionsContext(context.Background(), opts)
+}
+
+// UntrackedFilesWithOptionsContext returns the paths of the files git
+// doesn't track, as configured by opts, aborting if ctx is done
+func (r *Repo) UntrackedFilesWithOptionsContext(ctx context.Context, opts UntrackedOptions) ([]string, error) {
+	if r.bare {
+		return nil, fmt.Errorf("could not list untracked files: %w", ErrBareRepo)
+	}
+
+	args := []string{"ls-files", "--others", "-z"}
+	if !opts.Ignored {
+		args = append(args, "--exclude-standard")
+	}
+
+	output, err := r.output(ctx, r.deploymentPath, "could not list untracked files", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := splitNul(output)
+	if paths == nil {
+		paths = []string{}
+	}
+
+	return paths, nil
+}
+
+// FileChange is a tracked file that differs from HEAD
+type FileChange struct {
+	Path string
+	// Change is how the file differs: FileModified, FileTypeChanged,
+	// FileDeleted, FileAdded for files staged as new, or FileUnmerged
+	Change FileState
+}
+
+// ModifiedFiles returns the tracked files whose content differs from
+// HEAD, whether the changes are staged or only in the work tree, or an
+// empty slice if there are none. Untracked files are left out; they are
+// listed by UntrackedFiles
+func (r *Repo) ModifiedFiles() ([]FileChange, error) {
+	return r.ModifiedFilesContext(context.Background())
+}
+
+// ModifiedFilesContext returns the tracked files whose content differs
+// from HEAD, aborting if ctx is done
+func (r *Repo) ModifiedFilesContext(ctx context.Context) ([]FileChange, error) {
+	if r.bare {
+		return nil, fmt.Errorf("could not list modified files: %w", ErrBareRepo)
+	}
+
+	// renames are listed as a deletion and an addition, so every path
+	// comes with its own change
+	output, err := r.output(ctx, r.deploymentPath, "could not list modified files", "diff", "--name-status", "--no-renames", "-z", "HEAD", "--")
+	if err != nil {
+		return nil, err
+	}
+
+	// "M\x00path\x00D\x00other\x00"
+	changes := []FileChange{}
+	entries := splitNul(output)
+	for i := 0; i+1 < len(entries); i += 2 {
+		changes = append(changes, FileChange{Path: entries[i+1], Change: FileState(entries[i][0])})
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,183 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/r3labs/verify/git"
+)
+
+// statusPaths returns the paths of entries, joined by commas
+func statusPaths(entries []git.StatusEntry) string {
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		// change makes the work tree in dir dirty
+		change func(t *testing.T, dir string)
+		// staged, modified and untracked are the paths Status lists
+		staged, modified, untracked string
+		// dirty is the paths CheckClean complains about, and blocks
+		// whether Checkout refuses to switch branches
+		dirty  string
+		blocks bool
+	}{
+		{
+			name:   "clean",
+			change: func(t *testing.T, dir string) {},
+		},
+		{
+			name: "modified",
+			change: func(t *testing.T, dir string) {
+				writeFile(t, dir, "a", "changed\n")
+			},
+			modified: "a",
+			dirty:    "a",
+			blocks:   true,
+		},
+		{
+			name: "staged",
+			change: func(t *testing.T, dir string) {
+				writeFile(t, dir, "new", "1\n")
+				run(t, dir, "add", "new")
+			},
+			staged: "new",
+			dirty:  "new",
+			blocks: true,
+		},
+		{
+			name: "staged and modified",
+			change: func(t *testing.T, dir string) {
+				writeFile(t, dir, "b", "staged\n")
+				run(t, dir, "add", "b")
+				writeFile(t, dir, "b", "modified\n")
+			},
+			staged:   "b",
+			modified: "b",
+			dirty:    "b",
+			blocks:   true,
+		},
+		{
+			name: "untracked only",
+			change: func(t *testing.T, dir string) {
+				writeFile(t, dir, "untracked", "1\n")
+			},
+			untracked: "untracked",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, _ := newOrigin(t)
+			r := cloneOrigin(t, url)
+			tt.change(t, r.DeployPath())
+
+			s, err := r.Status()
+			if err != nil {
+				t.Fatalf("Status() = %v", err)
+			}
+			if got := statusPaths(s.Staged); got != tt.staged {
+				t.Errorf("Staged = %q, want %q", got, tt.staged)
+			}
+			if got := statusPaths(s.Modified); got != tt.modified {
+				t.Errorf("Modified = %q, want %q", got, tt.modified)
+			}
+			if got := statusPaths(s.Untracked); got != tt.untracked {
+				t.Errorf("Untracked = %q, want %q", got, tt.untracked)
+			}
+			if clean := tt.staged == "" && tt.modified == "" && tt.untracked == ""; s.Clean() != clean {
+				t.Errorf("Clean() = %v, want %v", s.Clean(), clean)
+			}
+
+			clean, err := r.IsClean()
+			if err != nil {
+				t.Fatalf("IsClean() = %v", err)
+			}
+			if clean != (tt.dirty == "") {
+				t.Errorf("IsClean() = %v, want %v", clean, tt.dirty == "")
+			}
+
+			err = r.CheckClean()
+			var derr *git.DirtyError
+			switch {
+			case tt.dirty == "" && err != nil:
+				t.Errorf("CheckClean() = %v, want nil", err)
+			case tt.dirty != "" && !errors.As(err, &derr):
+				t.Errorf("CheckClean() = %v, want a *DirtyError", err)
+			case tt.dirty != "" && strings.Join(derr.Paths, ",") != tt.dirty:
+				t.Errorf("CheckClean() paths = %q, want %q", derr.Paths, tt.dirty)
+			}
+
+			err = r.Checkout("develop")
+			if tt.blocks != errors.Is(err, git.ErrDirtyWorkTree) {
+				t.Errorf("Checkout() = %v, want it refused %v", err, tt.blocks)
+			}
+			if !tt.blocks && err != nil {
+				t.Errorf("Checkout() = %v", err)
+			}
+		})
+	}
+}
+
+func TestDirtyUntracked(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url, git.WithDirtyUntracked())
+	writeFile(t, r.DeployPath(), "untracked", "1\n")
+
+	err := r.CheckClean()
+	var derr *git.DirtyError
+	if !errors.As(err, &derr) || strings.Join(derr.Paths, ",") != "untracked" {
+		t.Errorf("CheckClean() = %v, want untracked to be dirty", err)
+	}
+
+	err = r.Sync("develop")
+	if !errors.Is(err, git.ErrDirtyWorkTree) {
+		t.Errorf("Sync() = %v, want ErrDirtyWorkTree", err)
+	}
+}
+
+func TestDirtyRefused(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url)
+	writeFile(t, r.DeployPath(), "a", "changed\n")
+	writeFile(t, r.DeployPath(), "untracked", "new\n")
+
+	err := r.Checkout("develop")
+	var dirty *git.DirtyError
+	if !errors.As(err, &dirty) || !errors.Is(err, git.ErrDirtyWorkTree) {
+		t.Fatalf("Checkout() = %v, want a *DirtyError", err)
+	}
+	if strings.Join(dirty.Paths, ",") != "a" {
+		t.Errorf("Paths = %q, want only the changed tracked file", dirty.Paths)
+	}
+
+	err = r.Sync("develop")
+	if !errors.Is(err, git.ErrDirtyWorkTree) {
+		t.Errorf("Sync() = %v, want ErrDirtyWorkTree", err)
+	}
+	if branch, _ := r.Branch(); branch != "master" {
+		t.Errorf("HEAD is on %s after a refused checkout, want master", branch)
+	}
+}
+
+func TestAllowDirty(t *testing.T) {
+	url, _ := newOrigin(t)
+	r := cloneOrigin(t, url, git.WithAllowDirty())
+	writeFile(t, r.DeployPath(), "a", "changed\n")
+
+	err := r.Checkout("develop")
+	if err != nil {
+		t.Errorf("Checkout() = %v, want local changes carried over", err)
+	}
+}
@@ -0,0 +1,446 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tag is a tag, as read from the repo
+type Tag struct {
+	Name string
+	// ID is the id of the object the tag points to: its tag object if it
+	// is annotated, otherwise the commit
+	ID string
+	// Commit is the id of the commit the tag points to, peeling annotated
+	// tags
+	Commit string
+	// Annotated is set for tags with a tag object of their own, which the
+	// tagger fields and Message are read from
+	Annotated   bool
+	TaggerName  string
+	TaggerEmail string
+	TaggerTime  time.Time
+	Message     string
+}
+
+// tagFormat has for-each-ref write each field of a tag NUL terminated
+const tagFormat = "--format=%(refname)%00%(objecttype)%00%(objectname)%00%(*objectname)%00%(taggername)%00%(taggeremail)%00%(taggerdate:iso-strict)%00%(contents)%00"
+
+// tagFields is the number of fields tagFormat writes per tag
+const tagFields = 8
+
+// Tags lists the names of the repo's local tags, sorted by name, or an
+// empty slice if there are none
+func (r *Repo) Tags() ([]string, error) {
+	return r.TagsContext(context.Background())
+}
+
+// TagsContext lists the names of the repo's local tags, aborting if ctx is
+// done
+func (r *Repo) TagsContext(ctx context.Context) ([]string, error) {
+	return r.refNames(ctx, "could not list tags", "refs/tags/")
+}
+
+// TagsAt lists the tags pointing at the commit ref names, sorted by name,
+// or an empty slice if there are none. Annotated tags are peeled, so they
+// are listed too. ErrRefNotFound is returned if ref doesn't name a commit
+func (r *Repo) TagsAt(ref string) ([]string, error) {
+	return r.TagsAtContext(context.Background(), ref)
+}
+
+// TagsAtContext lists the tags pointing at the commit ref names, aborting
+// if ctx is done
+func (r *Repo) TagsAtContext(ctx context.Context, ref string) ([]string, error) {
+	id, err := r.CommitIDForContext(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.refNames(ctx, "could not list tags at "+ref, "refs/tags/", "--points-at="+id)
+}
+
+// ListTags returns the repo's local tags, lightweight and annotated,
+// sorted by name, or an empty slice if there are none
+func (r *Repo) ListTags() ([]Tag, error) {
+	return r.ListTagsContext(context.Background())
+}
+
+// ListTagsContext returns the repo's local tags, aborting if ctx is done
+func (r *Repo) ListTagsContext(ctx context.Context) ([]Tag, error) {
+	return r.listTags(ctx, "refs/tags/")
+}
+
+// listTags returns the tags whose refs match pattern
+func (r *Repo) listTags(ctx context.Context, pattern string, args ...string) ([]Tag, error) {
+	args = append(append([]string{"for-each-ref", tagFormat}, args...), pattern)
+
+	output, err := r.output(ctx, r.deploymentPath, "could not list tags", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// each tag is terminated by a newline after its last field
+	fields := strings.Split(string(output), "\x00")
+	fields = fields[:len(fields)-1]
+	if len(fields)%tagFields != 0 {
+		return nil, fmt.Errorf("could not list tags: unexpected output from git")
+	}
+
+	tags := make([]Tag, 0, len(fields)/tagFields)
+	for i := 0; i < len(fields); i += tagFields {
+		tag, err := parseTag(fields[i : i+tagFields])
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
+
+// parseTag reads a tag from its tagFormat fields
+func parseTag(f []string) (Tag, error) {
+	tag := Tag{
+		Name:   strings.TrimPrefix(strings.TrimPrefix(f[0], "\n"), "refs/tags/"),
+		ID:     f[2],
+		Commit: f[2],
+	}
+
+	if f[1] != "tag" {
+		return tag, nil
+	}
+
+	tag.Annotated = true
+	tag.Commit = f[3]
+	tag.TaggerName = f[4]
+	tag.TaggerEmail = strings.TrimSuffix(strings.TrimPrefix(f[5], "<"), ">")
+	tag.Message = strings.TrimSuffix(f[7], "\n")
+
+	if f[6] != "" {
+		tagged, err := time.Parse(time.RFC3339, f[6])
+		if err != nil {
+			return Tag{}, fmt.Errorf("could not parse date of tag %s: %w", tag.Name, err)
+		}
+		tag.TaggerTime = tagged
+	}
+
+	return tag, nil
+}
+
+// TagOptions change how tags are created
+type TagOptions struct {
+	// Message makes the tag annotated, with it as the message. Tags
+	// without one are lightweight
+	Message string
+	// Force moves the tag if it already exists
+	Force bool
+}
+
+// Tag creates the tag name at ref, or HEAD if ref is empty. The tag is
+// annotated with message, or lightweight if message is empty. It fails
+// with ErrTagExists if the tag is already there, and with ErrRefNotFound
+// if ref doesn't name a commit
+func (r *Repo) Tag(name, ref, message string) error {
+	return r.TagWithOptionsContext(context.Background(), name, ref, TagOptions{Message: message})
+}
+
+// TagContext creates the tag name at ref, aborting if ctx is done
+func (r *Repo) TagContext(ctx context.Context, name, ref, message string) error {
+	return r.TagWithOptionsContext(ctx, name, ref, TagOptions{Message: message})
+}
+
+// TagWithOptions creates the tag name at ref, as set by opts
+func (r *Repo) TagWithOptions(name, ref string, opts TagOptions) error {
+	return r.TagWithOptionsContext(context.Background(), name, ref, opts)
+}
+
+// TagWithOptionsContext creates the tag name at ref, as set by opts,
+// aborting if ctx is done
+func (r *Repo) TagWithOptionsContext(ctx context.Context, name, ref string, opts TagOptions) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	id, err := r.CommitIDForContext(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"tag"}
+	if opts.Force {
+		args = append(args, "--force")
+	}
+	if opts.Message != "" {
+		args = append(args, "--annotate", "--message="+opts.Message)
+	}
+	args = append(args, name, id)
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not create tag "+name, args...)
+	return err
+}
+
+// DeleteTag deletes the local tag name, and if remote is set, the tag of
+// that name on origin too. A tag origin doesn't have is not an error, as
+// someone else may have deleted it first, but ErrTagNotFound is returned
+// if there is no local tag, after deleting origin's
+func (r *Repo) DeleteTag(name string, remote bool) error {
+	return r.DeleteTagContext(context.Background(), name, remote)
+}
+
+// DeleteTagContext deletes the local tag name, and if remote is set,
+// origin's, aborting if ctx is done
+func (r *Repo) DeleteTagContext(ctx context.Context, name string, remote bool) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, "could not delete tag "+name, "tag", "--delete", name)
+	if err != nil && (!remote || !errors.Is(err, ErrTagNotFound)) {
+		return err
+	}
+
+	if remote {
+		perr := r.push(ctx, "could not delete tag "+name+" from origin", PushOptions{}, ":refs/tags/"+name)
+
+		var gerr *GitError
+		if errors.As(perr, &gerr) && strings.Contains(gerr.Stderr, "remote ref does not exist") {
+			perr = nil
+		}
+		if perr != nil {
+			return perr
+		}
+	}
+
+	return err
+}
+
+// PushOptions change how refs are pushed
+type PushOptions struct {
+	// Force overwrites the refs on the remote, even if they point
+	// elsewhere
+	Force bool
+}
+
+// PushTag pushes the tag name to origin, authenticating as Fetch does. If
+// origin refuses it, e.g. because it has a different tag of that name or
+// protects tags, a *RejectedError with origin's reasons is returned
+func (r *Repo) PushTag(name string) error {
+	return r.PushTagWithOptionsContext(context.Background(), name, PushOptions{})
+}
+
+// PushTagContext pushes the tag name to origin, aborting if ctx is done
+func (r *Repo) PushTagContext(ctx context.Context, name string) error {
+	return r.PushTagWithOptionsContext(ctx, name, PushOptions{})
+}
+
+// PushTagWithOptions pushes the tag name to origin, as set by opts
+func (r *Repo) PushTagWithOptions(name string, opts PushOptions) error {
+	return r.PushTagWithOptionsContext(context.Background(), name, opts)
+}
+
+// PushTagWithOptionsContext pushes the tag name to origin, as set by opts,
+// aborting if ctx is done
+func (r *Repo) PushTagWithOptionsContext(ctx context.Context, name string, opts PushOptions) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	ref := "refs/tags/" + name
+	return r.push(ctx, "could not push tag "+name, opts, ref+":"+ref)
+}
+
+// PushAllTags pushes all local tags to origin. Tags origin refuses are
+// listed by the returned *RejectedError, the others are still pushed
+func (r *Repo) PushAllTags() error {
+	return r.PushAllTagsWithOptionsContext(context.Background(), PushOptions{})
+}
+
+// PushAllTagsContext pushes all local tags to origin, aborting if ctx is
+// done
+func (r *Repo) PushAllTagsContext(ctx context.Context) error {
+	return r.PushAllTagsWithOptionsContext(ctx, PushOptions{})
+}
+
+// PushAllTagsWithOptions pushes all local tags to origin, as set by opts
+func (r *Repo) PushAllTagsWithOptions(opts PushOptions) error {
+	return r.PushAllTagsWithOptionsContext(context.Background(), opts)
+}
+
+// PushAllTagsWithOptionsContext pushes all local tags to origin, as set by
+// opts, aborting if ctx is done
+func (r *Repo) PushAllTagsWithOptionsContext(ctx context.Context, opts PushOptions) error {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return r.push(ctx, "could not push tags", opts, "--tags")
+}
+
+// push pushes args, refspecs or options selecting them, to origin
+func (r *Repo) push(ctx context.Context, msg string, opts PushOptions, args ...string) (err error) {
+	defer r.observe("push", time.Now(), &err)
+
+	flags := []string{"push", "--porcelain"}
+	if opts.Force {
+		flags = append(flags, "--force")
+	}
+
+	stdout, stderr, err := r.mutate(ctx, r.deploymentPath, msg, append(append(flags, "origin"), args...)...)
+	if err != nil {
+		return pushError(msg, stdout, stderr, err)
+	}
+
+	return nil
+}
+
+// pushError returns a *RejectedError if the refs origin refused are listed
+// in push's porcelain output, or err otherwise
+func pushError(msg string, stdout, stderr []byte, err error) error {
+	rerr := &RejectedError{Refs: map[string]string{}}
+
+	// "!\trefs/tags/v1:refs/tags/v1\t[rejected] (already exists)"
+	for _, line := range strings.Split(string(stdout), "\n") {
+		f := strings.Split(line, "\t")
+		if len(f) != 3 || f[0] != "!" {
+			continue
+		}
+
+		ref := f[1]
+		if i := strings.LastIndex(ref, ":"); i >= 0 {
+			ref = ref[i+1:]
+		}
+
+		reason := f[2]
+		if i := strings.Index(reason, "("); i >= 0 {
+			reason = strings.TrimSuffix(reason[i+1:], ")")
+		}
+		rerr.Refs[ref] = reason
+	}
+
+	if len(rerr.Refs) == 0 {
+		return err
+	}
+
+	// hooks on the remote explain themselves on lines prefixed "remote:"
+	var remote []string
+	for _, line := range strings.Split(string(stderr), "\n") {
+		if strings.HasPrefix(line, "remote: ") {
+			remote = append(remote, strings.TrimSpace(strings.TrimPrefix(line, "remote: ")))
+		}
+	}
+	rerr.Remote = strings.Join(remote, "\n")
+
+	return fmt.Errorf("%s: %w", msg, rerr)
+}
+
+// LatestTagOptions change how LatestTag picks a tag
+type LatestTagOptions struct {
+	// Prefix only considers tags starting with it, e.g. "v" or
+	// "service-a/v". The rest of the name must be a semantic version,
+	// optionally starting with "v"
+	Prefix string
+	// Strict fails with ErrInvalidVersion if a tag with the prefix isn't a
+	// semantic version, rather than ignoring it
+	Strict bool
+}
+
+// LatestTag returns the tag starting with prefix that has the highest
+// semantic version, e.g. "v1.10.0" over "v1.9.3", and "v1.2.0" over
+// "v1.2.0-rc.1". Tags that aren't semantic versions are ignored. ErrNoTags
+// is returned if no tag qualifies
+func (r *Repo) LatestTag(prefix string) (string, error) {
+	return r.LatestTagWithOptionsContext(context.Background(), LatestTagOptions{Prefix: prefix})
+}
+
+// LatestTagContext returns the tag starting with prefix that has the
+// highest semantic version, aborting if ctx is done
+func (r *Repo) LatestTagContext(ctx context.Context, prefix string) (string, error) {
+	return r.LatestTagWithOptionsContext(ctx, LatestTagOptions{Prefix: prefix})
+}
+
+// LatestTagWithOptions returns the tag with the highest semantic version,
+// as selected by opts
+func (r *Repo) LatestTagWithOptions(opts LatestTagOptions) (string, error) {
+	return r.LatestTagWithOptionsContext(context.Background(), opts)
+}
+
+// LatestTagWithOptionsContext returns the tag with the highest semantic
+// version, as selected by opts, aborting if ctx is done
+func (r *Repo) LatestTagWithOptionsContext(ctx context.Context, opts LatestTagOptions) (string, error) {
+	names, err := r.TagsContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var latest string
+	var latestVersion semver
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, opts.Prefix) {
+			continue
+		}
+
+		v, ok := parseSemver(strings.TrimPrefix(name, opts.Prefix))
+		if !ok {
+			if opts.Strict {
+				return "", fmt.Errorf("could not parse tag %s: %w", name, ErrInvalidVersion)
+			}
+			continue
+		}
+
+		// names are sorted, so equal versions resolve to the same tag
+		if latest == "" || v.compare(latestVersion) > 0 {
+			latest, latestVersion = name, v
+		}
+	}
+
+	if latest == "" {
+		return "", fmt.Errorf("no version tags starting with %q: %w", opts.Prefix, ErrNoTags)
+	}
+
+	return latest, nil
+}
+
+// LatestTagByDate returns the most recently created tag starting with
+// prefix, for repos whose tags aren't semantic versions. Annotated tags
+// are dated when they were tagged, lightweight ones by their commit.
+// ErrNoTags is returned if no tag qualifies
+func (r *Repo) LatestTagByDate(prefix string) (string, error) {
+	return r.LatestTagByDateContext(context.Background(), prefix)
+}
+
+// LatestTagByDateContext returns the most recently created tag starting
+// with prefix, aborting if ctx is done
+func (r *Repo) LatestTagByDateContext(ctx context.Context, prefix string) (string, error) {
+	names, err := r.refNames(ctx, "could not list tags", "refs/tags/", "--sort=-creatordate")
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no tags starting with %q: %w", prefix, ErrNoTags)
+}
@@ -0,0 +1,120 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/r3labs/verify/git"
+)
+
+// findTag returns the tag name listed by r, failing t if there is none
+func findTag(t *testing.T, r *git.Repo, name string) git.Tag {
+	t.Helper()
+
+	tags, err := r.ListTags()
+	if err != nil {
+		t.Fatalf("ListTags() = %v", err)
+	}
+	for _, tag := range tags {
+		if tag.Name == name {
+			return tag
+		}
+	}
+
+	t.Fatalf("ListTags() = %+v, want %s among them", tags, name)
+	return git.Tag{}
+}
+
+func TestTag(t *testing.T) {
+	url, work := newOrigin(t)
+	master := run(t, work, "rev-parse", "master")
+	develop := run(t, work, "rev-parse", "develop")
+
+	r := cloneOrigin(t, url)
+
+	err := r.Tag("v1.0.0", "", "")
+	if err != nil {
+		t.Fatalf("Tag() = %v", err)
+	}
+	tag := findTag(t, r, "v1.0.0")
+	if tag.Annotated || tag.ID != master || tag.Commit != master || tag.Message != "" {
+		t.Errorf("lightweight tag = %+v, want it at %s", tag, master)
+	}
+
+	err = r.Tag("v1.1.0", "origin/develop", "Release 1.1.0")
+	if err != nil {
+		t.Fatalf("Tag() = %v", err)
+	}
+	tag = findTag(t, r, "v1.1.0")
+	if !tag.Annotated || tag.ID == develop || tag.Commit != develop {
+		t.Errorf("annotated tag = %+v, want a tag object for %s", tag, develop)
+	}
+	if tag.Message != "Release 1.1.0" || tag.TaggerName != "test" || tag.TaggerEmail != "test@example.com" || tag.TaggerTime.IsZero() {
+		t.Errorf("annotated tag = %+v, want its message and tagger", tag)
+	}
+
+	names, err := r.Tags()
+	if err != nil || strings.Join(names, " ") != "v1.0.0 v1.1.0" {
+		t.Errorf("Tags() = %q, %v, want v1.0.0 v1.1.0", names, err)
+	}
+
+	// an existing tag is only moved by force
+	err = r.Tag("v1.0.0", "origin/develop", "")
+	if !errors.Is(err, git.ErrTagExists) {
+		t.Errorf("Tag() of an existing tag = %v, want ErrTagExists", err)
+	}
+	if tag = findTag(t, r, "v1.0.0"); tag.Commit != master {
+		t.Errorf("v1.0.0 moved to %s, want it left at %s", tag.Commit, master)
+	}
+
+	err = r.TagWithOptions("v1.0.0", "origin/develop", git.TagOptions{Force: true, Message: "moved"})
+	if err != nil {
+		t.Fatalf("TagWithOptions(Force) = %v", err)
+	}
+	if tag = findTag(t, r, "v1.0.0"); tag.Commit != develop || !tag.Annotated {
+		t.Errorf("forced tag = %+v, want it annotated at %s", tag, develop)
+	}
+
+	err = r.Tag("v2.0.0", "nope", "")
+	if !errors.Is(err, git.ErrRefNotFound) {
+		t.Errorf("Tag() at an unknown ref = %v, want ErrRefNotFound", err)
+	}
+}
+
+func TestDeleteTag(t *testing.T) {
+	url, work := newOrigin(t)
+	r := cloneOrigin(t, url)
+
+	err := r.Tag("v1.0.0", "", "")
+	if err != nil {
+		t.Fatalf("Tag() = %v", err)
+	}
+	err = r.PushTag("v1.0.0")
+	if err != nil {
+		t.Fatalf("PushTag() = %v", err)
+	}
+	if remote := run(t, work, "ls-remote", "--tags", "origin"); !strings.Contains(remote, "refs/tags/v1.0.0") {
+		t.Errorf("origin has tags %q, want v1.0.0 pushed", remote)
+	}
+
+	err = r.DeleteTag("v1.0.0", true)
+	if err != nil {
+		t.Fatalf("DeleteTag() = %v", err)
+	}
+	if names, _ := r.Tags(); len(names) != 0 {
+		t.Errorf("Tags() = %q after DeleteTag(), want none", names)
+	}
+	if remote := run(t, work, "ls-remote", "--tags", "origin"); remote != "" {
+		t.Errorf("origin has tags %q, want v1.0.0 deleted", remote)
+	}
+
+	err = r.DeleteTag("v1.0.0", false)
+	if !errors.Is(err, git.ErrTagNotFound) {
+		t.Errorf("DeleteTag() of a missing tag = %v, want ErrTagNotFound", err)
+	}
+}
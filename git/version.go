@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+)
+
+// DefaultGitBinary is the git executable used by repos that don't set
+// GitBinary. A bare name is looked up in PATH
+var DefaultGitBinary = "git"
+
+// versionPattern matches the version in the output of git --version, e.g.
+// "git version 2.39.2" or "git version 2.37.1 (Apple Git-137.1)"
+var versionPattern = regexp.MustCompile(`git version (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// Version is a git release
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast reports whether v is the given release or newer
+func (v Version) AtLeast(major, minor int) bool {
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
+
+// Version returns the version of the git binary used by the repo
+func (r *Repo) Version() (Version, error) {
+	return r.VersionContext(context.Background())
+}
+
+// VersionContext returns the version of the git binary used by the repo,
+// aborting if ctx is done. The result is cached on the repo
+func (r *Repo) VersionContext(ctx context.Context) (Version, error) {
+	r.mu.Lock()
+	cached := r.version
+	r.mu.Unlock()
+
+	if cached != nil {
+		return *cached, nil
+	}
+
+	output, err := r.output(ctx, "", "could not get git version", "--version")
+	if err != nil {
+		return Version{}, err
+	}
+
+	m := versionPattern.FindSubmatch(output)
+	if m == nil {
+		return Version{}, fmt.Errorf("could not parse git version %q", output)
+	}
+
+	var v Version
+	v.Major, _ = strconv.Atoi(string(m[1]))
+	v.Minor, _ = strconv.Atoi(string(m[2]))
+	v.Patch, _ = strconv.Atoi(string(m[3]))
+
+	r.mu.Lock()
+	r.version = &v
+	r.mu.Unlock()
+
+	return v, nil
+}
+
+// gitBinary returns the git executable the repo runs
+func (r *Repo) gitBinary() string {
+	if r.GitBinary != "" {
+		return r.GitBinary
+	}
+	return DefaultGitBinary
+}
+
+// lookGit checks that the repo's git executable exists. Repos with a
+// custom Runner may not need one
+func (r *Repo) lookGit() error {
+	if r.Runner != nil {
+		return nil
+	}
+
+	_, err := exec.LookPath(r.gitBinary())
+	if err != nil {
+		return fmt.Errorf("could not find git binary %s: %w", r.gitBinary(), err)
+	}
+	return nil
+}
+
+// cloneFeatures lists the oldest git release supporting each clone option
+// that has not been around forever
+var cloneFeatures = []struct {
+	name         string
+	major, minor int
+	used         func(r *Repo) bool
+}{
+	{"partial clone", 2, 19, func(r *Repo) bool { return r.filter != "" }},
+	{"--recurse-submodules", 2, 13, func(r *Repo) bool { return r.submodules }},
+	{"--dissociate", 2, 3, func(r *Repo) bool { return r.reference != "" && r.dissociate }},
+}
+
+// requireVersion returns an ErrUnsupportedVersion error if feature needs
+// a newer git than the one installed
+func (r *Repo) requireVersion(ctx context.Context, feature string, major, minor int) error {
+	v, err := r.VersionContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !v.AtLeast(major, minor) {
+		return fmt.Errorf("%s needs git %d.%d, have %s: %w", feature, major, minor, v, ErrUnsupportedVersion)
+	}
+
+	return nil
+}
+
+// checkCloneFeatures returns an ErrUnsupportedVersion error if the repo's
+// clone options need a newer git than the one installed
+func (r *Repo) checkCloneFeatures(ctx context.Context) error {
+	var v *Version
+
+	for _, f := range cloneFeatures {
+		if !f.used(r) {
+			continue
+		}
+
+		if v == nil {
+			version, err := r.VersionContext(ctx)
+			if err != nil {
+				return err
+			}
+			v = &version
+		}
+
+		if !v.AtLeast(f.major, f.minor) {
+			return fmt.Errorf("%s needs git %d.%d, have %s: %w", f.name, f.major, f.minor, v, ErrUnsupportedVersion)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,194 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package git
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CleanOptions configures what Clean removes
+type CleanOptions struct {
+	// Directories removes untracked directories, not only untracked files
+	// in tracked ones
+	Directories bool
+	// Ignored removes the files .gitignore and the like exclude too
+	Ignored bool
+	// DryRun lists what would be removed without removing anything
+	DryRun bool
+}
+
+// Clean removes the untracked files from the work tree, as configured by
+// opts, returning their paths relative to the work tree, or an empty
+// slice if there were none. A DryRun repo returns what would be removed
+// and records the real command
+func (r *Repo) Clean(opts CleanOptions) ([]string, error) {
+	return r.CleanContext(context.Background(), opts)
+}
+
+// CleanContext removes the untracked files from the work tree, as
+// configured by opts, aborting if ctx is done
+func (r *Repo) CleanContext(ctx context.Context, opts CleanOptions) ([]string, error) {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if r.bare {
+		return nil, fmt.Errorf("could not clean work tree: %w", ErrBareRepo)
+	}
+
+	// without --force git refuses to clean unless told otherwise in config
+	args := []string{"clean", "--force"}
+	if opts.Directories {
+		args = append(args, "-d")
+	}
+	if opts.Ignored {
+		args = append(args, "-x")
+	}
+
+	var output []byte
+
+	if opts.DryRun || r.DryRun {
+		output, err = r.output(ctx, r.deploymentPath, "could not list files to clean", append(args, "--dry-run")...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !opts.DryRun {
+		var stdout []byte
+		stdout, _, err = r.mutate(ctx, r.deploymentPath, "could not clean work tree", args...)
+		if err != nil {
+			return nil, err
+		}
+		if !r.DryRun {
+			output = stdout
+		}
+	}
+
+	return parseClean(output), nil
+}
+
+// parseClean reads the paths from the output of git clean, where each
+// line is "Removing path" or "Would remove path". Paths with unusual
+// characters are quoted as in C
+func parseClean(output []byte) []string {
+	paths := []string{}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		var path string
+		switch {
+		case strings.HasPrefix(line, "Removing "):
+			path = strings.TrimPrefix(line, "Removing ")
+		case strings.HasPrefix(line, "Would remove "):
+			path = strings.TrimPrefix(line, "Would remove ")
+		default:
+			continue
+		}
+
+		if strings.HasPrefix(path, `"`) {
+			unquoted, err := strconv.Unquote(path)
+			if err == nil {
+				path = unquoted
+			}
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+// ResetOptions configures ResetHardWithOptions
+type ResetOptions struct {
+	// Force resets even though a merge, rebase, cherry-pick or revert is in
+	// progress, leaving git to make what it can of it
+	Force bool
+	// Abort aborts a merge, rebase, cherry-pick or revert in progress
+	// before resetting
+	Abort bool
+}
+
+// ResetHard moves HEAD, and the checked out branch if there is one, to
+// ref, discarding every change to tracked files. It returns the ids of the
+// commits HEAD was at before and after. ErrRefNotFound is returned if ref
+// doesn't name a commit, and a *DirtyError if a merge, rebase, cherry-pick
+// or revert is in progress
+func (r *Repo) ResetHard(ref string) (from, to string, err error) {
+	return r.ResetHardWithOptionsContext(context.Background(), ref, ResetOptions{})
+}
+
+// ResetHardContext moves HEAD to ref, discarding every change to tracked
+// files, aborting if ctx is done
+func (r *Repo) ResetHardContext(ctx context.Context, ref string) (from, to string, err error) {
+	return r.ResetHardWithOptionsContext(ctx, ref, ResetOptions{})
+}
+
+// ResetHardWithOptions moves HEAD to ref, discarding every change to
+// tracked files, as configured by opts
+func (r *Repo) ResetHardWithOptions(ref string, opts ResetOptions) (from, to string, err error) {
+	return r.ResetHardWithOptionsContext(context.Background(), ref, opts)
+}
+
+// ResetHardWithOptionsContext moves HEAD to ref, discarding every change
+// to tracked files, as configured by opts, aborting if ctx is done
+func (r *Repo) ResetHardWithOptionsContext(ctx context.Context, ref string, opts ResetOptions) (from, to string, err error) {
+	ctx, unlock, err := r.lock(ctx, true)
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+
+	msg := "could not reset to " + ref
+
+	if r.bare {
+		return "", "", fmt.Errorf("%s: %w", msg, ErrBareRepo)
+	}
+
+	to, err = r.CommitIDForContext(ctx, ref)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch op := r.inProgress(); {
+	case op == "":
+	case opts.Abort:
+		err = r.abortInProgress(ctx)
+		if err != nil {
+			return "", "", err
+		}
+	case !opts.Force:
+		return "", "", fmt.Errorf("%s: %w", msg, &DirtyError{Operation: op})
+	}
+
+	// aborting a rebase moves HEAD back to where it started
+	from, err = r.CommitIDForContext(ctx, "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+
+	_, _, err = r.mutate(ctx, r.deploymentPath, msg, "reset", "--quiet", "--hard", to)
+	if err != nil {
+		return "", "", err
+	}
+
+	return from, to, nil
+}
+
+// abortInProgress aborts the merge, rebase, cherry-pick or revert in
+// progress in the work tree, if there is one
+func (r *Repo) abortInProgress(ctx context.Context) error {
+	op := r.inProgress()
+	if op == "" {
+		return nil
+	}
+
+	_, _, err := r.mutate(ctx, r.deploymentPath, "could not abort "+op, op, "--abort")
+	return err
+}